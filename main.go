@@ -26,25 +26,35 @@ import (
 
 	"github.com/go-logr/zapr"
 	"github.com/openshift/library-go/pkg/controller/controllercmd"
+	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/stolostron/go-log-utils/zaputil"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/rest"
 	utilflag "k8s.io/component-base/cli/flag"
 	"k8s.io/component-base/logs"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/clock"
 	"open-cluster-management.io/addon-framework/pkg/addonmanager"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	crwebhook "sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	policyaddon "open-cluster-management.io/governance-policy-addon-controller/pkg/addon"
 	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/certpolicy"
 	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/configpolicy"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/gatekeepersync"
 	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/policyframework"
 	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/standalonetemplating"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/render"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/webhook"
 )
 
 //+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=get;create
+//+kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
 //+kubebuilder:rbac:groups=certificates.k8s.io,resources=certificatesigningrequests;certificatesigningrequests/approval,verbs=get;list;watch;create;update
 //+kubebuilder:rbac:groups=certificates.k8s.io,resources=signers,verbs=approve
 //+kubebuilder:rbac:groups=cluster.open-cluster-management.io,resources=managedclusters,verbs=get;list;watch
@@ -53,26 +63,28 @@ import (
 // RBAC below will need to be updated if/when new policy controllers are added.
 
 //+kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=create
-//+kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;patch;update,resourceNames=governance-policy-framework;config-policy-controller;governance-standalone-hub-templating;cert-policy-controller
+//+kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;patch;update,resourceNames=governance-policy-framework;config-policy-controller;governance-standalone-hub-templating;cert-policy-controller;governance-policy-gatekeeper-sync
 
 //+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles,verbs=create
-//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles,verbs=get;update;patch;delete,resourceNames="open-cluster-management:policy-framework-hub";"open-cluster-management:config-policy-controller-hub";"open-cluster-management:governance-standalone-hub-templating";"open-cluster-management:cert-policy-controller-hub"
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles,verbs=get;update;patch;delete,resourceNames="open-cluster-management:policy-framework-hub";"open-cluster-management:config-policy-controller-hub";"open-cluster-management:governance-standalone-hub-templating";"open-cluster-management:cert-policy-controller-hub";"open-cluster-management:gatekeeper-sync-hub"
 //+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterrolebindings,verbs=create
 //+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterrolebindings,verbs=get;update;patch;delete,resourceNames="open-cluster-management:governance-standalone-hub-templating"
 //+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=create
-//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=get;update;patch;delete,resourceNames="open-cluster-management:policy-framework-hub";"open-cluster-management:config-policy-controller-hub";"open-cluster-management:governance-standalone-hub-templating";"open-cluster-management:cert-policy-controller-hub"
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=get;update;patch;delete,resourceNames="open-cluster-management:policy-framework-hub";"open-cluster-management:config-policy-controller-hub";"open-cluster-management:governance-standalone-hub-templating";"open-cluster-management:cert-policy-controller-hub";"open-cluster-management:gatekeeper-sync-hub"
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=list;watch,resourceNames="open-cluster-management:policy-framework-hub";"open-cluster-management:config-policy-controller-hub";"open-cluster-management:cert-policy-controller-hub";"open-cluster-management:gatekeeper-sync-hub"
 
 // Cannot limit based on resourceNames because the name is dynamic in hosted mode.
 //+kubebuilder:rbac:groups=work.open-cluster-management.io,resources=manifestworks,verbs=create;delete;get;list;patch;update;watch
 
 //+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=managedclusteraddons,verbs=create
 //+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=managedclusteraddons,verbs=get;list;watch;update
-//+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=managedclusteraddons,verbs=delete,resourceNames=config-policy-controller;governance-policy-framework;governance-standalone-hub-templating;cert-policy-controller
-//+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=managedclusteraddons/finalizers,verbs=update,resourceNames=config-policy-controller;governance-policy-framework;governance-standalone-hub-templating;cert-policy-controller
-//+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=managedclusteraddons/status,verbs=update;patch,resourceNames=config-policy-controller;governance-policy-framework;governance-standalone-hub-templating;cert-policy-controller
-//+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=clustermanagementaddons/status,verbs=update;patch,resourceNames=config-policy-controller;governance-policy-framework;governance-standalone-hub-templating;cert-policy-controller
+//+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=managedclusteraddons,verbs=delete,resourceNames=config-policy-controller;governance-policy-framework;governance-standalone-hub-templating;cert-policy-controller;governance-policy-gatekeeper-sync
+//+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=managedclusteraddons/finalizers,verbs=update,resourceNames=config-policy-controller;governance-policy-framework;governance-standalone-hub-templating;cert-policy-controller;governance-policy-gatekeeper-sync
+//+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=managedclusteraddons/status,verbs=update;patch,resourceNames=config-policy-controller;governance-policy-framework;governance-standalone-hub-templating;cert-policy-controller;governance-policy-gatekeeper-sync
+//+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=clustermanagementaddons,verbs=patch,resourceNames=config-policy-controller;governance-policy-framework;governance-standalone-hub-templating;cert-policy-controller;governance-policy-gatekeeper-sync
+//+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=clustermanagementaddons/status,verbs=update;patch,resourceNames=config-policy-controller;governance-policy-framework;governance-standalone-hub-templating;cert-policy-controller;governance-policy-gatekeeper-sync
 
-//+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=clustermanagementaddons/finalizers,verbs=update,resourceNames=config-policy-controller;governance-policy-framework;governance-standalone-hub-templating;cert-policy-controller
+//+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=clustermanagementaddons/finalizers,verbs=update,resourceNames=config-policy-controller;governance-policy-framework;governance-standalone-hub-templating;cert-policy-controller;governance-policy-gatekeeper-sync
 //+kubebuilder:rbac:groups=addon.open-cluster-management.io,resources=addondeploymentconfigs,verbs=get;list;watch
 
 // Permissions required for policy-framework
@@ -85,6 +97,7 @@ import (
 //+kubebuilder:rbac:groups=cluster.open-cluster-management.io,resources=clusterclaims,resourceNames=id.k8s.io,verbs=get
 //+kubebuilder:rbac:groups=core;events.k8s.io,resources=events,verbs=create;get;list;patch;update;watch
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=create;get;update
 //+kubebuilder:rbac:groups=config.openshift.io,resources=infrastructures,verbs=get;list;watch
 
 var (
@@ -95,6 +108,11 @@ var (
 		LevelName:   "log-level",
 		EncoderName: "log-encoder",
 	}
+	metricsAddr    string
+	secureMetrics  bool
+	enableWebhook  bool
+	webhookPort    int
+	webhookCertDir string
 )
 
 const (
@@ -105,6 +123,22 @@ func main() {
 	// Bind command line flags to the various cmd/log configurations
 	zflags.Bind(flag.CommandLine)
 	klog.InitFlags(flag.CommandLine)
+	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8443",
+		"The address the metrics endpoint binds to. Set this to \"0\" to disable the metrics endpoint.")
+	flag.BoolVar(&secureMetrics, "secure-metrics", true,
+		"Serve the metrics endpoint over HTTPS and require authentication and authorization to access it.")
+	flag.BoolVar(&enableWebhook, "enable-webhook", false,
+		"Serve the validating webhooks for the governance ManagedClusterAddOns and AddOnDeploymentConfigs.")
+	flag.IntVar(&webhookPort, "webhook-port", 9443, "The port the validating webhooks are served on.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs",
+		"The directory containing the tls.crt and tls.key files to serve the validating webhooks with.")
+	flag.BoolVar(&policyaddon.ReportValues, "report-values", true,
+		"Write the values of each addon, and where they came from, to a ConfigMap in the cluster namespace.")
+	flag.BoolVar(&policyaddon.ReportHealth, "report-health", true,
+		"Report the health of each addon agent in a ManagedClusterAddOn condition, and summarize it in "+
+			"annotations on the ClusterManagementAddOn.")
+	flag.BoolVar(&policyaddon.SeparateCRDWork, "separate-crd-work", true,
+		"Deploy the CRDs of each addon agent in a ManifestWork separate from the agent workload.")
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.CommandLine.SetNormalizeFunc(utilflag.WordSepNormalizeFunc)
 
@@ -127,11 +161,16 @@ func main() {
 	defer logs.FlushLogs()
 
 	ctrlconfig := controllercmd.NewControllerCommandConfig(ctrlName, ctrlVersion, runController, clock.RealClock{})
+	// The metrics are served by the controller-runtime metrics server started in runController instead
 	ctrlconfig.DisableServing = true
 
 	ctrlcmd := ctrlconfig.NewCommandWithContext(context.TODO())
 	ctrlcmd.Use = ctrlName
 	ctrlcmd.Short = "Governance policy addon controller for Open Cluster Management"
+	// Positional arguments such as "controller" are still accepted for the root command now that it has
+	// subcommands
+	ctrlcmd.Args = cobra.ArbitraryArgs
+	ctrlcmd.AddCommand(render.NewCommand(), render.NewDiffCommand())
 
 	if err := ctrlcmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
@@ -156,10 +195,44 @@ func runController(ctx context.Context, controllerContext *controllercmd.Control
 		configpolicy.GetAndAddAgent,
 		standalonetemplating.GetAndAddAgent,
 		certpolicy.GetAndAddAgent,
+		gatekeepersync.GetAndAddAgent,
+	}
+
+	metricsServer, err := newMetricsServer(controllerContext.KubeConfig)
+	if err != nil {
+		log.Error(err, "unable to create the metrics server")
+		os.Exit(1)
 	}
 
 	wg := sync.WaitGroup{}
 
+	if metricsServer != nil {
+		wg.Go(func() {
+			if err := metricsServer.Start(ctx); err != nil {
+				log.Error(err, "problem running the metrics server")
+				os.Exit(1)
+			}
+		})
+	}
+
+	if enableWebhook {
+		webhookServer, err := webhook.NewServer(ctx, controllerContext.KubeConfig, crwebhook.Options{
+			Port:    webhookPort,
+			CertDir: webhookCertDir,
+		})
+		if err != nil {
+			log.Error(err, "unable to create the webhook server")
+			os.Exit(1)
+		}
+
+		wg.Go(func() {
+			if err := webhookServer.Start(ctx); err != nil {
+				log.Error(err, "problem running the webhook server")
+				os.Exit(1)
+			}
+		})
+	}
+
 	for _, f := range agentFuncs {
 		err := f(ctx, mgr, controllerContext)
 		if err != nil {
@@ -184,6 +257,27 @@ func runController(ctx context.Context, controllerContext *controllercmd.Control
 	return nil
 }
 
+// newMetricsServer returns the server for the metrics of this controller, or
+// nil when the metrics endpoint is disabled. When serving securely, the
+// requests are authenticated and authorized with the Kubernetes API server.
+func newMetricsServer(kubeConfig *rest.Config) (metricsserver.Server, error) {
+	options := metricsserver.Options{
+		BindAddress:   metricsAddr,
+		SecureServing: secureMetrics,
+	}
+
+	if secureMetrics {
+		options.FilterProvider = filters.WithAuthenticationAndAuthorization
+	}
+
+	httpClient, err := rest.HTTPClientFor(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create an HTTP client for the metrics server: %w", err)
+	}
+
+	return metricsserver.NewServer(options, kubeConfig, httpClient)
+}
+
 func setupLogging() {
 	// Build controller-runtime logger
 	ctrlZap, err := zflags.BuildForCtrl()
@@ -5,7 +5,9 @@ import (
 	"embed"
 	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
 	"time"
 
 	"github.com/openshift/library-go/pkg/controller/controllercmd"
@@ -26,7 +28,11 @@ import (
 )
 
 const (
-	addonName = "cert-policy-controller"
+	addonName   = "cert-policy-controller"
+	imageEnvVar = "CERT_POLICY_CONTROLLER_IMAGE"
+	imageKey    = "cert_policy_controller"
+	// hubRoleBindingName is the name of the RoleBinding granting the agent access in its cluster namespace
+	hubRoleBindingName = "open-cluster-management:cert-policy-controller-hub"
 )
 
 type certPolicyUserValues struct {
@@ -43,6 +49,9 @@ var (
 	//go:embed manifests/managedclusterchart/templates/_helpers.tpl
 	FS embed.FS
 
+	// defaultImages returns the default images of the agent, from the chart or the environment variable
+	defaultImages = policyaddon.NewDefaultImagesFunc(FS, "manifests/managedclusterchart", imageKey, imageEnvVar)
+
 	log = ctrl.Log.WithName("certpolicy")
 
 	agentPermissionFiles = []string{
@@ -59,9 +68,6 @@ func getSkeletonValues() certPolicyUserValues {
 			BaseValues: policyaddon.BaseValues{
 				GlobalValues: &policyaddon.GlobalValues{
 					ImagePullPolicy: corev1.PullIfNotPresent,
-					ImageOverrides: map[string]string{
-						"cert_policy_controller": os.Getenv("CERT_POLICY_CONTROLLER_IMAGE"),
-					},
 					NetworkPolicies: &policyaddon.NetworkPolicies{
 						Enabled: policyaddon.GetNetworkPoliciesEnabled(),
 					},
@@ -71,70 +77,137 @@ func getSkeletonValues() certPolicyUserValues {
 	}
 }
 
-func getValuesFromAnnotations(
-	clusterClient clusterlistersv1.ManagedClusterLister,
-) func(*clusterv1.ManagedCluster, *addonapiv1beta1.ManagedClusterAddOn) (addonfactory.Values, error) {
+func getSkeletonValuesFunc(
+	_ *clusterv1.ManagedCluster, _ *addonapiv1beta1.ManagedClusterAddOn,
+) (addonfactory.Values, error) {
+	return addonfactory.JsonStructToValues(getSkeletonValues())
+}
+
+func getClusterValues(clusterClient clusterlistersv1.ManagedClusterLister) addonfactory.GetValuesFunc {
 	return func(
 		cluster *clusterv1.ManagedCluster, addon *addonapiv1beta1.ManagedClusterAddOn,
 	) (addonfactory.Values, error) {
-		userValues := getSkeletonValues()
+		userValues := certPolicyUserValues{}
 
 		err := userValues.SetCommonValues(cluster, addon, clusterClient)
 		if err != nil {
 			return nil, err
 		}
 
-		if err := userValues.SetCommonValuesFromAnnotations(addon); err != nil {
-			log.Error(err, "failed to set common values from annotations")
-		}
-
 		return addonfactory.JsonStructToValues(userValues)
 	}
 }
 
+func getValuesFromAnnotations(
+	_ *clusterv1.ManagedCluster, addon *addonapiv1beta1.ManagedClusterAddOn,
+) (addonfactory.Values, error) {
+	userValues := certPolicyUserValues{}
+
+	if err := userValues.setValuesFromAnnotations(addon); err != nil {
+		log.Error(err, "failed to set values from annotations")
+	}
+
+	return addonfactory.JsonStructToValues(userValues)
+}
+
+// setValuesFromAnnotations sets the values from the ManagedClusterAddOn
+// annotations. It returns an aggregated error of the rejected values.
+func (cpv *certPolicyUserValues) setValuesFromAnnotations(addon *addonapiv1beta1.ManagedClusterAddOn) error {
+	return errors.Join(cpv.SetCommonValuesFromAnnotations(addon), cpv.SetReplicasFromAnnotation(addon))
+}
+
 func getValuesFromCustomizedVariableValues(config addonapiv1beta1.AddOnDeploymentConfig) (addonfactory.Values, error) {
-	userValues := getSkeletonValues()
+	// Only the values set by the config are returned, so that they don't override the values of the layers below
+	userValues := certPolicyUserValues{}
 
-	userValuesMap, err := userValues.SetCommonValuesFromCustomizedVariables(config)
+	unknownValues, err := userValues.setValuesFromCustomizedVariables(config)
 	if err != nil {
-		log.Error(err, "error setting common addon values from customized variables")
+		log.Error(err, "error setting addon values from customized variables")
 	}
 
+	for key, value := range unknownValues {
+		log.Error(errors.New("unknown customized variable"),
+			"variable is not supported",
+			"variable", key,
+			"value", value)
+	}
+
+	return addonfactory.JsonStructToValues(userValues)
+}
+
+// setValuesFromCustomizedVariables sets the values from the customized variables
+// in the deployment config. It returns a map with any unknown variables and an
+// aggregated error of the rejected values.
+func (cpv *certPolicyUserValues) setValuesFromCustomizedVariables(
+	config addonapiv1beta1.AddOnDeploymentConfig,
+) (map[string]string, error) {
+	userValuesMap, aggregateErr := cpv.SetCommonValuesFromCustomizedVariables(config)
+	unknownValues := map[string]string{}
+
 	//nolint:unparam
 	variableToFuncMap := map[string]func(string) error{
+		"replicas": cpv.SetReplicas,
 		"managedKubeConfigSecret": func(value string) error {
-			userValues.ManagedKubeConfigSecret = value
+			cpv.ManagedKubeConfigSecret = value
 
 			return nil
 		},
 	}
 
-	for key, value := range userValuesMap {
-		if fn, ok := variableToFuncMap[key]; ok {
-			err := fn(value)
-			if err != nil {
-				log.Error(err, "error setting customized variable", "variable", key, "value", value)
-			}
-		} else {
-			log.Error(errors.New("unknown customized variable"),
-				"variable is not supported",
-				"variable", key,
-				"value", value)
+	for _, key := range slices.Sorted(maps.Keys(userValuesMap)) {
+		fn, ok := variableToFuncMap[key]
+		if !ok {
+			unknownValues[key] = userValuesMap[key]
+
+			continue
+		}
+
+		if err := fn(userValuesMap[key]); err != nil {
+			aggregateErr = errors.Join(aggregateErr, &policyaddon.InvalidValueError{
+				Source: policyaddon.CustomizedVariableSource,
+				Key:    key,
+				Err:    err,
+			})
 		}
 	}
 
-	return addonfactory.JsonStructToValues(userValues)
+	images, err := defaultImages()
+	if err != nil {
+		return unknownValues, errors.Join(aggregateErr, err)
+	}
+
+	if err := cpv.SetImageFromDeploymentConfig(config, imageKey, images); err != nil {
+		aggregateErr = errors.Join(aggregateErr, err)
+	}
+
+	return unknownValues, aggregateErr
 }
 
-func GetAgentAddon(ctx context.Context, controllerContext *controllercmd.ControllerContext) (agent.AgentAddon, error) {
-	registrationOption := policyaddon.NewRegistrationOption(
-		ctx,
-		controllerContext,
-		addonName,
-		agentPermissionFiles,
-		FS,
-		false)
+// ValidateConfiguration returns warnings for the unsupported annotations and
+// customized variables, and an aggregated error of the values rejected from the
+// ManagedClusterAddOn annotations and the deployment config.
+func ValidateConfiguration(
+	addon *addonapiv1beta1.ManagedClusterAddOn, config *addonapiv1beta1.AddOnDeploymentConfig,
+) ([]string, error) {
+	userValues := getSkeletonValues()
+	warnings := policyaddon.UnknownAnnotationWarnings(addon, policyaddon.ReplicasAnnotation)
+
+	err := userValues.setValuesFromAnnotations(addon)
+
+	if config != nil {
+		unknownValues, configErr := userValues.setValuesFromCustomizedVariables(*config)
+		warnings = append(warnings, policyaddon.UnknownVariableWarnings(addonName, unknownValues)...)
+		err = errors.Join(err, configErr, policyaddon.ValidateHostedInstallNamespace(*config, addon.Namespace))
+	}
+
+	return warnings, err
+}
 
+// GetAgentAddon returns the agent addon using new hub clients. The addons hosted
+// on a ManagedCluster are updated when the hosting cluster changes.
+func GetAgentAddon(
+	ctx context.Context, mgr addonmanager.AddonManager, controllerContext *controllercmd.ControllerContext,
+) (agent.AgentAddon, error) {
 	addonClient, err := addonv1alpha1client.NewForConfig(controllerContext.KubeConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve addon client: %w", err)
@@ -149,31 +222,102 @@ func GetAgentAddon(ctx context.Context, controllerContext *controllercmd.Control
 		Cluster().V1().ManagedClusters()
 	go clusterInformer.Informer().Run(ctx.Done())
 
-	return addonfactory.NewAgentAddonFactory(addonName, FS, "manifests/managedclusterchart").
+	err = policyaddon.TriggerOnHostingClusterChange(ctx, mgr, addonName, addonClient, clusterInformer.Informer())
+	if err != nil {
+		return nil, err
+	}
+
+	return BuildAgentAddon(ctx, controllerContext, policyaddon.AgentAddonClients{
+		AddonClient:   addonClient,
+		ClusterClient: clusterClient,
+		ClusterLister: clusterInformer.Lister(),
+	})
+}
+
+// BuildAgentAddon builds the agent addon using the provided hub clients.
+func BuildAgentAddon(
+	ctx context.Context,
+	controllerContext *controllercmd.ControllerContext,
+	clients policyaddon.AgentAddonClients,
+) (agent.AgentAddon, error) {
+	registrationOption := policyaddon.NewRegistrationOption(
+		ctx,
+		controllerContext,
+		addonName,
+		agentPermissionFiles,
+		FS,
+		false)
+
+	values := GetAddonValues(clients)
+
+	agentAddon, err := addonfactory.NewAgentAddonFactory(addonName, FS, "manifests/managedclusterchart").
 		WithConfigGVRs(utils.AddOnDeploymentConfigGVR).
-		WithGetValuesFuncs(
-			getValuesFromAnnotations(clusterInformer.Lister()),
-			addonfactory.GetValuesFromAddonAnnotation,
-			addonfactory.GetAddOnDeploymentConfigValues(
-				utils.NewAddOnDeploymentConfigGetter(addonClient),
-				addonfactory.ToAddOnNodePlacementValues,
-				addonfactory.ToAddOnResourceRequirementsValues,
-				getValuesFromCustomizedVariableValues,
-			),
-		).
-		WithManagedClusterClient(clusterClient).
+		WithGetValuesFuncs(values.GetValuesFuncs()...).
+		WithManagedClusterClient(clients.ClusterClient).
 		WithAgentRegistrationOption(registrationOption).
 		WithAgentInstallNamespace(
-			policyaddon.
-				CommonAgentInstallNamespaceFromDeploymentConfigFunc(utils.NewAddOnDeploymentConfigGetter(addonClient)),
+			policyaddon.CommonAgentInstallNamespaceFromDeploymentConfigFunc(ctx, addonName, clients.AddonClient),
 		).
 		WithScheme(policyaddon.Scheme).
 		WithAgentHostedModeEnabledOption().
+		WithAgentHealthProber(policyaddon.NewAgentHealthProber()).
 		BuildHelmAgentAddon()
+	if err != nil {
+		return nil, err
+	}
+
+	return &policyaddon.ValuesAgentAddon{AgentAddon: agentAddon, Values: values}, nil
+}
+
+// GetAddonValues returns the sources of the addon values using the provided hub
+// clients.
+func GetAddonValues(clients policyaddon.AgentAddonClients) *policyaddon.AddonValues {
+	return policyaddon.NewAddonValues().
+		Add(policyaddon.SkeletonLayer, "skeleton", getSkeletonValuesFunc).
+		Add(policyaddon.SkeletonLayer, "image-env", getImageValuesFromEnv).
+		Add(policyaddon.ClusterLayer, "cluster", getClusterValues(clients.ClusterLister)).
+		AddDeploymentConfig("AddOnDeploymentConfig", addonfactory.GetAddOnDeploymentConfigValues(
+			utils.NewAddOnDeploymentConfigGetter(clients.AddonClient),
+			addonfactory.ToAddOnNodePlacementValues,
+			addonfactory.ToAddOnResourceRequirementsValues,
+			getValuesFromCustomizedVariableValues,
+		)).
+		Add(policyaddon.AnnotationLayer, "annotations", getValuesFromAnnotations).
+		Add(policyaddon.AnnotationLayer, "values-annotation", addonfactory.GetValuesFromAddonAnnotation).
+		Add(policyaddon.MandatedLayer, "uninstall", policyaddon.MandateValues)
 }
 
 func GetAndAddAgent(
 	ctx context.Context, mgr addonmanager.AddonManager, controllerContext *controllercmd.ControllerContext,
 ) error {
-	return policyaddon.GetAndAddAgent(ctx, mgr, addonName, controllerContext, GetAgentAddon)
+	err := policyaddon.GetAndAddAgent(ctx, mgr, addonName, controllerContext, GetAgentAddon, ValidateConfiguration)
+	if err != nil {
+		return err
+	}
+
+	return policyaddon.StartHubPermissionsCleanup(ctx, controllerContext, addonName, hubRoleBindingName)
+}
+
+// getImageValuesFromEnv sets the image from the environment variable, when it
+// is set to a non-empty value, as the default image of the fleet. The image
+// customized variable and the registry mirrors of a deployment config override
+// it for the clusters using that config.
+func getImageValuesFromEnv(
+	_ *clusterv1.ManagedCluster,
+	_ *addonapiv1beta1.ManagedClusterAddOn,
+) (addonfactory.Values, error) {
+	values := addonfactory.Values{}
+
+	img := os.Getenv(imageEnvVar)
+	if img == "" {
+		return values, nil
+	}
+
+	values["global"] = map[string]any{
+		"imageOverrides": map[string]any{
+			imageKey: img,
+		},
+	}
+
+	return values, nil
 }
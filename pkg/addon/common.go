@@ -5,27 +5,51 @@ import (
 	"embed"
 	"errors"
 	"fmt"
+	"maps"
+	"math"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
-	"github.com/openshift/library-go/pkg/assets"
 	"github.com/openshift/library-go/pkg/controller/controllercmd"
-	"github.com/openshift/library-go/pkg/operator/events"
-	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
 	prometheusv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	certificatesv1 "k8s.io/api/certificates/v1"
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"open-cluster-management.io/addon-framework/pkg/addonfactory"
 	"open-cluster-management.io/addon-framework/pkg/addonmanager"
 	"open-cluster-management.io/addon-framework/pkg/agent"
 	"open-cluster-management.io/addon-framework/pkg/utils"
 	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonv1alpha1client "open-cluster-management.io/api/client/addon/clientset/versioned"
+	addonlistersv1alpha1 "open-cluster-management.io/api/client/addon/listers/addon/v1alpha1"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	clusterv1client "open-cluster-management.io/api/client/cluster/clientset/versioned"
+	clusterv1informers "open-cluster-management.io/api/client/cluster/informers/externalversions"
 	clusterlistersv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	workv1client "open-cluster-management.io/api/client/work/clientset/versioned"
+	workinformers "open-cluster-management.io/api/client/work/informers/externalversions"
 	clusterv1 "open-cluster-management.io/api/cluster/v1"
 	sdktls "open-cluster-management.io/sdk-go/pkg/tls"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/yaml"
 )
 
 var log = ctrl.Log.WithName("common")
@@ -37,12 +61,126 @@ const (
 	ClientQPSAnnotation             = "client-qps"
 	ClientBurstAnnotation           = "client-burst"
 	PrometheusEnabledAnnotation     = "prometheus-metrics-enabled"
+	ReplicasAnnotation              = "replicas"
 	NetworkPoliciesEnabledEnvVar    = "NETWORK_POLICIES_ENABLED"
 
 	AnnotationParseErrorFmt = "Failed to verify '%s' annotation value '%s' for component %s " +
 		"(falling back to default value %v)"
+
+	// ConfigurationValidCondition is the ManagedClusterAddOn condition type reporting whether all of the
+	// user-provided annotation and customized variable values were accepted.
+	ConfigurationValidCondition = "ConfigurationValid"
+	ConfigurationValidReason    = "AsExpected"
+	InvalidValuesReason         = "InvalidValues"
+
+	// HostingClusterResolvedCondition is the ManagedClusterAddOn condition type reporting whether the hosting
+	// ManagedCluster of a hosted addon was found.
+	HostingClusterResolvedCondition = "HostingClusterResolved"
+	HostingClusterResolvedReason    = "AsExpected"
+	HostingClusterUnresolvedReason  = "HostingClusterUnresolved"
+
+	AnnotationSource         = "annotation"
+	CustomizedVariableSource = "customized variable"
+
+	// ImageVariable is the customized variable overriding the image of the addon agent.
+	ImageVariable = "image"
+
+	// HostedInstallNamespaceVariable is the customized variable, and HostedInstallNamespaceAnnotation is the
+	// ClusterManagementAddOn annotation, with the template of the agent install namespace in hosted mode. The
+	// template is rendered with the ClusterName field set to the name of the hosted cluster.
+	HostedInstallNamespaceVariable   = "hostedInstallNamespace"
+	HostedInstallNamespaceAnnotation = "policy-addon-hosted-install-namespace"
+	DefaultHostedInstallNamespace    = "klusterlet-{{ .ClusterName }}"
+
+	// The inclusive upper bounds of the client and concurrency settings. The lower bound is 1 for each.
+	MaxEvaluationConcurrency = 100
+	MaxClientQPS             = 5000
+	MaxClientBurst           = 10000
+	MaxReplicas              = 10
 )
 
+// ErrValueOutOfRange is returned when a numeric value is outside of its
+// supported bounds.
+var ErrValueOutOfRange = errors.New("value out of range")
+
+// ErrHostingClusterUnresolved is returned when the hosting ManagedCluster of a
+// hosted addon can't be retrieved, since the values depending on it can't be
+// computed until it is.
+var ErrHostingClusterUnresolved = errors.New("failed to resolve the hosting ManagedCluster")
+
+// imageReferenceRegexp matches an image reference with an optional registry,
+// tag, and digest, such as "quay.io/stolostron/config-policy-controller:v1".
+var imageReferenceRegexp = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(:[0-9]+)?` +
+	`(/[a-z0-9]+([._-]+[a-z0-9]+)*)*(:\w[\w.-]{0,127})?(@sha256:[a-f0-9]{64})?$`)
+
+// InvalidValueError is returned when a user-provided value is rejected. The
+// wrapped error describes the rejected value and the fallback that is applied.
+type InvalidValueError struct {
+	Source string
+	Key    string
+	Err    error
+}
+
+func (e *InvalidValueError) Error() string {
+	return fmt.Sprintf("invalid %s '%s': %v", e.Source, e.Key, e.Err)
+}
+
+func (e *InvalidValueError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigurationValidator returns warnings for unsupported settings and an
+// aggregated error of InvalidValueErrors for the user-provided values of the
+// ManagedClusterAddOn and its deployment config, which is nil when no
+// deployment config is referenced.
+type ConfigurationValidator func(
+	addon *addonapiv1beta1.ManagedClusterAddOn, config *addonapiv1beta1.AddOnDeploymentConfig,
+) (warnings []string, err error)
+
+// commonAnnotations are the unprefixed ManagedClusterAddOn annotations supported by every addon.
+var commonAnnotations = []string{
+	PolicyAddonPauseAnnotation,
+	PolicyAddonPauseUntilAnnotation,
+	PolicyLogLevelAnnotation,
+	EvaluationConcurrencyAnnotation,
+	ClientQPSAnnotation,
+	ClientBurstAnnotation,
+	PrometheusEnabledAnnotation,
+}
+
+// UnknownAnnotationWarnings returns a warning for each unprefixed annotation on
+// the ManagedClusterAddOn which is neither a common annotation nor one of the
+// additional annotations supported by the addon. Unprefixed annotations are
+// most likely misspelled addon settings, such as "evaluation-concurrency".
+func UnknownAnnotationWarnings(addon *addonapiv1beta1.ManagedClusterAddOn, additional ...string) []string {
+	warnings := []string{}
+
+	for _, annotation := range slices.Sorted(maps.Keys(addon.GetAnnotations())) {
+		if strings.Contains(annotation, "/") ||
+			slices.Contains(commonAnnotations, annotation) || slices.Contains(additional, annotation) {
+			continue
+		}
+
+		warnings = append(warnings, fmt.Sprintf("the annotation '%s' is not supported by the %s addon",
+			annotation, addon.Name))
+	}
+
+	return warnings
+}
+
+// UnknownVariableWarnings returns a warning for each of the unknown customized
+// variables returned when setting the addon values from a deployment config.
+func UnknownVariableWarnings(addonName string, unknownValues map[string]string) []string {
+	warnings := []string{}
+
+	for _, variable := range slices.Sorted(maps.Keys(unknownValues)) {
+		warnings = append(warnings, fmt.Sprintf("the customized variable '%s' is not supported by the %s addon",
+			variable, addonName))
+	}
+
+	return warnings
+}
+
 // CommonValues contains common values for the addon chart.
 type CommonValues struct {
 	BaseValues `json:",inline"`
@@ -50,6 +188,20 @@ type CommonValues struct {
 
 	KubernetesDistribution        string `json:"kubernetesDistribution,omitempty"`
 	HostingKubernetesDistribution string `json:"hostingKubernetesDistribution,omitempty"`
+	// Replicas is only set by the addons which support running more than one agent
+	Replicas uint16 `json:"replicas,omitempty"`
+
+	PriorityClassName         string                            `json:"priorityClassName,omitempty"`
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	PodDisruptionBudget       *PodDisruptionBudget              `json:"podDisruptionBudget,omitempty"`
+}
+
+// PodDisruptionBudget contains the PodDisruptionBudget values for the addon chart.
+type PodDisruptionBudget struct {
+	// Enabled is a pointer since the chart enables the PodDisruptionBudget with
+	// more than one replica when it's unset
+	Enabled        *bool               `json:"enabled,omitempty"`
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
 }
 
 // UserArgs contains common controller flags for the addon chart.
@@ -57,9 +209,9 @@ type UserArgs struct {
 	LogEncoder            string `json:"logEncoder,omitempty"`
 	LogLevel              int8   `json:"logLevel,omitempty"`
 	PkgLogLevel           int8   `json:"pkgLogLevel,omitempty"`
-	EvaluationConcurrency uint8  `json:"evaluationConcurrency,omitempty"`
-	ClientQPS             uint8  `json:"clientQPS,omitempty"` //nolint:tagliatelle
-	ClientBurst           uint8  `json:"clientBurst,omitempty"`
+	EvaluationConcurrency uint16 `json:"evaluationConcurrency,omitempty"`
+	ClientQPS             uint16 `json:"clientQPS,omitempty"` //nolint:tagliatelle
+	ClientBurst           uint16 `json:"clientBurst,omitempty"`
 	TLSMinVersion         string `json:"tlsMinVersion,omitempty"`
 	TLSCipherSuites       string `json:"tlsCipherSuites,omitempty"`
 }
@@ -121,7 +273,8 @@ type BaseValues struct {
 
 // PrometheusConfig contains Prometheus metrics configuration values for the addon chart.
 type PrometheusConfig struct {
-	Enabled        bool            `json:"enabled,omitempty"`
+	// Enabled is always set so that disabling it overrides a lower precedence value
+	Enabled        bool            `json:"enabled"`
 	ServiceMonitor *ServiceMonitor `json:"serviceMonitor,omitempty"`
 }
 
@@ -130,6 +283,15 @@ type ServiceMonitor struct {
 	Namespace *string `json:"namespace,omitempty"`
 }
 
+// AgentAddonClients contains the hub clients and listers used to build an
+// agent addon. The listers are only required by the addons that use them.
+type AgentAddonClients struct {
+	AddonClient   addonv1alpha1client.Interface
+	ClusterClient clusterv1client.Interface
+	ClusterLister clusterlistersv1.ManagedClusterLister
+	AddonLister   addonlistersv1alpha1.ManagedClusterAddOnLister
+}
+
 var Scheme = runtime.NewScheme()
 
 func init() {
@@ -155,68 +317,88 @@ func NewRegistrationOption(
 	filesystem embed.FS,
 	useClusterRole bool,
 ) *agent.RegistrationOption {
-	applyManifestFromFile := func(file, clusterName string,
-		kubeclient *kubernetes.Clientset, recorder events.Recorder,
-	) error {
-		groupIdx := 0 // 0 is a cluster-specific group
-
-		if useClusterRole {
-			groupIdx = 1 // 1 is a group for the entire addon
-		}
-
-		groups := agent.DefaultGroups(clusterName, addonName)
-		config := struct {
-			ClusterName string
-			Group       string
-		}{
-			ClusterName: clusterName,
-			Group:       groups[groupIdx],
-		}
-
-		results := resourceapply.ApplyDirectly(ctx,
-			resourceapply.NewKubeClientHolder(kubeclient),
-			recorder,
-			resourceapply.NewResourceCache(),
-			func(name string) ([]byte, error) {
-				template, err := filesystem.ReadFile(file)
-				if err != nil {
-					return nil, err
-				}
-
-				return assets.MustCreateAssetFromTemplate(name, template, config).Data, nil
-			},
-			file,
-		)
-
-		for _, result := range results {
-			if result.Error != nil {
-				return result.Error
-			}
+	// The clients are created on the first use, since the addon is also built
+	// without a hub connection to render the manifests.
+	getKubeClient := sync.OnceValues(func() (kubernetes.Interface, error) {
+		return kubernetes.NewForConfig(controllerContext.KubeConfig)
+	})
+
+	getHubPermissions := sync.OnceValues(func() (*hubPermissions, error) {
+		kubeClient, err := getKubeClient()
+		if err != nil {
+			return nil, err
 		}
 
-		return nil
-	}
+		return newHubPermissions(kubeClient, controllerContext.EventRecorder, addonName, agentPermissionFiles,
+			filesystem, useClusterRole)
+	})
+
+	getAddonClient := sync.OnceValues(func() (addonv1alpha1client.Interface, error) {
+		addonClient, err := addonv1alpha1client.NewForConfig(controllerContext.KubeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve addon client: %w", err)
+		}
+
+		return addonClient, nil
+	})
 
-	kubeConfig := controllerContext.KubeConfig
-	recorder := controllerContext.EventRecorder
+	getCMALister := newCMAListerFunc(ctx, addonName, getAddonClient)
+
+	getCSRApprover := sync.OnceValues(func() (agent.CSRApproveFunc, error) {
+		kubeClient, err := getKubeClient()
+		if err != nil {
+			return nil, err
+		}
+
+		cmaLister, err := getCMALister()
+		if err != nil {
+			return nil, err
+		}
+
+		return NewCSRApprover(addonName, cmaLister, newEventRecorder(ctx, kubeClient)), nil
+	})
 
 	return &agent.RegistrationOption{
-		Configurations:  agent.KubeClientSignerConfigurations(addonName, addonName),
-		CSRApproveCheck: utils.DefaultCSRApprover(addonName),
-		PermissionConfig: func(
-			_ context.Context,
+		Configurations: registrationConfigurations(addonName, getCMALister, useClusterRole),
+		CSRApproveCheck: func(
+			ctx context.Context,
 			cluster *clusterv1.ManagedCluster,
-			_ *addonapiv1beta1.ManagedClusterAddOn,
-		) error {
-			kubeclient, err := kubernetes.NewForConfig(kubeConfig)
+			addon *addonapiv1beta1.ManagedClusterAddOn,
+			csr *certificatesv1.CertificateSigningRequest,
+		) bool {
+			csrApprover, err := getCSRApprover()
 			if err != nil {
+				log.Error(err, "Failed to create the CSR approver", "addon", addonName)
+
+				return false
+			}
+
+			approved := csrApprover(ctx, cluster, addon, csr)
+			if approved {
+				csrApprovals.WithLabelValues(addonName).Inc()
+			}
+
+			return approved
+		},
+		PermissionConfig: func(
+			ctx context.Context,
+			_ *clusterv1.ManagedCluster,
+			addon *addonapiv1beta1.ManagedClusterAddOn,
+		) error {
+			permissions, err := getHubPermissions()
+			if err == nil {
+				err = permissions.apply(ctx, addon)
+			}
+
+			// The permissions are applied again when the agent reports its user
+			if errors.Is(err, ErrAgentUserNotReported) {
 				return err
 			}
 
-			for _, file := range agentPermissionFiles {
-				if err := applyManifestFromFile(file, cluster.Name, kubeclient, recorder); err != nil {
-					return err
-				}
+			if err != nil {
+				permissionConfigErrors.WithLabelValues(addonName).Inc()
+
+				return err
 			}
 
 			return nil
@@ -244,22 +426,91 @@ func GetClusterVendor(cluster *clusterv1.ManagedCluster) string {
 	return vendor
 }
 
-// GetAndAddAgent adds the agent to the manager.
+// GetAndAddAgent adds the agent to the manager. The validator is used to report
+// rejected values in the ConfigurationValid condition of the ManagedClusterAddOn.
 func GetAndAddAgent(
 	ctx context.Context,
 	mgr addonmanager.AddonManager,
 	addonName string,
 	controllerContext *controllercmd.ControllerContext,
-	getAgent func(context.Context, *controllercmd.ControllerContext) (agent.AgentAddon, error),
+	getAgent func(context.Context, addonmanager.AddonManager, *controllercmd.ControllerContext) (agent.AgentAddon, error),
+	validator ConfigurationValidator,
 ) error {
-	agentAddon, err := getAgent(ctx, controllerContext)
+	agentAddon, err := getAgent(ctx, mgr, controllerContext)
 	if err != nil {
 		return fmt.Errorf("failed getting the %v agent addon: %w", addonName, err)
 	}
 
-	agentAddon = &PolicyAgentAddon{agentAddon}
+	addonClient, err := addonv1alpha1client.NewForConfig(controllerContext.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve addon client: %w", err)
+	}
+
+	workClient, err := workv1client.NewForConfig(controllerContext.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to initialize a ManifestWork client: %w", err)
+	}
+
+	addonInformerFactory := newAddonInformerFactory(addonClient, addonName)
+
+	// Only the ManifestWorks of this addon are watched
+	workInformerFactory := workinformers.NewSharedInformerFactoryWithOptions(workClient, 10*time.Minute,
+		workinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = addonapiv1beta1.AddonLabelKey + "=" + addonName
+		}),
+	)
+
+	rollout, err := newImageRollout(mgr, addonName, addonInformerFactory, workInformerFactory)
+	if err != nil {
+		return err
+	}
+
+	pause := startPauseController(ctx, mgr, addonName, addonClient, addonInformerFactory, workInformerFactory)
+
+	clusterClient, err := clusterv1client.NewForConfig(controllerContext.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to initialize a managed cluster client: %w", err)
+	}
+
+	clusterInformerFactory := clusterv1informers.NewSharedInformerFactory(clusterClient, 10*time.Minute)
+
+	// The controller also deletes the CRD ManifestWorks when they're no longer separate
+	crdWorks, err := startCRDWorks(ctx, mgr, addonName, agentAddon, pause, workClient,
+		clusterInformerFactory, addonInformerFactory, workInformerFactory)
+	if err != nil {
+		return err
+	}
+
+	policyAgentAddon := &PolicyAgentAddon{
+		AgentAddon: agentAddon,
+		adcGetter:  utils.NewAddOnDeploymentConfigGetter(addonClient),
+		validator:  validator,
+		pause:      pause,
+		rollout:    rollout,
+		crdWorks:   crdWorks,
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(controllerContext.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create the Kubernetes client: %w", err)
+	}
+
+	if provider, ok := agentAddon.(ValuesProvider); ok && ReportValues && provider.AddonValues() != nil {
+		startValuesReporter(ctx, addonName, provider.AddonValues(), kubeClient,
+			clusterInformerFactory, addonInformerFactory)
+	}
+
+	policyAgentAddon.recorder = newEventRecorder(ctx, kubeClient)
+
+	if ReportHealth {
+		startHealthController(ctx, addonName, addonClient, kubeClient, addonInformerFactory, workInformerFactory)
+	}
 
-	err = mgr.AddAgent(agentAddon)
+	addonInformerFactory.Start(ctx.Done())
+	workInformerFactory.Start(ctx.Done())
+	clusterInformerFactory.Start(ctx.Done())
+
+	err = mgr.AddAgent(policyAgentAddon)
 	if err != nil {
 		return fmt.Errorf("failed adding the %v agent addon to the manager: %w", addonName, err)
 	}
@@ -267,32 +518,208 @@ func GetAndAddAgent(
 	return nil
 }
 
+// newEventRecorder returns a recorder of the events on the ManagedClusterAddOns.
+func newEventRecorder(ctx context.Context, kubeClient kubernetes.Interface) record.EventRecorder {
+	eventScheme := runtime.NewScheme()
+	utilruntime.Must(addonapiv1beta1.Install(eventScheme))
+
+	broadcaster := record.NewBroadcaster(record.WithContext(ctx))
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+
+	return broadcaster.NewRecorder(eventScheme, corev1.EventSource{Component: "governance-policy-addon-controller"})
+}
+
 // PolicyAgentAddon wraps the AgentAddon created from the addonfactory to override some behavior
 type PolicyAgentAddon struct {
 	agent.AgentAddon
+	adcGetter utils.AddOnDeploymentConfigGetter
+	validator ConfigurationValidator
+	pause     *pauseController
+	rollout   *imageRollout
+	crdWorks  *crdWorks
+	recorder  record.EventRecorder
+}
+
+// GetAgentAddonOptions overrides the AgentAddon.GetAgentAddonOptions method to
+// add status feedback for the agent Deployments to the ManifestWorks, which the
+// health controller uses to report their readiness.
+func (pa *PolicyAgentAddon) GetAgentAddonOptions() agent.AgentAddonOptions {
+	options := pa.AgentAddon.GetAgentAddonOptions()
+
+	options.ManifestConfigs = append(slices.Clone(options.ManifestConfigs),
+		utils.WellKnowManifestConfig(appsv1.GroupName, "deployments", "*", "*"))
+
+	return options
 }
 
-// Manifests overrides the AgentAddon.Manifests method to return an error when
-// the policy addon is paused.
+// Manifests overrides the AgentAddon.Manifests method to keep the deployed
+// manifests when the policy addon is paused, and to report rejected values in
+// the ConfigurationValid condition of the ManagedClusterAddOn.
 func (pa *PolicyAgentAddon) Manifests(
 	ctx context.Context,
 	cluster *clusterv1.ManagedCluster,
 	addon *addonapiv1beta1.ManagedClusterAddOn,
 ) ([]runtime.Object, error) {
-	// Return error when pause annotation is set to short-circuit automatic addon updates
-	pauseAnnotation := addon.GetAnnotations()[PolicyAddonPauseAnnotation]
-	if pauseAnnotation == "true" {
-		return nil, errors.New("the Policy Addon controller is paused due to the policy-addon-pause annotation")
+	// Return the deployed manifests when paused so the ManifestWorks are left unchanged, without failing the
+	// addon. The Paused condition is reported by the pause controller, which also triggers an update when the
+	// addon is resumed.
+	if pa.pause != nil {
+		state, err := pa.pause.pauseState(addon)
+		if err != nil {
+			return nil, err
+		}
+
+		if state.Paused {
+			return pa.pause.deployedObjects(addon)
+		}
+	}
+
+	start := time.Now()
+
+	objects, err := pa.manifests(ctx, cluster, addon)
+
+	manifestsDuration.WithLabelValues(addon.Name).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		manifestsErrors.WithLabelValues(addon.Name).Inc()
+
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+func (pa *PolicyAgentAddon) manifests(
+	ctx context.Context,
+	cluster *clusterv1.ManagedCluster,
+	addon *addonapiv1beta1.ManagedClusterAddOn,
+) ([]runtime.Object, error) {
+	objects, err := pa.AgentAddon.Manifests(ctx, cluster, addon)
+
+	// The addon-framework patches the status of this ManagedClusterAddOn copy even when the manifests fail
+	if addon.GetAnnotations()[addonapiv1beta1.HostingClusterNameAnnotationKey] != "" &&
+		SetHostingClusterResolvedCondition(addon, err) && pa.recorder != nil {
+		pa.recorder.Event(addon, corev1.EventTypeWarning, HostingClusterUnresolvedReason, err.Error())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The CRDs of hosted addons are deployed on the hosting cluster with the agent
+	if pa.crdWorks != nil && SeparateCRDWork &&
+		addon.GetAnnotations()[addonapiv1beta1.HostingClusterNameAnnotationKey] == "" {
+		objects, err = pa.crdWorks.separate(addon, objects)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkManifestsSize(pa.recorder, addon, objects); err != nil {
+		return nil, err
+	}
+
+	// Keep the applied agent images when the rollout strategy doesn't allow this cluster to update yet
+	if pa.rollout != nil {
+		if err := pa.rollout.holdBackImages(addon, objects); err != nil {
+			return nil, err
+		}
+	}
+
+	if pa.validator != nil {
+		config, err := utils.GetDesiredAddOnDeploymentConfig(addon, pa.adcGetter)
+		if err != nil {
+			return nil, err
+		}
+
+		_, validationErr := pa.validator(addon, config)
+
+		// Only count the rejected values when they change, since the manifests are regenerated on every resync
+		existingMessage := ""
+		if existing := meta.FindStatusCondition(addon.Status.Conditions, ConfigurationValidCondition); existing != nil {
+			existingMessage = existing.Message
+		}
+
+		// The addon-framework patches the status of this ManagedClusterAddOn copy after the manifests are applied
+		SetConfigurationValidCondition(addon, validationErr)
+
+		current := meta.FindStatusCondition(addon.Status.Conditions, ConfigurationValidCondition)
+		if existingMessage != current.Message {
+			for _, invalidErr := range invalidValueErrors(validationErr) {
+				rejectedValues.WithLabelValues(addon.Name, invalidErr.Source, invalidErr.Key).Inc()
+			}
+		}
+	}
+
+	return objects, nil
+}
+
+// SetConfigurationValidCondition sets the ConfigurationValid condition on the
+// ManagedClusterAddOn, listing every rejected value in the aggregated error.
+func SetConfigurationValidCondition(addon *addonapiv1beta1.ManagedClusterAddOn, validationErr error) {
+	condition := metav1.Condition{
+		Type:    ConfigurationValidCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  ConfigurationValidReason,
+		Message: "All annotation and customized variable values are valid",
+	}
+
+	if validationErr != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = InvalidValuesReason
+		condition.Message = "Rejected values: " + strings.ReplaceAll(validationErr.Error(), "\n", "; ")
+	}
+
+	meta.SetStatusCondition(&addon.Status.Conditions, condition)
+}
+
+// SetHostingClusterResolvedCondition sets the HostingClusterResolved condition
+// on the hosted ManagedClusterAddOn from the error generating its manifests. It
+// returns true when the hosting cluster newly failed to be resolved.
+func SetHostingClusterResolvedCondition(addon *addonapiv1beta1.ManagedClusterAddOn, manifestsErr error) bool {
+	condition := metav1.Condition{
+		Type:    HostingClusterResolvedCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  HostingClusterResolvedReason,
+		Message: "The hosting ManagedCluster was resolved",
+	}
+
+	if errors.Is(manifestsErr, ErrHostingClusterUnresolved) {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = HostingClusterUnresolvedReason
+		condition.Message = manifestsErr.Error()
+	} else if manifestsErr != nil {
+		// The hosting cluster isn't known to be resolved when the manifests failed for another reason
+		return false
+	}
+
+	// Copy the existing condition, since setting the condition updates it in place
+	var existing *metav1.Condition
+	if found := meta.FindStatusCondition(addon.Status.Conditions, HostingClusterResolvedCondition); found != nil {
+		existing = found.DeepCopy()
 	}
 
-	return pa.AgentAddon.Manifests(ctx, cluster, addon)
+	meta.SetStatusCondition(&addon.Status.Conditions, condition)
+
+	return condition.Status == metav1.ConditionFalse &&
+		(existing == nil || existing.Status != condition.Status || existing.Message != condition.Message)
 }
 
 // CommonAgentInstallNamespaceFromDeploymentConfigFunc returns a function that
-// gets the agent install namespace for the addon from the deployment config.
+// gets the agent install namespace for the addon from the deployment config. In
+// hosted mode, the namespace is rendered from the hostedInstallNamespace
+// customized variable of the deployment config, the
+// policy-addon-hosted-install-namespace annotation of the
+// ClusterManagementAddOn, or the klusterlet-<cluster name> default, in that
+// order.
 func CommonAgentInstallNamespaceFromDeploymentConfigFunc(
-	adcgetter utils.AddOnDeploymentConfigGetter,
+	ctx context.Context, addonName string, addonClient addonv1alpha1client.Interface,
 ) func(context.Context, *addonapiv1beta1.ManagedClusterAddOn) (string, error) {
+	adcgetter := utils.NewAddOnDeploymentConfigGetter(addonClient)
+	getCMALister := newCMAListerFunc(ctx, addonName, func() (addonv1alpha1client.Interface, error) {
+		return addonClient, nil
+	})
+
 	return func(ctx context.Context, addon *addonapiv1beta1.ManagedClusterAddOn) (string, error) {
 		if addon == nil {
 			log.Info("failed to get addon install namespace, addon is nil")
@@ -300,17 +727,121 @@ func CommonAgentInstallNamespaceFromDeploymentConfigFunc(
 			return "", nil
 		}
 
-		hostingClusterName := addon.Annotations["addon.open-cluster-management.io/hosting-cluster-name"]
-		// Check it is hosted mode
-		// the hosted mode install namespace name follows the fixed format: klusterlet-<cluster name>
-		if hostingClusterName != "" {
-			return "klusterlet-" + addon.Namespace, nil
+		hostingClusterName := addon.Annotations[addonapiv1beta1.HostingClusterNameAnnotationKey]
+		if hostingClusterName == "" {
+			return utils.AgentInstallNamespaceFromDeploymentConfigFunc(adcgetter)(ctx, addon)
+		}
+
+		namespaceTemplate, err := getHostedInstallNamespaceTemplate(getCMALister, adcgetter, addon)
+		if err != nil {
+			return "", err
 		}
 
-		return utils.AgentInstallNamespaceFromDeploymentConfigFunc(adcgetter)(ctx, addon)
+		return HostedInstallNamespace(namespaceTemplate, addon.Namespace)
 	}
 }
 
+// getHostedInstallNamespaceTemplate returns the template of the hosted mode
+// agent install namespace of the addon.
+func getHostedInstallNamespaceTemplate(
+	getCMALister func() (addonlistersv1beta1.ClusterManagementAddOnLister, error),
+	adcgetter utils.AddOnDeploymentConfigGetter,
+	addon *addonapiv1beta1.ManagedClusterAddOn,
+) (string, error) {
+	config, err := utils.GetDesiredAddOnDeploymentConfig(addon, adcgetter)
+	if err != nil {
+		return "", fmt.Errorf("failed to get deployment config for addon %s: %w", addon.Name, err)
+	}
+
+	if config != nil {
+		for _, variable := range config.Spec.CustomizedVariables {
+			if variable.Name == HostedInstallNamespaceVariable {
+				return variable.Value, nil
+			}
+		}
+	}
+
+	cmaLister, err := getCMALister()
+	if err != nil {
+		return "", err
+	}
+
+	cma, err := cmaLister.Get(addon.Name)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return "", fmt.Errorf("failed to get the ClusterManagementAddOn %s: %w", addon.Name, err)
+	}
+
+	if err == nil && cma.Annotations[HostedInstallNamespaceAnnotation] != "" {
+		return cma.Annotations[HostedInstallNamespaceAnnotation], nil
+	}
+
+	return DefaultHostedInstallNamespace, nil
+}
+
+// newCMAListerFunc returns a function which returns the lister of the
+// ClusterManagementAddOn of the addon. The informer is only started on the first
+// call, since the addon is also built without a hub connection to render the
+// manifests.
+func newCMAListerFunc(
+	ctx context.Context, addonName string, getAddonClient func() (addonv1alpha1client.Interface, error),
+) func() (addonlistersv1beta1.ClusterManagementAddOnLister, error) {
+	return sync.OnceValues(func() (addonlistersv1beta1.ClusterManagementAddOnLister, error) {
+		addonClient, err := getAddonClient()
+		if err != nil {
+			return nil, err
+		}
+
+		cmaInformer := newAddonInformerFactory(addonClient, addonName).Addon().V1beta1().ClusterManagementAddOns()
+		go cmaInformer.Informer().Run(ctx.Done())
+
+		if !cache.WaitForCacheSync(ctx.Done(), cmaInformer.Informer().HasSynced) {
+			return nil, fmt.Errorf("failed to sync the cache of the ClusterManagementAddOn %s", addonName)
+		}
+
+		return cmaInformer.Lister(), nil
+	})
+}
+
+// HostedInstallNamespace renders the template of the hosted mode agent install
+// namespace for the hosted cluster. It returns an error when the template is
+// invalid or the namespace isn't a valid DNS label.
+func HostedInstallNamespace(namespaceTemplate string, clusterName string) (string, error) {
+	tmpl, err := template.New("hostedInstallNamespace").Option("missingkey=error").Parse(namespaceTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid hosted install namespace template '%s': %w", namespaceTemplate, err)
+	}
+
+	namespace := strings.Builder{}
+
+	if err := tmpl.Execute(&namespace, struct{ ClusterName string }{clusterName}); err != nil {
+		return "", fmt.Errorf("invalid hosted install namespace template '%s': %w", namespaceTemplate, err)
+	}
+
+	if errs := validation.IsDNS1123Label(namespace.String()); len(errs) != 0 {
+		return "", fmt.Errorf("invalid hosted install namespace '%s': %s", namespace.String(),
+			strings.Join(errs, ", "))
+	}
+
+	return namespace.String(), nil
+}
+
+// ValidateHostedInstallNamespace returns an InvalidValueError when the hosted
+// install namespace customized variable of the deployment config doesn't render
+// a valid namespace for the cluster.
+func ValidateHostedInstallNamespace(config addonapiv1beta1.AddOnDeploymentConfig, clusterName string) error {
+	for _, variable := range config.Spec.CustomizedVariables {
+		if variable.Name != HostedInstallNamespaceVariable {
+			continue
+		}
+
+		if _, err := HostedInstallNamespace(variable.Value, clusterName); err != nil {
+			return &InvalidValueError{Source: CustomizedVariableSource, Key: HostedInstallNamespaceVariable, Err: err}
+		}
+	}
+
+	return nil
+}
+
 // GetLogLevel verifies the user-provided log level against Zap, returning 0 if the check fails.
 func GetLogLevel(level string) (int8, error) {
 	logDefault := int8(0)
@@ -339,52 +870,117 @@ func (cv *CommonValues) SetLogLevel(value string) error {
 	return err
 }
 
+// fallbackDescription describes the value used in place of a rejected value. A
+// zero value is omitted from the chart values, so the value from another source
+// or the chart default is used instead.
+func fallbackDescription[T comparable](current T) string {
+	var zero T
+	if current == zero {
+		return "the default value"
+	}
+
+	return fmt.Sprintf("value %v", current)
+}
+
+// parseBoundedUint parses a base 10 unsigned integer, returning an error
+// wrapping ErrValueOutOfRange if it is not within the inclusive bounds.
+func parseBoundedUint(value string, minimum, maximum uint16) (uint16, error) {
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		// A value too large for a uint64 is still a valid integer
+		if !errors.Is(err, strconv.ErrRange) {
+			return 0, err
+		}
+
+		parsed = math.MaxUint64
+	}
+
+	if parsed < uint64(minimum) || parsed > uint64(maximum) {
+		return 0, fmt.Errorf("%w: must be between %d and %d", ErrValueOutOfRange, minimum, maximum)
+	}
+
+	// This is safe because the value is within the uint16 bounds
+	return uint16(parsed), nil
+}
+
 // SetEvaluationConcurrency sets the evaluation concurrency for the addon.
 func (cv *CommonValues) SetEvaluationConcurrency(value string) error {
-	evaluationConcurrency, err := strconv.ParseUint(value, 10, 8)
+	evaluationConcurrency, err := parseBoundedUint(value, 1, MaxEvaluationConcurrency)
 	if err != nil {
-		return fmt.Errorf("failed to parse evaluation concurrency value '%s' (falling back to default value %d): %w",
-			value, cv.EvaluationConcurrency, err)
+		return fmt.Errorf("invalid evaluation concurrency value '%s' (falling back to %s): %w",
+			value, fallbackDescription(cv.EvaluationConcurrency), err)
 	}
 
-	// This is safe because we specified the uint8 in ParseUint
-	cv.EvaluationConcurrency = uint8(evaluationConcurrency)
+	cv.EvaluationConcurrency = evaluationConcurrency
 
 	return nil
 }
 
 // SetClientQPS sets the client QPS for the addon.
 func (cv *CommonValues) SetClientQPS(value string) error {
-	clientQPS, err := strconv.ParseUint(value, 10, 8)
+	clientQPS, err := parseBoundedUint(value, 1, MaxClientQPS)
+	if err != nil {
+		return fmt.Errorf("invalid client QPS value '%s' (falling back to %s): %w",
+			value, fallbackDescription(cv.ClientQPS), err)
+	}
+
+	cv.ClientQPS = clientQPS
+
+	return nil
+}
+
+// SetReplicas sets the number of replicas of the addon agent. With more than
+// one replica, the agents use leader election and the chart adds a
+// PodDisruptionBudget and a pod anti-affinity.
+func (cv *CommonValues) SetReplicas(value string) error {
+	replicas, err := parseBoundedUint(value, 1, MaxReplicas)
 	if err != nil {
-		return fmt.Errorf("failed to parse client QPS value '%s' (falling back to default value %d): %w",
-			value, cv.ClientQPS, err)
+		return fmt.Errorf("invalid replicas value '%s' (falling back to %s): %w",
+			value, fallbackDescription(cv.Replicas), err)
 	}
 
-	// This is safe because we specified the uint8 in ParseUint
-	cv.ClientQPS = uint8(clientQPS)
+	cv.Replicas = replicas
+
+	return nil
+}
+
+// SetReplicasFromAnnotation sets the number of replicas of the addon agent from
+// the replicas annotation on the ManagedClusterAddOn. It returns an
+// InvalidValueError when the value is rejected.
+func (cv *CommonValues) SetReplicasFromAnnotation(addon *addonapiv1beta1.ManagedClusterAddOn) error {
+	value, ok := addon.GetAnnotations()[ReplicasAnnotation]
+	if !ok {
+		return nil
+	}
+
+	if err := cv.SetReplicas(value); err != nil {
+		return &InvalidValueError{Source: AnnotationSource, Key: ReplicasAnnotation, Err: err}
+	}
 
 	return nil
 }
 
 // SetClientBurstFromEvaluationConcurrency sets the client burst for the addon
-// based on the evaluation concurrency.
+// based on the evaluation concurrency, capped at MaxClientBurst.
 func (cv *CommonValues) SetClientBurstFromEvaluationConcurrency() {
 	if cv.EvaluationConcurrency != 0 && cv.ClientBurst == 0 {
-		cv.ClientBurst = cv.EvaluationConcurrency*22 + 1
+		// Calculate with a wider type so that the result can't overflow before it's capped
+		clientBurst := uint32(cv.EvaluationConcurrency)*22 + 1
+
+		// This is safe because the value is capped to the uint16 MaxClientBurst
+		cv.ClientBurst = uint16(min(clientBurst, MaxClientBurst))
 	}
 }
 
 // SetClientBurst sets the client burst for the addon.
 func (cv *CommonValues) SetClientBurst(value string) error {
-	clientBurst, err := strconv.ParseUint(value, 10, 8)
+	clientBurst, err := parseBoundedUint(value, 1, MaxClientBurst)
 	if err != nil {
-		return fmt.Errorf("failed to parse client burst value '%s' (falling back to default value %d): %w",
-			value, cv.ClientBurst, err)
+		return fmt.Errorf("invalid client burst value '%s' (falling back to %s): %w",
+			value, fallbackDescription(cv.ClientBurst), err)
 	}
 
-	// This is safe because we specified the uint8 in ParseUint
-	cv.ClientBurst = uint8(clientBurst)
+	cv.ClientBurst = clientBurst
 
 	return nil
 }
@@ -429,18 +1025,102 @@ func (cv *CommonValues) SetPrometheusEnabled(value string) error {
 	return nil
 }
 
+// SetPriorityClassName sets the PriorityClass of the addon agent pods.
+func (cv *CommonValues) SetPriorityClassName(value string) error {
+	if errs := validation.IsDNS1123Subdomain(value); len(errs) != 0 {
+		return fmt.Errorf("invalid priority class name '%s' (leaving unset): %s", value, strings.Join(errs, ", "))
+	}
+
+	cv.PriorityClassName = value
+
+	return nil
+}
+
+// SetTopologySpreadConstraints sets the topology spread constraints of the
+// addon agent pods from a JSON or YAML list. The chart selects the agent pods
+// for the constraints without a label selector.
+func (cv *CommonValues) SetTopologySpreadConstraints(value string) error {
+	constraints := []corev1.TopologySpreadConstraint{}
+
+	if err := yaml.UnmarshalStrict([]byte(value), &constraints); err != nil {
+		return fmt.Errorf("failed to parse topology spread constraints '%s' (leaving unset): %w", value, err)
+	}
+
+	for i, constraint := range constraints {
+		if constraint.MaxSkew < 1 || constraint.TopologyKey == "" {
+			return fmt.Errorf("topology spread constraint %d must have a topologyKey and a maxSkew of at least 1 "+
+				"(leaving unset)", i)
+		}
+
+		switch constraint.WhenUnsatisfiable {
+		case corev1.DoNotSchedule, corev1.ScheduleAnyway:
+		default:
+			return fmt.Errorf("topology spread constraint %d has an unsupported whenUnsatisfiable value '%s' "+
+				"(leaving unset)", i, constraint.WhenUnsatisfiable)
+		}
+	}
+
+	cv.TopologySpreadConstraints = constraints
+
+	return nil
+}
+
+// SetPodDisruptionBudgetEnabled sets whether the chart creates a
+// PodDisruptionBudget for the addon agent pods. When it's unset, the
+// PodDisruptionBudget is created with more than one replica.
+func (cv *CommonValues) SetPodDisruptionBudgetEnabled(value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("failed to parse pod disruption budget enabled boolean '%s' "+
+			"(falling back to the default value): %w", value, err)
+	}
+
+	if cv.PodDisruptionBudget == nil {
+		cv.PodDisruptionBudget = &PodDisruptionBudget{}
+	}
+
+	cv.PodDisruptionBudget.Enabled = &enabled
+
+	return nil
+}
+
+// SetPodDisruptionBudgetMaxUnavailable sets the number or percentage of the
+// addon agent pods which can be disrupted at once. It must allow at least one
+// pod to be disrupted so that node drains aren't blocked.
+func (cv *CommonValues) SetPodDisruptionBudgetMaxUnavailable(value string) error {
+	maxUnavailable := intstr.Parse(value)
+
+	scaled, err := intstr.GetScaledValueFromIntOrPercent(&maxUnavailable, 100, true)
+	if err != nil {
+		return fmt.Errorf("invalid pod disruption budget max unavailable value '%s' "+
+			"(falling back to the default value): %w", value, err)
+	}
+
+	if scaled < 1 || (maxUnavailable.Type == intstr.String && scaled > 100) {
+		return fmt.Errorf("invalid pod disruption budget max unavailable value '%s' "+
+			"(falling back to the default value): %w", value, ErrValueOutOfRange)
+	}
+
+	if cv.PodDisruptionBudget == nil {
+		cv.PodDisruptionBudget = &PodDisruptionBudget{}
+	}
+
+	cv.PodDisruptionBudget.MaxUnavailable = &maxUnavailable
+
+	return nil
+}
+
 // SetCommonValues populates settings in the common chart values for the addon
 // based on the environment. It returns an error for the respective component
 // addon handler.
 //
-// Currently the only error is a fetch error for the hosting cluster, which
-// would warrant a retry.
+// Currently the only error is an ErrHostingClusterUnresolved fetch error for
+// the hosting cluster, which warrants a retry.
 func (cv *CommonValues) SetCommonValues(
 	cluster *clusterv1.ManagedCluster,
 	addon *addonapiv1beta1.ManagedClusterAddOn,
 	clusterClient clusterlistersv1.ManagedClusterLister,
 ) error {
-	var err error
 	// Set the Kubernetes distribution for the current cluster
 	cv.KubernetesDistribution = GetClusterVendor(cluster)
 
@@ -448,9 +1128,11 @@ func (cv *CommonValues) SetCommonValues(
 	hostingClusterName := addon.GetAnnotations()[addonapiv1beta1.HostingClusterNameAnnotationKey]
 	if hostingClusterName != "" {
 		hostingCluster, err := clusterClient.Get(hostingClusterName)
-		if err == nil {
-			cv.HostingKubernetesDistribution = GetClusterVendor(hostingCluster)
+		if err != nil {
+			return fmt.Errorf("%w %s: %w", ErrHostingClusterUnresolved, hostingClusterName, err)
 		}
+
+		cv.HostingKubernetesDistribution = GetClusterVendor(hostingCluster)
 	} else {
 		cv.HostingKubernetesDistribution = cv.KubernetesDistribution
 	}
@@ -460,7 +1142,7 @@ func (cv *CommonValues) SetCommonValues(
 		Enabled: cv.HostingKubernetesDistribution == "OpenShift",
 	}
 
-	return err
+	return nil
 }
 
 // SetCommonValuesFromCustomizedVariables sets the common values for the addon
@@ -475,20 +1157,33 @@ func (cv *CommonValues) SetCommonValuesFromCustomizedVariables(
 
 	//nolint:nlreturn,unparam
 	variableToFuncMap := map[string]func(string) error{
-		"logLevel":              cv.SetLogLevel,
-		"logEncoder":            func(value string) error { cv.LogEncoder = value; return nil },
-		"evaluationConcurrency": cv.SetEvaluationConcurrency,
-		"clientQPS":             cv.SetClientQPS,
-		"clientBurst":           cv.SetClientBurst,
-		"prometheusEnabled":     cv.SetPrometheusEnabled,
-		"tlsMinVersion":         cv.SetTLSMinVersion,
-		"tlsCipherSuites":       cv.SetTLSCipherSuites,
+		"logLevel":                          cv.SetLogLevel,
+		"logEncoder":                        func(value string) error { cv.LogEncoder = value; return nil },
+		"evaluationConcurrency":             cv.SetEvaluationConcurrency,
+		"clientQPS":                         cv.SetClientQPS,
+		"clientBurst":                       cv.SetClientBurst,
+		"prometheusEnabled":                 cv.SetPrometheusEnabled,
+		"tlsMinVersion":                     cv.SetTLSMinVersion,
+		"tlsCipherSuites":                   cv.SetTLSCipherSuites,
+		"priorityClassName":                 cv.SetPriorityClassName,
+		"topologySpreadConstraints":         cv.SetTopologySpreadConstraints,
+		"podDisruptionBudgetEnabled":        cv.SetPodDisruptionBudgetEnabled,
+		"podDisruptionBudgetMaxUnavailable": cv.SetPodDisruptionBudgetMaxUnavailable,
+		// The image is set by SetImageFromDeploymentConfig since its key depends on the addon
+		ImageVariable: func(string) error { return nil },
+		// The hosted install namespace isn't a value, it's validated for the cluster by
+		// ValidateHostedInstallNamespace
+		HostedInstallNamespaceVariable: func(string) error { return nil },
 	}
 
 	for _, variable := range config.Spec.CustomizedVariables {
 		if fn, ok := variableToFuncMap[variable.Name]; ok {
 			if err := fn(variable.Value); err != nil {
-				aggregateErr = errors.Join(aggregateErr, err)
+				aggregateErr = errors.Join(aggregateErr, &InvalidValueError{
+					Source: CustomizedVariableSource,
+					Key:    variable.Name,
+					Err:    err,
+				})
 			}
 		} else {
 			// If the variable is unknown, add it to the returned values
@@ -501,11 +1196,113 @@ func (cv *CommonValues) SetCommonValuesFromCustomizedVariables(
 	return values, aggregateErr
 }
 
+// NewDefaultImagesFunc returns a function returning the default images of the
+// addon by image key, which are the global.imageOverrides of the values of the
+// chart in chartDir, with the image at imageKey set from the imageEnvVar
+// environment variable when it is set. The chart values are only read once.
+func NewDefaultImagesFunc(
+	filesystem embed.FS, chartDir string, imageKey string, imageEnvVar string,
+) func() (map[string]string, error) {
+	getChartImages := sync.OnceValues(func() (map[string]string, error) {
+		raw, err := filesystem.ReadFile(chartDir + "/values.yaml")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the chart values: %w", err)
+		}
+
+		chartValues := struct {
+			Global GlobalValues `json:"global"`
+		}{}
+
+		if err := yaml.Unmarshal(raw, &chartValues); err != nil {
+			return nil, fmt.Errorf("failed to parse the chart values: %w", err)
+		}
+
+		return chartValues.Global.ImageOverrides, nil
+	})
+
+	return func() (map[string]string, error) {
+		chartImages, err := getChartImages()
+		if err != nil {
+			return nil, err
+		}
+
+		images := maps.Clone(chartImages)
+		if images == nil {
+			images = map[string]string{}
+		}
+
+		if image := os.Getenv(imageEnvVar); image != "" {
+			images[imageKey] = image
+		}
+
+		return images, nil
+	}
+}
+
+// SetImageFromDeploymentConfig sets the images of the addon in the image
+// overrides from the deployment config. The image at imageKey is taken from the
+// image customized variable, falling back to its default image, and the
+// registry mirrors of the deployment config are applied to every image. An
+// image is left unset when it would be its default image, so that the default
+// keeps its origin. An invalid image variable is rejected with an
+// InvalidValueError and the default image is used.
+func (cv *CommonValues) SetImageFromDeploymentConfig(
+	config addonapiv1beta1.AddOnDeploymentConfig, imageKey string, defaultImages map[string]string,
+) error {
+	var err error
+
+	images := maps.Clone(defaultImages)
+	if images == nil {
+		images = map[string]string{}
+	}
+
+	for _, variable := range config.Spec.CustomizedVariables {
+		if variable.Name != ImageVariable {
+			continue
+		}
+
+		if !imageReferenceRegexp.MatchString(variable.Value) {
+			err = &InvalidValueError{
+				Source: CustomizedVariableSource,
+				Key:    ImageVariable,
+				Err: fmt.Errorf("invalid image reference '%s' (falling back to default image '%s')",
+					variable.Value, defaultImages[imageKey]),
+			}
+
+			continue
+		}
+
+		images[imageKey] = variable.Value
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(images)) {
+		if images[key] == "" {
+			continue
+		}
+
+		image := addonfactory.OverrideImage(config.Spec.Registries, images[key])
+		if image == defaultImages[key] {
+			continue
+		}
+
+		if cv.GlobalValues == nil {
+			cv.GlobalValues = &GlobalValues{}
+		}
+
+		if cv.GlobalValues.ImageOverrides == nil {
+			cv.GlobalValues.ImageOverrides = map[string]string{}
+		}
+
+		cv.GlobalValues.ImageOverrides[key] = image
+	}
+
+	return err
+}
+
 // SetCommonValuesFromAnnotations sets the common values for the addon chart
 // using annotations on the ManagedClusterAddOn. It returns an aggregated error
-// for the respective component addon handler.
+// of InvalidValueErrors for the respective component addon handler.
 func (cv *CommonValues) SetCommonValuesFromAnnotations(addon *addonapiv1beta1.ManagedClusterAddOn) error {
-	addonName := addon.Name
 	mcaoAnnotations := addon.GetAnnotations()
 	var aggregateErr error
 
@@ -517,19 +1314,72 @@ func (cv *CommonValues) SetCommonValuesFromAnnotations(addon *addonapiv1beta1.Ma
 		PrometheusEnabledAnnotation:     cv.SetPrometheusEnabled,
 	}
 
-	for annotation, fn := range annotationToFuncMap {
+	// Sort the annotations so that the aggregated error is consistent between calls
+	for _, annotation := range slices.Sorted(maps.Keys(annotationToFuncMap)) {
 		if val, ok := mcaoAnnotations[annotation]; ok {
-			if err := fn(val); err != nil {
-				aggregateErr = errors.Join(aggregateErr,
-					fmt.Errorf("failed to set value from annotation '%s' for addon '%s': %w",
-						annotation, addonName, err))
+			if err := annotationToFuncMap[annotation](val); err != nil {
+				aggregateErr = errors.Join(aggregateErr, &InvalidValueError{
+					Source: AnnotationSource,
+					Key:    annotation,
+					Err:    err,
+				})
 			}
 		}
 	}
 
 	cv.SetClientBurstFromEvaluationConcurrency()
 
-	return nil
+	return aggregateErr
+}
+
+// IsClusterDeploymentConfig returns whether the desired AddOnDeploymentConfig
+// of the addon is set in the configs of the ManagedClusterAddOn, rather than by
+// the default config or an install strategy placement of the
+// ClusterManagementAddOn.
+func IsClusterDeploymentConfig(addon *addonapiv1beta1.ManagedClusterAddOn) bool {
+	ok, configRef := utils.GetAddOnConfigRef(addon.Status.ConfigReferences,
+		utils.AddOnDeploymentConfigGVR.Group, utils.AddOnDeploymentConfigGVR.Resource)
+	if !ok || configRef.DesiredConfig == nil {
+		return false
+	}
+
+	return slices.ContainsFunc(addon.Spec.Configs, func(config addonapiv1beta1.AddOnConfig) bool {
+		return config.Group == utils.AddOnDeploymentConfigGVR.Group &&
+			config.Resource == utils.AddOnDeploymentConfigGVR.Resource &&
+			config.ConfigReferent == configRef.DesiredConfig.ConfigReferent
+	})
+}
+
+// DeploymentConfigValuesFuncs splits the values from the AddOnDeploymentConfig
+// by where the config is set. The first returned function has the values of the
+// AddOnDeploymentConfig from the default config or an install strategy
+// placement of the ClusterManagementAddOn, and the second the values of the
+// AddOnDeploymentConfig set in the configs of the ManagedClusterAddOn. Both
+// should be set before the annotation values functions.
+func DeploymentConfigValuesFuncs(
+	getValues addonfactory.GetValuesFunc,
+) (addonfactory.GetValuesFunc, addonfactory.GetValuesFunc) {
+	defaultValues := func(
+		cluster *clusterv1.ManagedCluster, addon *addonapiv1beta1.ManagedClusterAddOn,
+	) (addonfactory.Values, error) {
+		if IsClusterDeploymentConfig(addon) {
+			return addonfactory.Values{}, nil
+		}
+
+		return getValues(cluster, addon)
+	}
+
+	clusterValues := func(
+		cluster *clusterv1.ManagedCluster, addon *addonapiv1beta1.ManagedClusterAddOn,
+	) (addonfactory.Values, error) {
+		if !IsClusterDeploymentConfig(addon) {
+			return addonfactory.Values{}, nil
+		}
+
+		return getValues(cluster, addon)
+	}
+
+	return defaultValues, clusterValues
 }
 
 // MandateValues sets deployment variables regardless of user overrides. As a result, caution should
@@ -2,7 +2,23 @@
 
 package addon
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"open-cluster-management.io/addon-framework/pkg/addonfactory"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonfake "open-cluster-management.io/api/client/addon/clientset/versioned/fake"
+	clusterlistersv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
 
 func TestSetTLSMinVersion(t *testing.T) {
 	t.Run("valid version is set", func(t *testing.T) {
@@ -56,3 +72,583 @@ func TestSetTLSCipherSuites(t *testing.T) {
 		}
 	})
 }
+
+func TestSetCommonValuesFromAnnotations(t *testing.T) {
+	t.Run("invalid values are returned as InvalidValueErrors", func(t *testing.T) {
+		cv := &CommonValues{}
+		addon := &addonapiv1beta1.ManagedClusterAddOn{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{"client-qps": "not-a-number"},
+			},
+		}
+
+		err := cv.SetCommonValuesFromAnnotations(addon)
+
+		var invalidErr *InvalidValueError
+		if !errors.As(err, &invalidErr) {
+			t.Fatalf("expected an InvalidValueError, got: %v", err)
+		}
+
+		if invalidErr.Source != AnnotationSource || invalidErr.Key != "client-qps" {
+			t.Fatalf("expected the error to reference the client-qps annotation, got: %v", invalidErr)
+		}
+	})
+}
+
+func TestSetConfigurationValidCondition(t *testing.T) {
+	addon := &addonapiv1beta1.ManagedClusterAddOn{}
+
+	SetConfigurationValidCondition(addon, &InvalidValueError{
+		Source: AnnotationSource, Key: "log-level", Err: errors.New("bad value"),
+	})
+
+	cond := meta.FindStatusCondition(addon.Status.Conditions, ConfigurationValidCondition)
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != InvalidValuesReason {
+		t.Fatalf("expected a False condition with the %s reason, got: %v", InvalidValuesReason, cond)
+	}
+
+	SetConfigurationValidCondition(addon, nil)
+
+	cond = meta.FindStatusCondition(addon.Status.Conditions, ConfigurationValidCondition)
+	if cond == nil || cond.Status != metav1.ConditionTrue {
+		t.Fatalf("expected a True condition, got: %v", cond)
+	}
+}
+
+func TestSetCommonValuesHostingCluster(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	lister := clusterlistersv1.NewManagedClusterLister(indexer)
+
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{addonapiv1beta1.HostingClusterNameAnnotationKey: "hosting"},
+		},
+	}
+
+	cv := &CommonValues{}
+
+	err := cv.SetCommonValues(&clusterv1.ManagedCluster{}, addon, lister)
+	if !errors.Is(err, ErrHostingClusterUnresolved) {
+		t.Fatalf("expected an ErrHostingClusterUnresolved error for a missing hosting cluster, got: %v", err)
+	}
+
+	hostingCluster := &clusterv1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "hosting", Labels: map[string]string{"vendor": "OpenShift"}},
+	}
+
+	if err := indexer.Add(hostingCluster); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cv.SetCommonValues(&clusterv1.ManagedCluster{}, addon, lister); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if cv.HostingKubernetesDistribution != "OpenShift" || !cv.PrometheusConfig.Enabled {
+		t.Fatalf("expected the OpenShift hosting cluster values, got: %v", cv)
+	}
+}
+
+func TestSetHostingClusterResolvedCondition(t *testing.T) {
+	addon := &addonapiv1beta1.ManagedClusterAddOn{}
+	unresolvedErr := fmt.Errorf("%w hosting: not found", ErrHostingClusterUnresolved)
+
+	if !SetHostingClusterResolvedCondition(addon, unresolvedErr) {
+		t.Fatal("expected the unresolved hosting cluster to be reported")
+	}
+
+	cond := meta.FindStatusCondition(addon.Status.Conditions, HostingClusterResolvedCondition)
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != HostingClusterUnresolvedReason {
+		t.Fatalf("expected a False condition with the %s reason, got: %v", HostingClusterUnresolvedReason, cond)
+	}
+
+	if SetHostingClusterResolvedCondition(addon, unresolvedErr) {
+		t.Fatal("expected the same unresolved hosting cluster to not be reported again")
+	}
+
+	if SetHostingClusterResolvedCondition(addon, errors.New("other failure")) {
+		t.Fatal("expected another failure to not be reported")
+	}
+
+	SetHostingClusterResolvedCondition(addon, nil)
+
+	cond = meta.FindStatusCondition(addon.Status.Conditions, HostingClusterResolvedCondition)
+	if cond == nil || cond.Status != metav1.ConditionTrue {
+		t.Fatalf("expected a True condition, got: %v", cond)
+	}
+
+	if !SetHostingClusterResolvedCondition(addon, unresolvedErr) {
+		t.Fatal("expected the hosting cluster failing to be resolved again to be reported")
+	}
+}
+
+func TestSetClientQPS(t *testing.T) {
+	tests := map[string]struct {
+		value       string
+		expected    uint16
+		outOfRange  bool
+		expectError bool
+	}{
+		"large value is accepted":        {value: "2000", expected: 2000},
+		"maximum value is accepted":      {value: "5000", expected: MaxClientQPS},
+		"zero is out of range":           {value: "0", outOfRange: true, expectError: true},
+		"value above maximum":            {value: "5001", outOfRange: true, expectError: true},
+		"value above uint64 is rejected": {value: "99999999999999999999999", outOfRange: true, expectError: true},
+		"non-numeric value is rejected":  {value: "fast", expectError: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cv := &CommonValues{}
+
+			err := cv.SetClientQPS(test.value)
+			if (err != nil) != test.expectError {
+				t.Fatalf("expected error to be %v, got: %v", test.expectError, err)
+			}
+
+			if errors.Is(err, ErrValueOutOfRange) != test.outOfRange {
+				t.Fatalf("expected out of range error to be %v, got: %v", test.outOfRange, err)
+			}
+
+			if cv.ClientQPS != test.expected {
+				t.Fatalf("expected ClientQPS to be %d, got: %d", test.expected, cv.ClientQPS)
+			}
+		})
+	}
+}
+
+func TestSetReplicasFromAnnotation(t *testing.T) {
+	tests := map[string]struct {
+		value       string
+		expected    uint16
+		expectError bool
+	}{
+		"multiple replicas are accepted": {value: "3", expected: 3},
+		"zero is rejected":               {value: "0", expectError: true},
+		"value above maximum":            {value: "11", expectError: true},
+		"non-numeric value is rejected":  {value: "many", expectError: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cv := &CommonValues{}
+			addon := &addonapiv1beta1.ManagedClusterAddOn{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ReplicasAnnotation: test.value}},
+			}
+
+			err := cv.SetReplicasFromAnnotation(addon)
+			if (err != nil) != test.expectError {
+				t.Fatalf("expected error to be %v, got: %v", test.expectError, err)
+			}
+
+			var invalidErr *InvalidValueError
+			if err != nil && (!errors.As(err, &invalidErr) || invalidErr.Key != ReplicasAnnotation) {
+				t.Fatalf("expected an InvalidValueError for the annotation, got: %v", err)
+			}
+
+			if cv.Replicas != test.expected {
+				t.Fatalf("expected Replicas to be %d, got: %d", test.expected, cv.Replicas)
+			}
+		})
+	}
+}
+
+func TestSetTopologySpreadConstraints(t *testing.T) {
+	tests := map[string]struct {
+		value       string
+		expected    int
+		expectError bool
+	}{
+		"JSON list is accepted": {
+			value:    `[{"maxSkew": 1, "topologyKey": "zone", "whenUnsatisfiable": "ScheduleAnyway"}]`,
+			expected: 1,
+		},
+		"YAML list is accepted": {
+			value:    "- maxSkew: 2\n  topologyKey: zone\n  whenUnsatisfiable: DoNotSchedule",
+			expected: 1,
+		},
+		"missing topology key is rejected": {
+			value:       `[{"maxSkew": 1, "whenUnsatisfiable": "ScheduleAnyway"}]`,
+			expectError: true,
+		},
+		"unsupported whenUnsatisfiable is rejected": {
+			value:       `[{"maxSkew": 1, "topologyKey": "zone", "whenUnsatisfiable": "Sometimes"}]`,
+			expectError: true,
+		},
+		"unknown field is rejected": {
+			value:       `[{"maxSkew": 1, "topologyKey": "zone", "whenUnsatisfiable": "ScheduleAnyway", "skew": 1}]`,
+			expectError: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cv := &CommonValues{}
+
+			err := cv.SetTopologySpreadConstraints(test.value)
+			if (err != nil) != test.expectError {
+				t.Fatalf("expected error to be %v, got: %v", test.expectError, err)
+			}
+
+			if len(cv.TopologySpreadConstraints) != test.expected {
+				t.Fatalf("expected %d constraints, got: %v", test.expected, cv.TopologySpreadConstraints)
+			}
+		})
+	}
+}
+
+func TestSetPodDisruptionBudgetMaxUnavailable(t *testing.T) {
+	tests := map[string]struct {
+		value       string
+		expectError bool
+	}{
+		"number is accepted":            {value: "2"},
+		"percentage is accepted":        {value: "50%"},
+		"zero is rejected":              {value: "0", expectError: true},
+		"zero percent is rejected":      {value: "0%", expectError: true},
+		"percentage above 100":          {value: "150%", expectError: true},
+		"non-numeric value is rejected": {value: "some", expectError: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cv := &CommonValues{}
+
+			err := cv.SetPodDisruptionBudgetMaxUnavailable(test.value)
+			if (err != nil) != test.expectError {
+				t.Fatalf("expected error to be %v, got: %v", test.expectError, err)
+			}
+
+			if test.expectError != (cv.PodDisruptionBudget == nil) {
+				t.Fatalf("expected the PodDisruptionBudget to be set only for a valid value, got: %v",
+					cv.PodDisruptionBudget)
+			}
+		})
+	}
+}
+
+func TestSetClientBurstFromEvaluationConcurrency(t *testing.T) {
+	t.Run("burst is derived from the evaluation concurrency", func(t *testing.T) {
+		cv := &CommonValues{}
+		cv.EvaluationConcurrency = 20
+
+		cv.SetClientBurstFromEvaluationConcurrency()
+
+		if cv.ClientBurst != 441 {
+			t.Fatalf("expected ClientBurst to be 441, got: %d", cv.ClientBurst)
+		}
+	})
+
+	t.Run("derived burst is capped", func(t *testing.T) {
+		cv := &CommonValues{}
+		cv.EvaluationConcurrency = 65535
+
+		cv.SetClientBurstFromEvaluationConcurrency()
+
+		if cv.ClientBurst != MaxClientBurst {
+			t.Fatalf("expected ClientBurst to be capped at %d, got: %d", MaxClientBurst, cv.ClientBurst)
+		}
+	})
+
+	t.Run("explicit burst is kept", func(t *testing.T) {
+		cv := &CommonValues{}
+		cv.EvaluationConcurrency = 20
+		cv.ClientBurst = 50
+
+		cv.SetClientBurstFromEvaluationConcurrency()
+
+		if cv.ClientBurst != 50 {
+			t.Fatalf("expected ClientBurst to be kept at 50, got: %d", cv.ClientBurst)
+		}
+	})
+}
+
+func TestDeploymentConfigValuesFuncs(t *testing.T) {
+	configReferent := addonapiv1beta1.ConfigReferent{Namespace: "open-cluster-management", Name: "edge-config"}
+	configGroupResource := addonapiv1beta1.ConfigGroupResource{
+		Group:    "addon.open-cluster-management.io",
+		Resource: "addondeploymentconfigs",
+	}
+
+	getValues := func(_ *clusterv1.ManagedCluster, _ *addonapiv1beta1.ManagedClusterAddOn) (addonfactory.Values, error) {
+		return addonfactory.Values{"logLevel": 2}, nil
+	}
+
+	defaultValues, clusterValues := DeploymentConfigValuesFuncs(getValues)
+
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		Status: addonapiv1beta1.ManagedClusterAddOnStatus{
+			ConfigReferences: []addonapiv1beta1.ConfigReference{{
+				ConfigGroupResource: configGroupResource,
+				DesiredConfig: &addonapiv1beta1.ConfigSpecHash{
+					ConfigReferent: configReferent,
+					SpecHash:       "hash",
+				},
+			}},
+		},
+	}
+
+	t.Run("config from the ClusterManagementAddOn is applied before the annotations", func(t *testing.T) {
+		if IsClusterDeploymentConfig(addon) {
+			t.Fatal("expected the config not to be set on the ManagedClusterAddOn")
+		}
+
+		values, _ := defaultValues(nil, addon)
+		if len(values) == 0 {
+			t.Fatal("expected the default values function to return the config values")
+		}
+
+		values, _ = clusterValues(nil, addon)
+		if len(values) != 0 {
+			t.Fatalf("expected the cluster values function to return no values, got: %v", values)
+		}
+	})
+
+	t.Run("config from the ManagedClusterAddOn is applied by the cluster values function", func(t *testing.T) {
+		clusterAddon := addon.DeepCopy()
+		clusterAddon.Spec.Configs = []addonapiv1beta1.AddOnConfig{{
+			ConfigGroupResource: configGroupResource,
+			ConfigReferent:      configReferent,
+		}}
+
+		if !IsClusterDeploymentConfig(clusterAddon) {
+			t.Fatal("expected the config to be set on the ManagedClusterAddOn")
+		}
+
+		values, _ := defaultValues(nil, clusterAddon)
+		if len(values) != 0 {
+			t.Fatalf("expected the default values function to return no values, got: %v", values)
+		}
+
+		values, _ = clusterValues(nil, clusterAddon)
+		if len(values) == 0 {
+			t.Fatal("expected the cluster values function to return the config values")
+		}
+	})
+}
+
+func TestSetImageFromDeploymentConfig(t *testing.T) {
+	defaultImage := "quay.io/stolostron/config-policy-controller:latest"
+	mirror := addonapiv1beta1.ImageMirror{
+		Source: "quay.io/stolostron",
+		Mirror: "registry.example.com/stolostron",
+	}
+
+	tests := map[string]struct {
+		image       string
+		registries  []addonapiv1beta1.ImageMirror
+		imageKey    string
+		expected    string
+		expectError bool
+	}{
+		"default image is left unset": {},
+		"image variable is set": {
+			image:    "quay.io/stolostron/config-policy-controller:hotfix",
+			expected: "quay.io/stolostron/config-policy-controller:hotfix",
+		},
+		"registries mirror the default": {
+			registries: []addonapiv1beta1.ImageMirror{mirror},
+			expected:   "registry.example.com/stolostron/config-policy-controller:latest",
+		},
+		"registries mirror the variable": {
+			image:      "quay.io/stolostron/other:v1",
+			registries: []addonapiv1beta1.ImageMirror{mirror},
+			expected:   "registry.example.com/stolostron/other:v1",
+		},
+		"digest image variable is set": {
+			image:    "localhost:5000/policy@sha256:" + strings.Repeat("a", 64),
+			expected: "localhost:5000/policy@sha256:" + strings.Repeat("a", 64),
+		},
+		"invalid image variable is ignored": {image: "Not An Image", expectError: true},
+		"registries mirror every image": {
+			registries: []addonapiv1beta1.ImageMirror{mirror},
+			imageKey:   "kube_rbac_proxy",
+			expected:   "registry.example.com/stolostron/kube-rbac-proxy:latest",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := addonapiv1beta1.AddOnDeploymentConfig{
+				Spec: addonapiv1beta1.AddOnDeploymentConfigSpec{Registries: test.registries},
+			}
+
+			if test.image != "" {
+				config.Spec.CustomizedVariables = []addonapiv1beta1.CustomizedVariable{
+					{Name: ImageVariable, Value: test.image},
+				}
+			}
+
+			defaultImages := map[string]string{
+				"config_policy_controller": defaultImage,
+				"kube_rbac_proxy":          "quay.io/stolostron/kube-rbac-proxy:latest",
+			}
+			cv := &CommonValues{}
+
+			err := cv.SetImageFromDeploymentConfig(config, "config_policy_controller", defaultImages)
+			if (err != nil) != test.expectError {
+				t.Fatalf("expected error to be %v, got: %v", test.expectError, err)
+			}
+
+			imageKey := test.imageKey
+			if imageKey == "" {
+				imageKey = "config_policy_controller"
+			}
+
+			image := ""
+			if cv.GlobalValues != nil {
+				image = cv.GlobalValues.ImageOverrides[imageKey]
+			}
+
+			if image != test.expected {
+				t.Fatalf("expected the image to be %q, got: %q", test.expected, image)
+			}
+		})
+	}
+}
+
+func TestHostedInstallNamespace(t *testing.T) {
+	tests := map[string]struct {
+		template    string
+		expected    string
+		expectedErr string
+	}{
+		"default":        {template: DefaultHostedInstallNamespace, expected: "klusterlet-cluster1"},
+		"custom pattern": {template: "{{ .ClusterName }}-hosted-agents", expected: "cluster1-hosted-agents"},
+		"static":         {template: "hosted-agents", expected: "hosted-agents"},
+		"unknown field": {
+			template:    "klusterlet-{{ .Cluster }}",
+			expectedErr: "invalid hosted install namespace template",
+		},
+		"not a DNS label": {
+			template:    "Klusterlet.{{ .ClusterName }}",
+			expectedErr: "invalid hosted install namespace 'Klusterlet.cluster1'",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			namespace, err := HostedInstallNamespace(test.template, "cluster1")
+
+			if test.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+					t.Fatalf("expected error containing %q, got: %v", test.expectedErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+
+			if namespace != test.expected {
+				t.Fatalf("expected namespace %q, got %q", test.expected, namespace)
+			}
+		})
+	}
+}
+
+func TestValidateHostedInstallNamespace(t *testing.T) {
+	config := addonapiv1beta1.AddOnDeploymentConfig{
+		Spec: addonapiv1beta1.AddOnDeploymentConfigSpec{
+			CustomizedVariables: []addonapiv1beta1.CustomizedVariable{
+				{Name: HostedInstallNamespaceVariable, Value: "{{ .ClusterName }}-klusterlet"},
+			},
+		},
+	}
+
+	if err := ValidateHostedInstallNamespace(config, "cluster1"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// The namespace is only too long with the name of this cluster
+	err := ValidateHostedInstallNamespace(config, strings.Repeat("a", 60))
+
+	invalidErr := &InvalidValueError{}
+	if !errors.As(err, &invalidErr) || invalidErr.Key != HostedInstallNamespaceVariable {
+		t.Fatalf("expected an InvalidValueError for the hosted install namespace, got: %v", err)
+	}
+}
+
+func TestCommonAgentInstallNamespaceFromDeploymentConfigFunc(t *testing.T) {
+	cma := &addonapiv1beta1.ClusterManagementAddOn{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "config-policy-controller",
+			Annotations: map[string]string{HostedInstallNamespaceAnnotation: "{{ .ClusterName }}-klusterlet"},
+		},
+	}
+	adc := &addonapiv1beta1.AddOnDeploymentConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "hosted", Namespace: "open-cluster-management"},
+		Spec: addonapiv1beta1.AddOnDeploymentConfigSpec{
+			CustomizedVariables: []addonapiv1beta1.CustomizedVariable{
+				{Name: HostedInstallNamespaceVariable, Value: "hosted-{{ .ClusterName }}"},
+			},
+		},
+	}
+
+	hostedAddon := func(withConfig bool) *addonapiv1beta1.ManagedClusterAddOn {
+		addon := &addonapiv1beta1.ManagedClusterAddOn{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "config-policy-controller",
+				Namespace:   "cluster1",
+				Annotations: map[string]string{addonapiv1beta1.HostingClusterNameAnnotationKey: "hosting"},
+			},
+		}
+
+		if withConfig {
+			addon.Status.ConfigReferences = []addonapiv1beta1.ConfigReference{{
+				ConfigGroupResource: addonapiv1beta1.ConfigGroupResource{
+					Group:    "addon.open-cluster-management.io",
+					Resource: "addondeploymentconfigs",
+				},
+				DesiredConfig: &addonapiv1beta1.ConfigSpecHash{
+					ConfigReferent: addonapiv1beta1.ConfigReferent{Name: "hosted", Namespace: "open-cluster-management"},
+					SpecHash:       "hash",
+				},
+			}}
+		}
+
+		return addon
+	}
+
+	tests := map[string]struct {
+		objects  []runtime.Object
+		addon    *addonapiv1beta1.ManagedClusterAddOn
+		expected string
+	}{
+		"default pattern": {
+			addon:    hostedAddon(false),
+			expected: "klusterlet-cluster1",
+		},
+		"ClusterManagementAddOn annotation": {
+			objects:  []runtime.Object{cma},
+			addon:    hostedAddon(false),
+			expected: "cluster1-klusterlet",
+		},
+		"deployment config overrides the annotation": {
+			objects:  []runtime.Object{cma, adc},
+			addon:    hostedAddon(true),
+			expected: "hosted-cluster1",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.TODO())
+			defer cancel()
+
+			client := addonfake.NewSimpleClientset(test.objects...)
+			getNamespace := CommonAgentInstallNamespaceFromDeploymentConfigFunc(ctx, "config-policy-controller", client)
+
+			namespace, err := getNamespace(ctx, test.addon)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+
+			if namespace != test.expected {
+				t.Fatalf("expected namespace %q, got %q", test.expected, namespace)
+			}
+		})
+	}
+}
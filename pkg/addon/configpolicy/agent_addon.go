@@ -5,7 +5,9 @@ import (
 	"embed"
 	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
 	"strconv"
 	"time"
 
@@ -33,6 +35,10 @@ const (
 	addonName                        = "config-policy-controller"
 	operatorPolicyDisabledAnnotation = "operator-policy-disabled"
 	standaloneTemplatingAddonName    = "governance-standalone-hub-templating"
+	imageEnvVar                      = "CONFIG_POLICY_CONTROLLER_IMAGE"
+	imageKey                         = "config_policy_controller"
+	// hubRoleBindingName is the name of the RoleBinding granting the agent access in its cluster namespace
+	hubRoleBindingName = "open-cluster-management:config-policy-controller-hub"
 )
 
 type configPolicyUserValues struct {
@@ -44,7 +50,8 @@ type configPolicyUserValues struct {
 }
 
 type operatorPolicy struct {
-	Disabled         bool   `json:"disabled"`
+	// Disabled is only set when configured so that it doesn't override a lower precedence value
+	Disabled         *bool  `json:"disabled,omitempty"`
 	DefaultNamespace string `json:"defaultNamespace,omitempty"`
 }
 
@@ -56,6 +63,9 @@ var (
 	//go:embed manifests/managedclusterchart/templates/_helpers.tpl
 	FS embed.FS
 
+	// defaultImages returns the default images of the agent, from the chart or the environment variable
+	defaultImages = policyaddon.NewDefaultImagesFunc(FS, "manifests/managedclusterchart", imageKey, imageEnvVar)
+
 	log = ctrl.Log.WithName("configpolicy")
 
 	agentPermissionFiles = []string{
@@ -78,35 +88,40 @@ func getSkeletonValues() configPolicyUserValues {
 				},
 			},
 		},
-		OperatorPolicy: &operatorPolicy{
-			Disabled: false,
-		},
+		OperatorPolicy: &operatorPolicy{},
 	}
 }
 
 func (cpv *configPolicyUserValues) setOperatorPolicyDisabled(value string) error {
 	valBool, err := strconv.ParseBool(value)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to parse operator policy disabled boolean '%s' (falling back to the default value): %w",
+			value, err)
 	}
 
 	if cpv.OperatorPolicy != nil {
-		cpv.OperatorPolicy.Disabled = valBool
+		cpv.OperatorPolicy.Disabled = &valBool
 	} else {
-		cpv.OperatorPolicy = &operatorPolicy{Disabled: valBool}
+		cpv.OperatorPolicy = &operatorPolicy{Disabled: &valBool}
 	}
 
 	return nil
 }
 
-func getValuesFromAnnotations(
+func getSkeletonValuesFunc(
+	_ *clusterv1.ManagedCluster, _ *addonapiv1beta1.ManagedClusterAddOn,
+) (addonfactory.Values, error) {
+	return addonfactory.JsonStructToValues(getSkeletonValues())
+}
+
+func getClusterValues(
 	clusterClient clusterlistersv1.ManagedClusterLister,
 	addonClient addonlistersv1alpha1.ManagedClusterAddOnLister,
-) func(*clusterv1.ManagedCluster, *addonapiv1beta1.ManagedClusterAddOn) (addonfactory.Values, error) {
+) addonfactory.GetValuesFunc {
 	return func(
 		cluster *clusterv1.ManagedCluster, addon *addonapiv1beta1.ManagedClusterAddOn,
 	) (addonfactory.Values, error) {
-		userValues := getSkeletonValues()
+		userValues := configPolicyUserValues{}
 
 		err := userValues.SetCommonValues(cluster, addon, clusterClient)
 		if err != nil {
@@ -125,70 +140,137 @@ func getValuesFromAnnotations(
 
 		// Configure OperatorPolicy based on the cluster's OpenShift version
 		if cluster.Labels["openshiftVersion-major"] == "4" {
-			userValues.OperatorPolicy.DefaultNamespace = "openshift-operators"
+			userValues.OperatorPolicy = &operatorPolicy{DefaultNamespace: "openshift-operators"}
 		}
 
-		if err := userValues.SetCommonValuesFromAnnotations(addon); err != nil {
-			log.Error(err, "failed to set common values from annotations")
-		}
+		return addonfactory.JsonStructToValues(userValues)
+	}
+}
 
-		if val, ok := addon.GetAnnotations()[operatorPolicyDisabledAnnotation]; ok {
-			err := userValues.setOperatorPolicyDisabled(val)
-			if err != nil {
-				log.Error(err, fmt.Sprintf(
-					policyaddon.AnnotationParseErrorFmt,
-					operatorPolicyDisabledAnnotation, val, addonName, false),
-				)
-			}
-		}
+func getValuesFromAnnotations(
+	_ *clusterv1.ManagedCluster, addon *addonapiv1beta1.ManagedClusterAddOn,
+) (addonfactory.Values, error) {
+	userValues := configPolicyUserValues{}
 
-		return addonfactory.JsonStructToValues(userValues)
+	if err := userValues.setValuesFromAnnotations(addon); err != nil {
+		log.Error(err, "failed to set values from annotations")
 	}
+
+	return addonfactory.JsonStructToValues(userValues)
+}
+
+// setValuesFromAnnotations sets the values from the ManagedClusterAddOn
+// annotations. It returns an aggregated error of the rejected values.
+func (cpv *configPolicyUserValues) setValuesFromAnnotations(addon *addonapiv1beta1.ManagedClusterAddOn) error {
+	err := errors.Join(cpv.SetCommonValuesFromAnnotations(addon), cpv.SetReplicasFromAnnotation(addon))
+
+	if val, ok := addon.GetAnnotations()[operatorPolicyDisabledAnnotation]; ok {
+		if opErr := cpv.setOperatorPolicyDisabled(val); opErr != nil {
+			err = errors.Join(err, &policyaddon.InvalidValueError{
+				Source: policyaddon.AnnotationSource,
+				Key:    operatorPolicyDisabledAnnotation,
+				Err:    opErr,
+			})
+		}
+	}
+
+	return err
 }
 
 func getValuesFromCustomizedVariableValues(config addonapiv1beta1.AddOnDeploymentConfig) (addonfactory.Values, error) {
-	userValues := getSkeletonValues()
+	// Only the values set by the config are returned, so that they don't override the values of the layers below
+	userValues := configPolicyUserValues{}
 
-	userValuesMap, err := userValues.SetCommonValuesFromCustomizedVariables(config)
+	unknownValues, err := userValues.setValuesFromCustomizedVariables(config)
 	if err != nil {
-		log.Error(err, "error setting common addon values from customized variables")
+		log.Error(err, "error setting addon values from customized variables")
 	}
 
+	for key, value := range unknownValues {
+		log.Error(errors.New("unknown customized variable"),
+			"variable is not supported",
+			"variable", key,
+			"value", value)
+	}
+
+	return addonfactory.JsonStructToValues(userValues)
+}
+
+// setValuesFromCustomizedVariables sets the values from the customized variables
+// in the deployment config. It returns a map with any unknown variables and an
+// aggregated error of the rejected values.
+func (cpv *configPolicyUserValues) setValuesFromCustomizedVariables(
+	config addonapiv1beta1.AddOnDeploymentConfig,
+) (map[string]string, error) {
+	userValuesMap, aggregateErr := cpv.SetCommonValuesFromCustomizedVariables(config)
+	unknownValues := map[string]string{}
+
 	//nolint:unparam
 	variableToFuncMap := map[string]func(string) error{
-		"operatorPolicyDisabled": userValues.setOperatorPolicyDisabled,
+		"operatorPolicyDisabled": cpv.setOperatorPolicyDisabled,
+		"replicas":               cpv.SetReplicas,
 		"managedKubeConfigSecret": func(value string) error {
-			userValues.ManagedKubeConfigSecret = value
+			cpv.ManagedKubeConfigSecret = value
 
 			return nil
 		},
 	}
 
-	for key, value := range userValuesMap {
-		if fn, ok := variableToFuncMap[key]; ok {
-			err := fn(value)
-			if err != nil {
-				log.Error(err, "error setting customized variable", "variable", key, "value", value)
-			}
-		} else {
-			log.Error(errors.New("unknown customized variable"),
-				"variable is not supported",
-				"variable", key,
-				"value", value)
+	for _, key := range slices.Sorted(maps.Keys(userValuesMap)) {
+		fn, ok := variableToFuncMap[key]
+		if !ok {
+			unknownValues[key] = userValuesMap[key]
+
+			continue
+		}
+
+		if err := fn(userValuesMap[key]); err != nil {
+			aggregateErr = errors.Join(aggregateErr, &policyaddon.InvalidValueError{
+				Source: policyaddon.CustomizedVariableSource,
+				Key:    key,
+				Err:    err,
+			})
 		}
 	}
 
-	return addonfactory.JsonStructToValues(userValues)
+	images, err := defaultImages()
+	if err != nil {
+		return unknownValues, errors.Join(aggregateErr, err)
+	}
+
+	if err := cpv.SetImageFromDeploymentConfig(config, imageKey, images); err != nil {
+		aggregateErr = errors.Join(aggregateErr, err)
+	}
+
+	return unknownValues, aggregateErr
 }
 
-func GetAgentAddon(ctx context.Context, controllerContext *controllercmd.ControllerContext) (agent.AgentAddon, error) {
-	registrationOption := policyaddon.NewRegistrationOption(ctx,
-		controllerContext,
-		addonName,
-		agentPermissionFiles,
-		FS,
-		false)
+// ValidateConfiguration returns warnings for the unsupported annotations and
+// customized variables, and an aggregated error of the values rejected from the
+// ManagedClusterAddOn annotations and the deployment config.
+func ValidateConfiguration(
+	addon *addonapiv1beta1.ManagedClusterAddOn, config *addonapiv1beta1.AddOnDeploymentConfig,
+) ([]string, error) {
+	userValues := getSkeletonValues()
+	warnings := policyaddon.UnknownAnnotationWarnings(addon,
+		operatorPolicyDisabledAnnotation, policyaddon.ReplicasAnnotation)
 
+	err := userValues.setValuesFromAnnotations(addon)
+
+	if config != nil {
+		unknownValues, configErr := userValues.setValuesFromCustomizedVariables(*config)
+		warnings = append(warnings, policyaddon.UnknownVariableWarnings(addonName, unknownValues)...)
+		err = errors.Join(err, configErr, policyaddon.ValidateHostedInstallNamespace(*config, addon.Namespace))
+	}
+
+	return warnings, err
+}
+
+// GetAgentAddon returns the agent addon using new hub clients. The addons hosted
+// on a ManagedCluster are updated when the hosting cluster changes.
+func GetAgentAddon(
+	ctx context.Context, mgr addonmanager.AddonManager, controllerContext *controllercmd.ControllerContext,
+) (agent.AgentAddon, error) {
 	addonClient, err := addonv1alpha1client.NewForConfig(controllerContext.KubeConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve addon client: %w", err)
@@ -207,53 +289,100 @@ func GetAgentAddon(ctx context.Context, controllerContext *controllercmd.Control
 		Cluster().V1().ManagedClusters()
 	go clusterInformer.Informer().Run(ctx.Done())
 
-	return addonfactory.NewAgentAddonFactory(addonName, FS, "manifests/managedclusterchart").
+	err = policyaddon.TriggerOnHostingClusterChange(ctx, mgr, addonName, addonClient, clusterInformer.Informer())
+	if err != nil {
+		return nil, err
+	}
+
+	return BuildAgentAddon(ctx, controllerContext, policyaddon.AgentAddonClients{
+		AddonClient:   addonClient,
+		ClusterClient: clusterClient,
+		ClusterLister: clusterInformer.Lister(),
+		AddonLister:   addonInformer.Lister(),
+	})
+}
+
+// BuildAgentAddon builds the agent addon using the provided hub clients.
+func BuildAgentAddon(
+	ctx context.Context,
+	controllerContext *controllercmd.ControllerContext,
+	clients policyaddon.AgentAddonClients,
+) (agent.AgentAddon, error) {
+	registrationOption := policyaddon.NewRegistrationOption(ctx,
+		controllerContext,
+		addonName,
+		agentPermissionFiles,
+		FS,
+		false)
+
+	values := GetAddonValues(clients)
+
+	agentAddon, err := addonfactory.NewAgentAddonFactory(addonName, FS, "manifests/managedclusterchart").
 		WithConfigGVRs(utils.AddOnDeploymentConfigGVR).
-		WithGetValuesFuncs(
-			getValuesFromAnnotations(clusterInformer.Lister(), addonInformer.Lister()),
-			addonfactory.GetValuesFromAddonAnnotation,
-			addonfactory.GetAddOnDeploymentConfigValues(
-				utils.NewAddOnDeploymentConfigGetter(addonClient),
-				addonfactory.ToAddOnNodePlacementValues,
-				addonfactory.ToAddOnResourceRequirementsValues,
-				getValuesFromCustomizedVariableValues,
-			),
-			policyaddon.MandateValues,
-			mandateImageFromEnv,
-		).
-		WithManagedClusterClient(clusterClient).
+		WithGetValuesFuncs(values.GetValuesFuncs()...).
+		WithManagedClusterClient(clients.ClusterClient).
 		WithAgentRegistrationOption(registrationOption).
 		WithAgentInstallNamespace(
-			policyaddon.
-				CommonAgentInstallNamespaceFromDeploymentConfigFunc(utils.NewAddOnDeploymentConfigGetter(addonClient)),
+			policyaddon.CommonAgentInstallNamespaceFromDeploymentConfigFunc(ctx, addonName, clients.AddonClient),
 		).
 		WithScheme(policyaddon.Scheme).
 		WithAgentHostedModeEnabledOption().
+		WithAgentHealthProber(policyaddon.NewAgentHealthProber()).
 		BuildHelmAgentAddon()
+	if err != nil {
+		return nil, err
+	}
+
+	return &policyaddon.ValuesAgentAddon{AgentAddon: agentAddon, Values: values}, nil
+}
+
+// GetAddonValues returns the sources of the addon values using the provided hub
+// clients.
+func GetAddonValues(clients policyaddon.AgentAddonClients) *policyaddon.AddonValues {
+	return policyaddon.NewAddonValues().
+		Add(policyaddon.SkeletonLayer, "skeleton", getSkeletonValuesFunc).
+		Add(policyaddon.SkeletonLayer, "image-env", getImageValuesFromEnv).
+		Add(policyaddon.ClusterLayer, "cluster", getClusterValues(clients.ClusterLister, clients.AddonLister)).
+		AddDeploymentConfig("AddOnDeploymentConfig", addonfactory.GetAddOnDeploymentConfigValues(
+			utils.NewAddOnDeploymentConfigGetter(clients.AddonClient),
+			addonfactory.ToAddOnNodePlacementValues,
+			addonfactory.ToAddOnResourceRequirementsValues,
+			getValuesFromCustomizedVariableValues,
+		)).
+		Add(policyaddon.AnnotationLayer, "annotations", getValuesFromAnnotations).
+		Add(policyaddon.AnnotationLayer, "values-annotation", addonfactory.GetValuesFromAddonAnnotation).
+		Add(policyaddon.MandatedLayer, "uninstall", policyaddon.MandateValues)
 }
 
 func GetAndAddAgent(
 	ctx context.Context, mgr addonmanager.AddonManager, controllerContext *controllercmd.ControllerContext,
 ) error {
-	return policyaddon.GetAndAddAgent(ctx, mgr, addonName, controllerContext, GetAgentAddon)
+	err := policyaddon.GetAndAddAgent(ctx, mgr, addonName, controllerContext, GetAgentAddon, ValidateConfiguration)
+	if err != nil {
+		return err
+	}
+
+	return policyaddon.StartHubPermissionsCleanup(ctx, controllerContext, addonName, hubRoleBindingName)
 }
 
-// mandateImageFromEnv ensures that if the environment variable for the image is
-// set to a non-empty value, that value is used in the chart.
-func mandateImageFromEnv(
+// getImageValuesFromEnv sets the image from the environment variable, when it
+// is set to a non-empty value, as the default image of the fleet. The image
+// customized variable and the registry mirrors of a deployment config override
+// it for the clusters using that config.
+func getImageValuesFromEnv(
 	_ *clusterv1.ManagedCluster,
 	_ *addonapiv1beta1.ManagedClusterAddOn,
 ) (addonfactory.Values, error) {
 	values := addonfactory.Values{}
 
-	img := os.Getenv("CONFIG_POLICY_CONTROLLER_IMAGE")
+	img := os.Getenv(imageEnvVar)
 	if img == "" {
 		return values, nil
 	}
 
 	values["global"] = map[string]any{
 		"imageOverrides": map[string]any{
-			"config_policy_controller": img,
+			imageKey: img,
 		},
 	}
 
@@ -0,0 +1,557 @@
+package addon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"open-cluster-management.io/addon-framework/pkg/addonmanager"
+	"open-cluster-management.io/addon-framework/pkg/addonmanager/constants"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addoninformers "open-cluster-management.io/api/client/addon/informers/externalversions"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	clusterv1informers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	clusterlistersv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	workv1client "open-cluster-management.io/api/client/work/clientset/versioned"
+	workinformers "open-cluster-management.io/api/client/work/informers/externalversions"
+	worklistersv1 "open-cluster-management.io/api/client/work/listers/work/v1"
+	workv1 "open-cluster-management.io/api/work/v1"
+	workapplier "open-cluster-management.io/sdk-go/pkg/apis/work/v1/applier"
+	"open-cluster-management.io/sdk-go/pkg/basecontroller/factory"
+)
+
+const (
+	// CRDWorkLabel labels the ManifestWork with the CRDs of the addon agent with the addon name. The
+	// addon-framework label isn't used, since the framework deletes the labeled ManifestWorks it didn't build.
+	CRDWorkLabel = "policy.open-cluster-management.io/addon-crds"
+	// CRDWorkHashAnnotation is the hash of the CRDs in the CRD ManifestWork, to know whether the CRDs rendered for
+	// the agent ManifestWork are the ones it applied.
+	CRDWorkHashAnnotation = "policy.open-cluster-management.io/addon-crds-hash"
+
+	// ManifestsSizeLimit is the size of the manifests at which the addon-framework splits the ManifestWorks
+	// of an addon, and the maximum size of the manifests in the CRD ManifestWork.
+	ManifestsSizeLimit = 500 * 1024
+	// ManifestsSizeWarning is the size of the manifests reported as approaching the limit.
+	ManifestsSizeWarning = ManifestsSizeLimit * 8 / 10
+
+	// ManifestsSizeCondition is the ManagedClusterAddOn condition type reporting whether the manifests of the
+	// agent ManifestWorks are below the size warning.
+	ManifestsSizeCondition   = "ManifestsSize"
+	ManifestsSizeValidReason = "ManifestsWithinSizeLimit"
+	ManifestsSizeReason      = "ManifestsApproachingSizeLimit"
+	ManifestsTooLargeReason  = "ManifestsTooLarge"
+
+	crdWorksResyncInterval = 10 * time.Minute
+)
+
+// SeparateCRDWork is whether the CRDs of the addon agents are deployed in a
+// ManifestWork separate from the agent workload.
+var SeparateCRDWork = true
+
+// ErrManifestsTooLarge is returned when the manifests of the addon agent exceed
+// the size limit of their ManifestWork.
+var ErrManifestsTooLarge = errors.New("the manifests exceed the ManifestWork size limit")
+
+// CRDWorkName returns the name of the ManifestWork with the CRDs of the addon
+// agent.
+func CRDWorkName(addonName string) string {
+	return "addon-" + addonName + "-crds"
+}
+
+// crdWorks deploys the CRDs of the addon agents in a ManifestWork separate from
+// the agent workload, so that the large CRDs don't push the agent ManifestWork
+// toward the size limit. The CRDs are only removed from the agent ManifestWork
+// once the CRD ManifestWork has applied them, so that they're never deleted
+// when they move and are updated before the agent, and the CRD ManifestWork is
+// only deleted once the agent ManifestWorks are deleted or have applied the
+// CRDs again.
+type crdWorks struct {
+	addonName string
+	// agentAddon renders the manifests of the addon agent, from which the CRDs are taken.
+	agentAddon    agent.AgentAddon
+	pause         *pauseController
+	applier       *workapplier.WorkApplier
+	crdWorkLister worklistersv1.ManifestWorkLister
+	workLister    worklistersv1.ManifestWorkLister
+	addonLister   addonlistersv1beta1.ManagedClusterAddOnLister
+	clusterLister clusterlistersv1.ManagedClusterLister
+	queue         workqueue.TypedRateLimitingInterface[string]
+}
+
+// startCRDWorks starts the controller applying and deleting the CRD
+// ManifestWorks of the addon, by cluster namespace. The addon-framework is
+// triggered to move the CRDs out of the agent ManifestWork when the CRD
+// ManifestWork is applied. The informer factories must be started by the
+// caller.
+func startCRDWorks(
+	ctx context.Context,
+	mgr addonmanager.AddonManager,
+	addonName string,
+	agentAddon agent.AgentAddon,
+	pause *pauseController,
+	workClient workv1client.Interface,
+	clusterInformerFactory clusterv1informers.SharedInformerFactory,
+	addonInformerFactory addoninformers.SharedInformerFactory,
+	workInformerFactory workinformers.SharedInformerFactory,
+) (*crdWorks, error) {
+	// Only the CRD ManifestWorks of this addon are watched
+	crdWorkInformerFactory := workinformers.NewSharedInformerFactoryWithOptions(workClient, 10*time.Minute,
+		workinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = CRDWorkLabel + "=" + addonName
+		}),
+	)
+
+	crdWorkInformer := crdWorkInformerFactory.Work().V1().ManifestWorks()
+	workInformer := workInformerFactory.Work().V1().ManifestWorks()
+	addonInformer := addonInformerFactory.Addon().V1beta1().ManagedClusterAddOns()
+	clusterInformer := clusterInformerFactory.Cluster().V1().ManagedClusters()
+
+	syncCtx := factory.NewSyncContext(addonName + "-crd-works")
+
+	c := &crdWorks{
+		addonName:     addonName,
+		agentAddon:    agentAddon,
+		pause:         pause,
+		applier:       workapplier.NewWorkApplierWithTypedClient(workClient, crdWorkInformer.Lister()),
+		crdWorkLister: crdWorkInformer.Lister(),
+		workLister:    workInformer.Lister(),
+		addonLister:   addonInformer.Lister(),
+		clusterLister: clusterInformer.Lister(),
+		queue:         syncCtx.Queue(),
+	}
+
+	// The rendered CRDs are applied when the agent manifests are generated with CRDs that aren't applied yet, so
+	// the events only need to cover the CRD ManifestWork itself and its cleanup
+	handlers := []struct {
+		informer cache.SharedIndexInformer
+		changed  func(oldObj, newObj any) bool
+	}{
+		{crdWorkInformer.Informer(), func(oldObj, newObj any) bool {
+			if work, ok := newObj.(*workv1.ManifestWork); ok && workStatusChanged(oldObj, newObj) {
+				mgr.Trigger(work.Namespace, addonName)
+			}
+
+			return generationChanged(oldObj, newObj)
+		}},
+		{workInformer.Informer(), workStatusChanged},
+		{addonInformer.Informer(), func(oldObj, newObj any) bool {
+			oldAddon, oldOK := oldObj.(*addonapiv1beta1.ManagedClusterAddOn)
+			newAddon, newOK := newObj.(*addonapiv1beta1.ManagedClusterAddOn)
+
+			return !oldOK || !newOK || newAddon.DeletionTimestamp != nil ||
+				!equality.Semantic.DeepEqual(oldAddon.Annotations, newAddon.Annotations)
+		}},
+	}
+
+	for _, handler := range handlers {
+		_, err := handler.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj any) {
+				if handler.changed(oldObj, newObj) {
+					c.enqueue(newObj)
+				}
+			},
+			DeleteFunc: func(obj any) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+
+				if work, ok := obj.(*workv1.ManifestWork); ok && work.Name == CRDWorkName(addonName) {
+					// Move the CRDs back to the agent ManifestWork
+					mgr.Trigger(work.Namespace, addonName)
+				}
+
+				c.enqueue(obj)
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to add the CRD ManifestWork event handler: %w", err)
+		}
+	}
+
+	controller := factory.New().
+		WithSyncContext(syncCtx).
+		WithSync(c.sync).
+		WithBareInformers(
+			crdWorkInformer.Informer(), workInformer.Informer(), addonInformer.Informer(), clusterInformer.Informer(),
+		).
+		ResyncEvery(crdWorksResyncInterval).
+		ToController(addonName + "-crd-works")
+
+	crdWorkInformerFactory.Start(ctx.Done())
+
+	go controller.Run(ctx, 1)
+
+	return c, nil
+}
+
+func generationChanged(oldObj, newObj any) bool {
+	oldAccessor, err := meta.Accessor(oldObj)
+	if err != nil {
+		return true
+	}
+
+	newAccessor, err := meta.Accessor(newObj)
+	if err != nil {
+		return true
+	}
+
+	return oldAccessor.GetGeneration() != newAccessor.GetGeneration()
+}
+
+// enqueue adds the namespace of the object to the queue.
+func (c *crdWorks) enqueue(obj any) {
+	if accessor, err := meta.Accessor(obj); err == nil {
+		c.queue.Add(accessor.GetNamespace())
+	}
+}
+
+// separate returns the objects for the agent ManifestWorks, without the CRDs
+// once the CRD ManifestWork has applied the same CRDs. The controller is
+// queued to apply the CRDs otherwise.
+func (c *crdWorks) separate(
+	addon *addonapiv1beta1.ManagedClusterAddOn, objects []runtime.Object,
+) ([]runtime.Object, error) {
+	crds, others := SplitCRDs(objects)
+	if len(crds) == 0 {
+		return objects, nil
+	}
+
+	rendered, _, err := c.buildWork(addon.Namespace, crds)
+	if err != nil {
+		return nil, err
+	}
+
+	work, err := c.crdWorkLister.ManifestWorks(addon.Namespace).Get(rendered.Name)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	if err != nil || work.Annotations[CRDWorkHashAnnotation] != rendered.Annotations[CRDWorkHashAnnotation] ||
+		!workApplied(work) {
+		c.queue.Add(addon.Namespace)
+
+		return objects, nil
+	}
+
+	return others, nil
+}
+
+// buildWork returns the CRD ManifestWork with the CRDs, and the size of its
+// manifests.
+func (c *crdWorks) buildWork(namespace string, crds []runtime.Object) (*workv1.ManifestWork, int, error) {
+	work := &workv1.ManifestWork{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CRDWorkName(c.addonName),
+			Namespace: namespace,
+			Labels:    map[string]string{CRDWorkLabel: c.addonName},
+		},
+	}
+
+	hash := sha256.New()
+	size := 0
+
+	for _, crd := range crds {
+		raw, err := runtime.Encode(unstructured.UnstructuredJSONScheme, crd)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to encode a CRD of the addon: %w", err)
+		}
+
+		hash.Write(raw)
+		size += len(raw)
+
+		work.Spec.Workload.Manifests = append(work.Spec.Workload.Manifests,
+			workv1.Manifest{RawExtension: runtime.RawExtension{Raw: raw}})
+	}
+
+	work.Annotations = map[string]string{CRDWorkHashAnnotation: hex.EncodeToString(hash.Sum(nil))}
+
+	return work, size, nil
+}
+
+// SplitCRDs returns the CRDs in the objects, and the other objects.
+func SplitCRDs(objects []runtime.Object) (crds, others []runtime.Object) {
+	for _, obj := range objects {
+		if isCRD(obj) {
+			crds = append(crds, obj)
+		} else {
+			others = append(others, obj)
+		}
+	}
+
+	return crds, others
+}
+
+func isCRD(obj runtime.Object) bool {
+	switch o := obj.(type) {
+	case *apiextensionsv1.CustomResourceDefinition:
+		return true
+	case *unstructured.Unstructured:
+		return o.GroupVersionKind().GroupKind() == apiextensionsv1.Kind("CustomResourceDefinition")
+	default:
+		return false
+	}
+}
+
+// ManifestsSize returns the size of the objects encoded as ManifestWork
+// manifests.
+func ManifestsSize(objects []runtime.Object) (int, error) {
+	size := 0
+
+	for _, obj := range objects {
+		raw, err := runtime.Encode(unstructured.UnstructuredJSONScheme, obj)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode a manifest of the addon: %w", err)
+		}
+
+		size += len(raw)
+	}
+
+	return size, nil
+}
+
+func (c *crdWorks) sync(ctx context.Context, _ factory.SyncContext, key string) error {
+	if key == factory.DefaultQueueKey {
+		return c.enqueueAll()
+	}
+
+	addon, err := c.addonLister.ManagedClusterAddOns(key).Get(c.addonName)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	if err != nil {
+		addon = nil
+	}
+
+	// The ManifestWorks of a paused addon are left unchanged
+	if addon != nil && c.pause != nil {
+		state, err := c.pause.pauseState(addon)
+		if err != nil {
+			return err
+		}
+
+		if state.Paused {
+			return nil
+		}
+	}
+
+	removed := addon == nil || addon.DeletionTimestamp != nil
+
+	if !removed && SeparateCRDWork && addon.Annotations[addonapiv1beta1.HostingClusterNameAnnotationKey] == "" {
+		return c.apply(ctx, addon)
+	}
+
+	work, err := c.crdWorkLister.ManifestWorks(key).Get(CRDWorkName(c.addonName))
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if work.DeletionTimestamp != nil {
+		return nil
+	}
+
+	unused, err := c.unused(work, addon)
+	if err != nil || !unused {
+		return err
+	}
+
+	log.Info("Deleting the unused CRD ManifestWork", "addon", c.addonName,
+		"namespace", work.Namespace, "name", work.Name)
+
+	return c.applier.Delete(ctx, work.Namespace, work.Name)
+}
+
+// enqueueAll adds the namespaces of every ManagedClusterAddOn and CRD
+// ManifestWork of the addon to the queue.
+func (c *crdWorks) enqueueAll() error {
+	addons, err := c.addonLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list the ManagedClusterAddOns: %w", err)
+	}
+
+	for _, addon := range addons {
+		c.queue.Add(addon.Namespace)
+	}
+
+	works, err := c.crdWorkLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list the CRD ManifestWorks: %w", err)
+	}
+
+	for _, work := range works {
+		c.queue.Add(work.Namespace)
+	}
+
+	return nil
+}
+
+// apply applies the CRD ManifestWork with the CRDs rendered for the addon.
+func (c *crdWorks) apply(ctx context.Context, addon *addonapiv1beta1.ManagedClusterAddOn) error {
+	cluster, err := c.clusterLister.Get(addon.Namespace)
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	objects, err := c.agentAddon.Manifests(ctx, cluster, addon)
+	if err != nil {
+		return fmt.Errorf("failed to render the CRDs of the addon: %w", err)
+	}
+
+	crds, _ := SplitCRDs(objects)
+	if len(crds) == 0 {
+		return nil
+	}
+
+	work, size, err := c.buildWork(addon.Namespace, crds)
+	if err != nil {
+		return err
+	}
+
+	// The CRD ManifestWork isn't split like the agent ManifestWorks
+	if size > ManifestsSizeLimit {
+		return fmt.Errorf("%w: the CRDs of the %s addon are %d bytes, the limit is %d bytes",
+			ErrManifestsTooLarge, c.addonName, size, ManifestsSizeLimit)
+	}
+
+	if _, err := c.applier.Apply(ctx, work); err != nil {
+		return fmt.Errorf("failed to apply the ManifestWork %s/%s: %w", work.Namespace, work.Name, err)
+	}
+
+	return nil
+}
+
+// unused returns whether the CRD ManifestWork is no longer used, because the
+// addon was removed, is hosted, or the CRDs are deployed in the agent
+// ManifestWork again. It must then wait for the agent ManifestWorks to be
+// deleted, or to be applied. When the CRDs are deployed in the agent
+// ManifestWork again, it must also have every CRD of the CRD ManifestWork.
+func (c *crdWorks) unused(work *workv1.ManifestWork, addon *addonapiv1beta1.ManagedClusterAddOn) (bool, error) {
+	removed := addon == nil || addon.DeletionTimestamp != nil
+	// The CRDs of hosted addons are deployed on the hosting cluster instead
+	hosted := !removed && addon.Annotations[addonapiv1beta1.HostingClusterNameAnnotationKey] != ""
+
+	deployWorks, err := c.workLister.ManifestWorks(work.Namespace).List(labels.Everything())
+	if err != nil {
+		return false, err
+	}
+
+	crdNames := manifestCRDNames(work)
+
+	for _, deployWork := range deployWorks {
+		if !strings.HasPrefix(deployWork.Name, constants.DeployWorkNamePrefix(c.addonName)) {
+			continue
+		}
+
+		if removed || !workApplied(deployWork) {
+			return false, nil
+		}
+
+		crdNames = crdNames.Difference(manifestCRDNames(deployWork))
+	}
+
+	return removed || hosted || crdNames.Len() == 0, nil
+}
+
+// manifestCRDNames returns the names of the CRDs in the manifests of the
+// ManifestWork.
+func manifestCRDNames(work *workv1.ManifestWork) sets.Set[string] {
+	names := sets.New[string]()
+
+	for _, manifest := range work.Spec.Workload.Manifests {
+		obj := metav1.PartialObjectMetadata{}
+		if err := json.Unmarshal(manifest.Raw, &obj); err != nil {
+			continue
+		}
+
+		if obj.GroupVersionKind().GroupKind() == apiextensionsv1.Kind("CustomResourceDefinition") {
+			names.Insert(obj.Name)
+		}
+	}
+
+	return names
+}
+
+// checkManifestsSize sets the ManifestsSize condition of the ManagedClusterAddOn
+// from the size of the manifests of the agent ManifestWorks, and returns an
+// error when they exceed the size limit, rather than letting the
+// addon-framework split them. The manifests approaching the limit are only
+// reported when the condition changes, since the manifests are regenerated
+// several times per sync.
+func checkManifestsSize(
+	recorder record.EventRecorder, addon *addonapiv1beta1.ManagedClusterAddOn, objects []runtime.Object,
+) error {
+	size, err := ManifestsSize(objects)
+	if err != nil {
+		return err
+	}
+
+	condition := metav1.Condition{
+		Type:    ManifestsSizeCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  ManifestsSizeValidReason,
+		Message: fmt.Sprintf("The manifests of the addon are %d bytes", size),
+	}
+
+	var sizeErr error
+
+	switch {
+	case size > ManifestsSizeLimit:
+		sizeErr = fmt.Errorf("%w: the manifests of the %s addon are %d bytes, the limit is %d bytes",
+			ErrManifestsTooLarge, addon.Name, size, ManifestsSizeLimit)
+
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = ManifestsTooLargeReason
+		condition.Message = sizeErr.Error()
+	case size > ManifestsSizeWarning:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = ManifestsSizeReason
+		condition.Message = fmt.Sprintf("The manifests of the addon are %d bytes, which approaches the "+
+			"ManifestWork size limit of %d bytes", size, ManifestsSizeLimit)
+	}
+
+	var existingReason string
+	if existing := meta.FindStatusCondition(addon.Status.Conditions, ManifestsSizeCondition); existing != nil {
+		existingReason = existing.Reason
+	}
+
+	// The addon-framework patches the status of this ManagedClusterAddOn copy, even when the manifests fail
+	meta.SetStatusCondition(&addon.Status.Conditions, condition)
+
+	if condition.Status == metav1.ConditionFalse && existingReason != condition.Reason {
+		log.Info(condition.Message, "namespace", addon.Namespace, "name", addon.Name)
+		oversizedManifests.WithLabelValues(addon.Name).Inc()
+
+		if recorder != nil {
+			recorder.Event(addon, corev1.EventTypeWarning, condition.Reason, condition.Message)
+		}
+	}
+
+	return sizeErr
+}
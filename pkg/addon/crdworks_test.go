@@ -0,0 +1,319 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	clusterlistersv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	workfake "open-cluster-management.io/api/client/work/clientset/versioned/fake"
+	worklistersv1 "open-cluster-management.io/api/client/work/listers/work/v1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+	workv1 "open-cluster-management.io/api/work/v1"
+	workapplier "open-cluster-management.io/sdk-go/pkg/apis/work/v1/applier"
+)
+
+// fakeAgentAddon renders fixed objects.
+type fakeAgentAddon struct {
+	objects []runtime.Object
+}
+
+func (f *fakeAgentAddon) Manifests(
+	_ context.Context, _ *clusterv1.ManagedCluster, _ *addonapiv1beta1.ManagedClusterAddOn,
+) ([]runtime.Object, error) {
+	return f.objects, nil
+}
+
+func (f *fakeAgentAddon) GetAgentAddonOptions() agent.AgentAddonOptions {
+	return agent.AgentAddonOptions{}
+}
+
+func testCRDObjects() []runtime.Object {
+	return []runtime.Object{
+		&apiextensionsv1.CustomResourceDefinition{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apiextensions.k8s.io/v1", Kind: "CustomResourceDefinition"},
+			ObjectMeta: metav1.ObjectMeta{Name: "configurationpolicies.policy.open-cluster-management.io"},
+		},
+		&corev1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "open-cluster-management-agent-addon"},
+		},
+	}
+}
+
+func TestCRDWorksSeparate(t *testing.T) {
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Namespace: "cluster1"},
+	}
+
+	c := &crdWorks{addonName: "config-policy-controller"}
+
+	crds, _ := SplitCRDs(testCRDObjects())
+
+	rendered, _, err := c.buildWork("cluster1", crds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crdWork := func(hash string, generation, observedGeneration int64) *workv1.ManifestWork {
+		work := rendered.DeepCopy()
+		work.Generation = generation
+		work.Annotations[CRDWorkHashAnnotation] = hash
+		work.Status.Conditions = []metav1.Condition{{
+			Type: workv1.WorkApplied, Status: metav1.ConditionTrue, ObservedGeneration: observedGeneration,
+		}}
+
+		return work
+	}
+
+	tests := map[string]struct {
+		existing        *workv1.ManifestWork
+		expectedObjects int
+	}{
+		"the CRDs stay in the agent ManifestWork until applied": {expectedObjects: 2},
+		"the applied CRDs are removed from the agent ManifestWork": {
+			existing:        crdWork(rendered.Annotations[CRDWorkHashAnnotation], 2, 2),
+			expectedObjects: 1,
+		},
+		"the CRDs stay in the agent ManifestWork until the update is applied": {
+			existing:        crdWork(rendered.Annotations[CRDWorkHashAnnotation], 2, 1),
+			expectedObjects: 2,
+		},
+		"the changed CRDs stay in the agent ManifestWork": {
+			existing:        crdWork("previous", 1, 1),
+			expectedObjects: 2,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+			if test.existing != nil {
+				if err := indexer.Add(test.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := &crdWorks{
+				addonName:     "config-policy-controller",
+				crdWorkLister: worklistersv1.NewManifestWorkLister(indexer),
+				queue: workqueue.NewTypedRateLimitingQueue(
+					workqueue.DefaultTypedControllerRateLimiter[string]()),
+			}
+
+			separated, err := c.separate(addon, testCRDObjects())
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+
+			if len(separated) != test.expectedObjects {
+				t.Fatalf("expected %d objects for the agent ManifestWork, got: %v", test.expectedObjects, separated)
+			}
+
+			// The controller is queued to apply the CRDs when they're kept in the agent ManifestWork
+			if queued := c.queue.Len() == 1; queued != (test.expectedObjects == 2) {
+				t.Fatalf("expected the cluster to be queued: %v, got: %v", test.expectedObjects == 2, queued)
+			}
+		})
+	}
+}
+
+func TestCRDWorksApply(t *testing.T) {
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Namespace: "cluster1"},
+	}
+
+	cluster := &clusterv1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster1"}}
+
+	clusterIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := clusterIndexer.Add(cluster); err != nil {
+		t.Fatal(err)
+	}
+
+	client := workfake.NewSimpleClientset()
+	lister := worklistersv1.NewManifestWorkLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+
+	c := &crdWorks{
+		addonName:     "config-policy-controller",
+		agentAddon:    &fakeAgentAddon{objects: testCRDObjects()},
+		applier:       workapplier.NewWorkApplierWithTypedClient(client, lister),
+		crdWorkLister: lister,
+		clusterLister: clusterlistersv1.NewManagedClusterLister(clusterIndexer),
+	}
+
+	if err := c.apply(context.TODO(), addon); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	work, err := client.WorkV1().ManifestWorks("cluster1").Get(context.TODO(),
+		CRDWorkName("config-policy-controller"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if work.Labels[CRDWorkLabel] != "config-policy-controller" || work.Annotations[CRDWorkHashAnnotation] == "" ||
+		len(work.Spec.Workload.Manifests) != 1 {
+		t.Fatalf("expected the CRD ManifestWork to contain the CRD, got: %v", work)
+	}
+}
+
+func TestCRDWorksUnused(t *testing.T) {
+	crdManifest := workv1.Manifest{RawExtension: runtime.RawExtension{Raw: []byte(
+		`{"apiVersion":"apiextensions.k8s.io/v1","kind":"CustomResourceDefinition",` +
+			`"metadata":{"name":"configurationpolicies.policy.open-cluster-management.io"}}`,
+	)}}
+
+	deployWork := func(applied bool, manifests ...workv1.Manifest) *workv1.ManifestWork {
+		work := &workv1.ManifestWork{
+			ObjectMeta: metav1.ObjectMeta{Name: "addon-config-policy-controller-deploy-0", Namespace: "cluster1"},
+		}
+
+		work.Spec.Workload.Manifests = manifests
+
+		if applied {
+			work.Status.Conditions = []metav1.Condition{{Type: workv1.WorkApplied, Status: metav1.ConditionTrue}}
+		}
+
+		return work
+	}
+
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Namespace: "cluster1"},
+	}
+
+	hostedAddon := addon.DeepCopy()
+	hostedAddon.Annotations = map[string]string{addonapiv1beta1.HostingClusterNameAnnotationKey: "hosting"}
+
+	tests := map[string]struct {
+		addon          *addonapiv1beta1.ManagedClusterAddOn
+		deployWork     *workv1.ManifestWork
+		expectedUnused bool
+	}{
+		"the CRDs aren't in the agent ManifestWork yet": {
+			addon:      addon,
+			deployWork: deployWork(true),
+		},
+		"the agent ManifestWork with the CRDs isn't applied": {
+			addon:      addon,
+			deployWork: deployWork(false, crdManifest),
+		},
+		"the agent ManifestWork with the CRDs is applied": {
+			addon:          addon,
+			deployWork:     deployWork(true, crdManifest),
+			expectedUnused: true,
+		},
+		"the removed addon still has its agent ManifestWork": {
+			deployWork: deployWork(true, crdManifest),
+		},
+		"the removed addon has no agent ManifestWork": {
+			expectedUnused: true,
+		},
+		"the hosted addon agent ManifestWork isn't applied": {
+			addon:      hostedAddon,
+			deployWork: deployWork(false),
+		},
+		"the hosted addon agent ManifestWork is applied": {
+			addon:          hostedAddon,
+			deployWork:     deployWork(true),
+			expectedUnused: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			workIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+			if test.deployWork != nil {
+				if err := workIndexer.Add(test.deployWork); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := &crdWorks{
+				addonName:  "config-policy-controller",
+				workLister: worklistersv1.NewManifestWorkLister(workIndexer),
+			}
+
+			unused, err := c.unused(&workv1.ManifestWork{
+				ObjectMeta: metav1.ObjectMeta{Name: CRDWorkName("config-policy-controller"), Namespace: "cluster1"},
+				Spec: workv1.ManifestWorkSpec{
+					Workload: workv1.ManifestsTemplate{Manifests: []workv1.Manifest{crdManifest}},
+				},
+			}, test.addon)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+
+			if unused != test.expectedUnused {
+				t.Fatalf("expected the CRD ManifestWork to be unused: %v, got: %v", test.expectedUnused, unused)
+			}
+		})
+	}
+}
+
+func TestCheckManifestsSize(t *testing.T) {
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Namespace: "cluster1"},
+	}
+
+	configMap := func(size int) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "open-cluster-management-agent-addon"},
+			Data:       map[string]string{"data": strings.Repeat("a", size)},
+		}
+	}
+
+	recorder := record.NewFakeRecorder(2)
+
+	if err := checkManifestsSize(recorder, addon, []runtime.Object{configMap(1024)}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if len(recorder.Events) != 0 {
+		t.Fatalf("expected no event for small manifests, got: %s", <-recorder.Events)
+	}
+
+	if !meta.IsStatusConditionTrue(addon.Status.Conditions, ManifestsSizeCondition) {
+		t.Fatalf("expected the %s condition to be true, got: %v", ManifestsSizeCondition, addon.Status.Conditions)
+	}
+
+	// The large manifests are only reported once
+	for range 2 {
+		if err := checkManifestsSize(recorder, addon, []runtime.Object{configMap(ManifestsSizeWarning)}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Warning "+ManifestsSizeReason) {
+		t.Fatalf("expected a warning event for large manifests, got: %s", event)
+	}
+
+	if len(recorder.Events) != 0 {
+		t.Fatalf("expected a single event for large manifests, got: %s", <-recorder.Events)
+	}
+
+	err := checkManifestsSize(recorder, addon, []runtime.Object{configMap(ManifestsSizeLimit)})
+	if !errors.Is(err, ErrManifestsTooLarge) {
+		t.Fatalf("expected the manifests to be too large, got: %v", err)
+	}
+
+	condition := meta.FindStatusCondition(addon.Status.Conditions, ManifestsSizeCondition)
+	if condition == nil || condition.Reason != ManifestsTooLargeReason {
+		t.Fatalf("expected the %s reason, got: %v", ManifestsTooLargeReason, condition)
+	}
+}
@@ -0,0 +1,210 @@
+package addon
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/record"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	"open-cluster-management.io/addon-framework/pkg/utils"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+const (
+	// CSRApprovalPolicyAnnotation is the ClusterManagementAddOn annotation selecting the policy to approve the
+	// CSRs of the addon agents.
+	CSRApprovalPolicyAnnotation = "policy-addon-csr-approval-policy"
+	// CSRApprovalClusterSelectorAnnotation is the ClusterManagementAddOn annotation with the label selector the
+	// ManagedCluster must match for the CSRs of its addon agent to be approved.
+	CSRApprovalClusterSelectorAnnotation = "policy-addon-csr-approval-cluster-selector"
+
+	// DefaultCSRApprovalPolicy approves any well-formed CSR of the addon agent.
+	DefaultCSRApprovalPolicy = "Default"
+	// StrictCSRApprovalPolicy additionally requires the ManagedCluster to be accepted, and the CSR to request
+	// exactly the default groups of the addon agent.
+	StrictCSRApprovalPolicy = "Strict"
+
+	CSRApprovedReason = "CSRApproved"
+	CSRDeniedReason   = "CSRDenied"
+)
+
+// CSRApprovalCheck returns an error with the reason to deny the CSR of the
+// addon agent, or nil when the check passes.
+type CSRApprovalCheck func(
+	cluster *clusterv1.ManagedCluster,
+	addon *addonapiv1beta1.ManagedClusterAddOn,
+	csr *certificatesv1.CertificateSigningRequest,
+) error
+
+// ClusterAcceptedCheck denies the CSRs of the ManagedClusters which aren't
+// accepted by the hub.
+func ClusterAcceptedCheck(
+	cluster *clusterv1.ManagedCluster, _ *addonapiv1beta1.ManagedClusterAddOn, _ *certificatesv1.CertificateSigningRequest,
+) error {
+	if !cluster.Spec.HubAcceptsClient ||
+		!meta.IsStatusConditionTrue(cluster.Status.Conditions, clusterv1.ManagedClusterConditionHubAccepted) {
+		return fmt.Errorf("the ManagedCluster %s is not accepted", cluster.Name)
+	}
+
+	return nil
+}
+
+// ClusterSelectorCheck denies the CSRs of the ManagedClusters which don't match
+// the label selector.
+func ClusterSelectorCheck(selector labels.Selector) CSRApprovalCheck {
+	return func(
+		cluster *clusterv1.ManagedCluster,
+		_ *addonapiv1beta1.ManagedClusterAddOn,
+		_ *certificatesv1.CertificateSigningRequest,
+	) error {
+		if !selector.Matches(labels.Set(cluster.Labels)) {
+			return fmt.Errorf("the ManagedCluster %s does not match the selector %s", cluster.Name, selector)
+		}
+
+		return nil
+	}
+}
+
+// DefaultGroupsCheck denies the CSRs requesting other groups than the default
+// groups of the addon agent.
+func DefaultGroupsCheck(
+	cluster *clusterv1.ManagedCluster,
+	addon *addonapiv1beta1.ManagedClusterAddOn,
+	csr *certificatesv1.CertificateSigningRequest,
+) error {
+	block, _ := pem.Decode(csr.Spec.Request)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return errors.New("the CSR does not contain a certificate request")
+	}
+
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("the certificate request of the CSR is invalid: %w", err)
+	}
+
+	requested := slices.Sorted(slices.Values(request.Subject.Organization))
+	expected := slices.Sorted(slices.Values(agent.DefaultGroups(cluster.Name, addon.Name)))
+
+	if !slices.Equal(slices.Compact(requested), expected) {
+		return fmt.Errorf("the CSR requests the groups %v instead of %v", requested, expected)
+	}
+
+	return nil
+}
+
+// GetCSRApprovalChecks returns the checks configured by the annotations of the
+// ClusterManagementAddOn, in addition to the default CSR approval. A nil
+// ClusterManagementAddOn uses the default policy.
+func GetCSRApprovalChecks(cma *addonapiv1beta1.ClusterManagementAddOn) ([]CSRApprovalCheck, error) {
+	var annotations map[string]string
+	if cma != nil {
+		annotations = cma.Annotations
+	}
+
+	checks := []CSRApprovalCheck{}
+
+	switch policy := annotations[CSRApprovalPolicyAnnotation]; policy {
+	case "", DefaultCSRApprovalPolicy:
+	case StrictCSRApprovalPolicy:
+		checks = append(checks, ClusterAcceptedCheck, DefaultGroupsCheck)
+	default:
+		return nil, fmt.Errorf("the %s annotation has an invalid value %q, expected %s or %s",
+			CSRApprovalPolicyAnnotation, policy, DefaultCSRApprovalPolicy, StrictCSRApprovalPolicy)
+	}
+
+	if annotations[CSRApprovalClusterSelectorAnnotation] != "" {
+		selector, err := labels.Parse(annotations[CSRApprovalClusterSelectorAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("the %s annotation is invalid: %w", CSRApprovalClusterSelectorAnnotation, err)
+		}
+
+		checks = append(checks, ClusterSelectorCheck(selector))
+	}
+
+	return checks, nil
+}
+
+// NewCSRApprover returns the CSR approval function of the addon. The CSRs
+// passing the default approval are also checked with the policy configured on
+// the ClusterManagementAddOn. Every decision is logged and recorded as an event
+// on the ManagedClusterAddOn when the recorder is set.
+func NewCSRApprover(
+	addonName string, cmaLister addonlistersv1beta1.ClusterManagementAddOnLister, recorder record.EventRecorder,
+) agent.CSRApproveFunc {
+	defaultApprover := utils.DefaultCSRApprover(addonName)
+
+	return func(
+		ctx context.Context,
+		cluster *clusterv1.ManagedCluster,
+		addon *addonapiv1beta1.ManagedClusterAddOn,
+		csr *certificatesv1.CertificateSigningRequest,
+	) bool {
+		err := checkCSR(ctx, addonName, cmaLister, defaultApprover, cluster, addon, csr)
+		if err != nil {
+			log.Info("Denied the CSR of the addon agent",
+				"addon", addonName, "cluster", cluster.Name, "csr", csr.Name, "reason", err.Error())
+
+			if recorder != nil {
+				recorder.Eventf(addon, corev1.EventTypeWarning, CSRDeniedReason,
+					"Denied the CSR %s: %v", csr.Name, err)
+			}
+
+			return false
+		}
+
+		log.Info("Approved the CSR of the addon agent", "addon", addonName, "cluster", cluster.Name, "csr", csr.Name)
+
+		if recorder != nil {
+			recorder.Eventf(addon, corev1.EventTypeNormal, CSRApprovedReason, "Approved the CSR %s", csr.Name)
+		}
+
+		return true
+	}
+}
+
+func checkCSR(
+	ctx context.Context,
+	addonName string,
+	cmaLister addonlistersv1beta1.ClusterManagementAddOnLister,
+	defaultApprover agent.CSRApproveFunc,
+	cluster *clusterv1.ManagedCluster,
+	addon *addonapiv1beta1.ManagedClusterAddOn,
+	csr *certificatesv1.CertificateSigningRequest,
+) error {
+	if !defaultApprover(ctx, cluster, addon, csr) {
+		return errors.New("the CSR is not a valid request of the addon agent")
+	}
+
+	cma, err := cmaLister.Get(addonName)
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get the ClusterManagementAddOn %s: %w", addonName, err)
+		}
+
+		cma = nil
+	}
+
+	checks, err := GetCSRApprovalChecks(cma)
+	if err != nil {
+		return err
+	}
+
+	for _, check := range checks {
+		if err := check(cluster, addon, csr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	certificatesv1 "k8s.io/api/certificates/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+func newTestCSR(t *testing.T, groups []string) *certificatesv1.CertificateSigningRequest {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   agent.DefaultUser("cluster1", "config-policy-controller", "config-policy-controller"),
+			Organization: groups,
+		},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &certificatesv1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "addon-cluster1-config-policy-controller"},
+		Spec: certificatesv1.CertificateSigningRequestSpec{
+			Request:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: request}),
+			Username: "system:open-cluster-management:cluster1:agent",
+		},
+	}
+}
+
+func TestCSRApprover(t *testing.T) {
+	defaultGroups := agent.DefaultGroups("cluster1", "config-policy-controller")
+	legacyGroups := append([]string{"system:authenticated"}, defaultGroups...)
+
+	acceptedCluster := &clusterv1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster1", Labels: map[string]string{"env": "prod"}},
+		Spec:       clusterv1.ManagedClusterSpec{HubAcceptsClient: true},
+		Status: clusterv1.ManagedClusterStatus{
+			Conditions: []metav1.Condition{{
+				Type: clusterv1.ManagedClusterConditionHubAccepted, Status: metav1.ConditionTrue,
+			}},
+		},
+	}
+
+	unacceptedCluster := acceptedCluster.DeepCopy()
+	unacceptedCluster.Spec.HubAcceptsClient = false
+
+	cma := func(annotations map[string]string) []runtime.Object {
+		return []runtime.Object{&addonapiv1beta1.ClusterManagementAddOn{
+			ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Annotations: annotations},
+		}}
+	}
+
+	tests := map[string]struct {
+		objects        []runtime.Object
+		cluster        *clusterv1.ManagedCluster
+		groups         []string
+		expectedReason string
+	}{
+		"no ClusterManagementAddOn": {
+			cluster: unacceptedCluster,
+			groups:  legacyGroups,
+		},
+		"default policy": {
+			objects: cma(map[string]string{CSRApprovalPolicyAnnotation: DefaultCSRApprovalPolicy}),
+			cluster: unacceptedCluster,
+			groups:  legacyGroups,
+		},
+		"invalid request": {
+			cluster:        acceptedCluster,
+			groups:         defaultGroups[:1],
+			expectedReason: "the CSR is not a valid request of the addon agent",
+		},
+		"strict policy": {
+			objects: cma(map[string]string{CSRApprovalPolicyAnnotation: StrictCSRApprovalPolicy}),
+			cluster: acceptedCluster,
+			groups:  defaultGroups,
+		},
+		"strict policy with a cluster not accepted": {
+			objects:        cma(map[string]string{CSRApprovalPolicyAnnotation: StrictCSRApprovalPolicy}),
+			cluster:        unacceptedCluster,
+			groups:         defaultGroups,
+			expectedReason: "the ManagedCluster cluster1 is not accepted",
+		},
+		"strict policy with other groups": {
+			objects:        cma(map[string]string{CSRApprovalPolicyAnnotation: StrictCSRApprovalPolicy}),
+			cluster:        acceptedCluster,
+			groups:         legacyGroups,
+			expectedReason: "the CSR requests the groups",
+		},
+		"matching cluster selector": {
+			objects: cma(map[string]string{CSRApprovalClusterSelectorAnnotation: "env in (prod,stage)"}),
+			cluster: acceptedCluster,
+			groups:  defaultGroups,
+		},
+		"cluster selector not matching": {
+			objects:        cma(map[string]string{CSRApprovalClusterSelectorAnnotation: "env=dev"}),
+			cluster:        acceptedCluster,
+			groups:         defaultGroups,
+			expectedReason: "the ManagedCluster cluster1 does not match the selector env=dev",
+		},
+		"invalid policy": {
+			objects:        cma(map[string]string{CSRApprovalPolicyAnnotation: "Lax"}),
+			cluster:        acceptedCluster,
+			groups:         defaultGroups,
+			expectedReason: `the policy-addon-csr-approval-policy annotation has an invalid value "Lax"`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cmaIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			for _, obj := range test.objects {
+				if err := cmaIndexer.Add(obj); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			recorder := record.NewFakeRecorder(1)
+			approver := NewCSRApprover("config-policy-controller",
+				addonlistersv1beta1.NewClusterManagementAddOnLister(cmaIndexer), recorder)
+
+			addon := &addonapiv1beta1.ManagedClusterAddOn{
+				ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Namespace: "cluster1"},
+			}
+
+			approved := approver(context.TODO(), test.cluster, addon, newTestCSR(t, test.groups))
+			event := <-recorder.Events
+
+			if test.expectedReason == "" {
+				if !approved || !strings.HasPrefix(event, "Normal "+CSRApprovedReason) {
+					t.Fatalf("expected the CSR to be approved, got approved: %v, event: %s", approved, event)
+				}
+
+				return
+			}
+
+			if approved {
+				t.Fatal("expected the CSR to be denied")
+			}
+
+			if !strings.HasPrefix(event, "Warning "+CSRDeniedReason) || !strings.Contains(event, test.expectedReason) {
+				t.Fatalf("expected a denial event with the reason %q, got: %s", test.expectedReason, event)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package gatekeepersync
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/openshift/library-go/pkg/controller/controllercmd"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"open-cluster-management.io/addon-framework/pkg/addonfactory"
+	"open-cluster-management.io/addon-framework/pkg/addonmanager"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	"open-cluster-management.io/addon-framework/pkg/utils"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonv1alpha1client "open-cluster-management.io/api/client/addon/clientset/versioned"
+	clusterv1client "open-cluster-management.io/api/client/cluster/clientset/versioned"
+	clusterv1informers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	clusterlistersv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	policyaddon "open-cluster-management.io/governance-policy-addon-controller/pkg/addon"
+)
+
+const (
+	addonName          = "governance-policy-gatekeeper-sync"
+	frameworkAddonName = "governance-policy-framework"
+	imageEnvVar        = "GOVERNANCE_POLICY_FRAMEWORK_ADDON_IMAGE"
+	imageKey           = "governance_policy_framework_addon"
+	// hubRoleBindingName is the name of the RoleBinding granting the agent access in its cluster namespace
+	hubRoleBindingName = "open-cluster-management:gatekeeper-sync-hub"
+)
+
+type gatekeeperSyncUserValues struct {
+	policyaddon.CommonValues `json:",inline"`
+}
+
+var (
+	// FS go:embed
+	//
+	//go:embed manifests
+	//go:embed manifests/managedclusterchart
+	//go:embed manifests/managedclusterchart/templates/_helpers.tpl
+	FS embed.FS
+
+	// defaultImages returns the default images of the agent, from the chart or the environment variable
+	defaultImages = policyaddon.NewDefaultImagesFunc(FS, "manifests/managedclusterchart", imageKey, imageEnvVar)
+
+	log = ctrl.Log.WithName("gatekeepersync")
+
+	agentPermissionFiles = []string{
+		// role with RBAC rules to access resources on hub
+		"manifests/hubpermissions/role.yaml",
+		// rolebinding to bind the above role to a certain user group
+		"manifests/hubpermissions/rolebinding.yaml",
+	}
+)
+
+func getSkeletonValues() gatekeeperSyncUserValues {
+	return gatekeeperSyncUserValues{
+		CommonValues: policyaddon.CommonValues{
+			BaseValues: policyaddon.BaseValues{
+				GlobalValues: &policyaddon.GlobalValues{
+					ImagePullPolicy: corev1.PullIfNotPresent,
+					NetworkPolicies: &policyaddon.NetworkPolicies{
+						Enabled: policyaddon.GetNetworkPoliciesEnabled(),
+					},
+				},
+			},
+		},
+	}
+}
+
+func getSkeletonValuesFunc(
+	_ *clusterv1.ManagedCluster, _ *addonapiv1beta1.ManagedClusterAddOn,
+) (addonfactory.Values, error) {
+	return addonfactory.JsonStructToValues(getSkeletonValues())
+}
+
+func getClusterValues(clusterClient clusterlistersv1.ManagedClusterLister) addonfactory.GetValuesFunc {
+	return func(
+		cluster *clusterv1.ManagedCluster, addon *addonapiv1beta1.ManagedClusterAddOn,
+	) (addonfactory.Values, error) {
+		userValues := gatekeeperSyncUserValues{}
+
+		err := userValues.SetCommonValues(cluster, addon, clusterClient)
+		if err != nil {
+			return nil, err
+		}
+
+		return addonfactory.JsonStructToValues(userValues)
+	}
+}
+
+func getValuesFromAnnotations(
+	_ *clusterv1.ManagedCluster, addon *addonapiv1beta1.ManagedClusterAddOn,
+) (addonfactory.Values, error) {
+	userValues := gatekeeperSyncUserValues{}
+
+	if err := userValues.SetCommonValuesFromAnnotations(addon); err != nil {
+		log.Error(err, "failed to set common values from annotations")
+	}
+
+	return addonfactory.JsonStructToValues(userValues)
+}
+
+func getValuesFromCustomizedVariableValues(config addonapiv1beta1.AddOnDeploymentConfig) (addonfactory.Values, error) {
+	// Only the values set by the config are returned, so that they don't override the values of the layers below
+	userValues := gatekeeperSyncUserValues{}
+
+	unknownValues, err := userValues.setValuesFromCustomizedVariables(config)
+	if err != nil {
+		log.Error(err, "error setting addon values from customized variables")
+	}
+
+	for key, value := range unknownValues {
+		log.Error(errors.New("unknown customized variable"),
+			"variable is not supported",
+			"variable", key,
+			"value", value)
+	}
+
+	return addonfactory.JsonStructToValues(userValues)
+}
+
+// setValuesFromCustomizedVariables sets the values from the customized variables
+// in the deployment config. It returns a map with any unknown variables and an
+// aggregated error of the rejected values.
+func (gsv *gatekeeperSyncUserValues) setValuesFromCustomizedVariables(
+	config addonapiv1beta1.AddOnDeploymentConfig,
+) (map[string]string, error) {
+	// The gatekeeper sync addon has no customized variables beyond the common ones
+	unknownValues, aggregateErr := gsv.SetCommonValuesFromCustomizedVariables(config)
+
+	images, err := defaultImages()
+	if err != nil {
+		return unknownValues, errors.Join(aggregateErr, err)
+	}
+
+	if err := gsv.SetImageFromDeploymentConfig(config, imageKey, images); err != nil {
+		aggregateErr = errors.Join(aggregateErr, err)
+	}
+
+	return unknownValues, aggregateErr
+}
+
+// ValidateConfiguration returns warnings for the unsupported annotations and
+// customized variables, and an aggregated error of the values rejected from the
+// ManagedClusterAddOn annotations and the deployment config.
+func ValidateConfiguration(
+	addon *addonapiv1beta1.ManagedClusterAddOn, config *addonapiv1beta1.AddOnDeploymentConfig,
+) ([]string, error) {
+	userValues := getSkeletonValues()
+	warnings := policyaddon.UnknownAnnotationWarnings(addon)
+
+	err := userValues.SetCommonValuesFromAnnotations(addon)
+
+	if config != nil {
+		unknownValues, configErr := userValues.setValuesFromCustomizedVariables(*config)
+		warnings = append(warnings, policyaddon.UnknownVariableWarnings(addonName, unknownValues)...)
+		err = errors.Join(err, configErr)
+	}
+
+	return warnings, err
+}
+
+// GetAgentAddon returns the agent addon using new hub clients. The addons hosted
+// on a ManagedCluster are updated when the hosting cluster changes.
+func GetAgentAddon(
+	ctx context.Context, mgr addonmanager.AddonManager, controllerContext *controllercmd.ControllerContext,
+) (agent.AgentAddon, error) {
+	addonClient, err := addonv1alpha1client.NewForConfig(controllerContext.KubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve addon client: %w", err)
+	}
+
+	clusterClient, err := clusterv1client.NewForConfig(controllerContext.KubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize a managed cluster client: %w", err)
+	}
+
+	clusterInformer := clusterv1informers.NewSharedInformerFactory(clusterClient, 10*time.Minute).
+		Cluster().V1().ManagedClusters()
+	go clusterInformer.Informer().Run(ctx.Done())
+
+	err = policyaddon.TriggerOnHostingClusterChange(ctx, mgr, addonName, addonClient, clusterInformer.Informer())
+	if err != nil {
+		return nil, err
+	}
+
+	return BuildAgentAddon(ctx, controllerContext, policyaddon.AgentAddonClients{
+		AddonClient:   addonClient,
+		ClusterClient: clusterClient,
+		ClusterLister: clusterInformer.Lister(),
+	})
+}
+
+// BuildAgentAddon builds the agent addon using the provided hub clients.
+func BuildAgentAddon(
+	ctx context.Context,
+	controllerContext *controllercmd.ControllerContext,
+	clients policyaddon.AgentAddonClients,
+) (agent.AgentAddon, error) {
+	registrationOption := policyaddon.NewRegistrationOption(
+		ctx,
+		controllerContext,
+		addonName,
+		agentPermissionFiles,
+		FS,
+		false)
+
+	values := GetAddonValues(clients)
+
+	agentAddon, err := addonfactory.NewAgentAddonFactory(addonName, FS, "manifests/managedclusterchart").
+		WithConfigGVRs(utils.AddOnDeploymentConfigGVR).
+		WithGetValuesFuncs(values.GetValuesFuncs()...).
+		WithManagedClusterClient(clients.ClusterClient).
+		WithAgentRegistrationOption(registrationOption).
+		WithAgentInstallNamespace(
+			policyaddon.CommonAgentInstallNamespaceFromDeploymentConfigFunc(ctx, addonName, clients.AddonClient),
+		).
+		WithScheme(policyaddon.Scheme).
+		BuildHelmAgentAddon()
+	if err != nil {
+		return nil, err
+	}
+
+	return &policyaddon.ValuesAgentAddon{AgentAddon: agentAddon, Values: values}, nil
+}
+
+// GatekeeperSyncAgentAddon wraps the AgentAddon to update the framework addon,
+// which disables its own Gatekeeper sync when this addon is enabled.
+type GatekeeperSyncAgentAddon struct {
+	agent.AgentAddon
+	manager addonmanager.AddonManager
+}
+
+func (ga *GatekeeperSyncAgentAddon) Manifests(
+	ctx context.Context,
+	cluster *clusterv1.ManagedCluster,
+	addon *addonapiv1beta1.ManagedClusterAddOn,
+) ([]runtime.Object, error) {
+	// framework addon needs to update itself whenever this addon is created/updated/deleted
+	ga.manager.Trigger(cluster.Name, frameworkAddonName)
+
+	return ga.AgentAddon.Manifests(ctx, cluster, addon)
+}
+
+// AddonValues returns the sources of the values of the wrapped agent addon.
+func (ga *GatekeeperSyncAgentAddon) AddonValues() *policyaddon.AddonValues {
+	if provider, ok := ga.AgentAddon.(policyaddon.ValuesProvider); ok {
+		return provider.AddonValues()
+	}
+
+	return nil
+}
+
+// GetAddonValues returns the sources of the addon values using the provided hub
+// clients.
+func GetAddonValues(clients policyaddon.AgentAddonClients) *policyaddon.AddonValues {
+	return policyaddon.NewAddonValues().
+		Add(policyaddon.SkeletonLayer, "skeleton", getSkeletonValuesFunc).
+		Add(policyaddon.SkeletonLayer, "image-env", getImageValuesFromEnv).
+		Add(policyaddon.ClusterLayer, "cluster", getClusterValues(clients.ClusterLister)).
+		AddDeploymentConfig("AddOnDeploymentConfig", addonfactory.GetAddOnDeploymentConfigValues(
+			utils.NewAddOnDeploymentConfigGetter(clients.AddonClient),
+			addonfactory.ToAddOnNodePlacementValues,
+			addonfactory.ToAddOnResourceRequirementsValues,
+			getValuesFromCustomizedVariableValues,
+		)).
+		Add(policyaddon.AnnotationLayer, "annotations", getValuesFromAnnotations).
+		Add(policyaddon.AnnotationLayer, "values-annotation", addonfactory.GetValuesFromAddonAnnotation).
+		Add(policyaddon.MandatedLayer, "uninstall", policyaddon.MandateValues)
+}
+
+func GetAndAddAgent(
+	ctx context.Context, mgr addonmanager.AddonManager, controllerContext *controllercmd.ControllerContext,
+) error {
+	getAgent := func(
+		ctx context.Context, mgr addonmanager.AddonManager, controllerContext *controllercmd.ControllerContext,
+	) (agent.AgentAddon, error) {
+		agentAddon, err := GetAgentAddon(ctx, mgr, controllerContext)
+		if err != nil {
+			return nil, err
+		}
+
+		return &GatekeeperSyncAgentAddon{AgentAddon: agentAddon, manager: mgr}, nil
+	}
+
+	err := policyaddon.GetAndAddAgent(ctx, mgr, addonName, controllerContext, getAgent, ValidateConfiguration)
+	if err != nil {
+		return err
+	}
+
+	return policyaddon.StartHubPermissionsCleanup(ctx, controllerContext, addonName, hubRoleBindingName)
+}
+
+// getImageValuesFromEnv sets the image from the environment variable, when it
+// is set to a non-empty value, as the default image of the fleet. The image
+// customized variable and the registry mirrors of a deployment config override
+// it for the clusters using that config.
+func getImageValuesFromEnv(
+	_ *clusterv1.ManagedCluster,
+	_ *addonapiv1beta1.ManagedClusterAddOn,
+) (addonfactory.Values, error) {
+	values := addonfactory.Values{}
+
+	img := os.Getenv(imageEnvVar)
+	if img == "" {
+		return values, nil
+	}
+
+	values["global"] = map[string]any{
+		"imageOverrides": map[string]any{
+			imageKey: img,
+		},
+	}
+
+	return values, nil
+}
@@ -0,0 +1,380 @@
+package addon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	coordinationlistersv1 "k8s.io/client-go/listers/coordination/v1"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/clock"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonv1alpha1client "open-cluster-management.io/api/client/addon/clientset/versioned"
+	addoninformers "open-cluster-management.io/api/client/addon/informers/externalversions"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	workinformers "open-cluster-management.io/api/client/work/informers/externalversions"
+	worklistersv1 "open-cluster-management.io/api/client/work/listers/work/v1"
+	workv1 "open-cluster-management.io/api/work/v1"
+	"open-cluster-management.io/sdk-go/pkg/basecontroller/factory"
+	"open-cluster-management.io/sdk-go/pkg/patcher"
+)
+
+// AgentHealth is the health of the agent of a ManagedClusterAddOn.
+type AgentHealth string
+
+const (
+	AgentHealthy        AgentHealth = "Healthy"
+	AgentDegraded       AgentHealth = "Degraded"
+	AgentHealthUnknown  AgentHealth = "Unknown"
+	AgentHealthyMessage             = "The agent is available, its hub lease is renewed, and its Deployments are ready"
+
+	// AgentHealthyCondition is the ManagedClusterAddOn condition type reporting the health of the agent. Its
+	// reason is the AgentHealth.
+	AgentHealthyCondition = "AgentHealthy"
+
+	// The ClusterManagementAddOn annotations with the number of ManagedClusterAddOns of each AgentHealth.
+	HealthyCountAnnotation  = "policy-addon-health-healthy"
+	DegradedCountAnnotation = "policy-addon-health-degraded"
+	UnknownCountAnnotation  = "policy-addon-health-unknown"
+
+	// HealthLeaseGracePeriod is how long the lease the agent renews on the hub can go without being renewed
+	// before the agent is degraded.
+	HealthLeaseGracePeriod = 5 * time.Minute
+	healthResyncInterval   = time.Minute
+	// healthSummaryDelay is how long the health changes are batched before the summary is recomputed.
+	healthSummaryDelay = 10 * time.Second
+	healthSummaryKey   = "summary"
+)
+
+// ReportHealth sets whether the health of the agents is reported on the
+// ManagedClusterAddOns and summarized on the ClusterManagementAddOn.
+var ReportHealth = true
+
+// healthCountAnnotations are the ClusterManagementAddOn annotations of each AgentHealth.
+var healthCountAnnotations = map[AgentHealth]string{
+	AgentHealthy:       HealthyCountAnnotation,
+	AgentDegraded:      DegradedCountAnnotation,
+	AgentHealthUnknown: UnknownCountAnnotation,
+}
+
+// GetAgentHealth returns the health of the agent of the ManagedClusterAddOn at
+// the given time and a message describing it, from:
+//   - the Available condition of the addon, set from the lease of the agent on
+//     the managed cluster or the status feedback of its Deployment
+//   - the lease the agent renews on the hub while it's reconciling, which may
+//     be nil since not every agent maintains one
+//   - the status feedback of the agent Deployments in the ManifestWorks of the
+//     addon
+//
+// The health is unknown when the availability of the addon is unknown, such as
+// when the managed cluster is offline, since the other sources are then stale.
+func GetAgentHealth(
+	addon *addonapiv1beta1.ManagedClusterAddOn,
+	lease *coordinationv1.Lease,
+	works []*workv1.ManifestWork,
+	now time.Time,
+) (AgentHealth, string) {
+	available := meta.FindStatusCondition(addon.Status.Conditions, addonapiv1beta1.ManagedClusterAddOnConditionAvailable)
+	if available == nil || available.Status == metav1.ConditionUnknown {
+		return AgentHealthUnknown, "The availability of the addon is unknown"
+	}
+
+	problems := []string{}
+
+	if available.Status == metav1.ConditionFalse {
+		problems = append(problems, "the addon is not available: "+available.Message)
+	}
+
+	if lease != nil && lease.Spec.RenewTime != nil && now.Sub(lease.Spec.RenewTime.Time) > HealthLeaseGracePeriod {
+		problems = append(problems, fmt.Sprintf("the agent last reconciled at %s",
+			lease.Spec.RenewTime.UTC().Format(time.RFC3339)))
+	}
+
+	for _, work := range works {
+		for _, manifest := range work.Status.ResourceStatus.Manifests {
+			if manifest.ResourceMeta.Group != appsv1.GroupName || manifest.ResourceMeta.Resource != "deployments" {
+				continue
+			}
+
+			status, ok := getDeploymentFeedback(manifest.StatusFeedbacks)
+			if ok && status.readyReplicas < status.replicas {
+				problems = append(problems, fmt.Sprintf("the Deployment %s/%s has %d of %d ready replicas",
+					manifest.ResourceMeta.Namespace, manifest.ResourceMeta.Name, status.readyReplicas, status.replicas))
+			}
+		}
+	}
+
+	if len(problems) != 0 {
+		message := strings.Join(problems, "; ")
+
+		return AgentDegraded, strings.ToUpper(message[:1]) + message[1:]
+	}
+
+	return AgentHealthy, AgentHealthyMessage
+}
+
+// healthController reports the health of the agents of an addon in the
+// AgentHealthy condition of each ManagedClusterAddOn, by cluster namespace, and
+// the number of ManagedClusterAddOns of each health in annotations on the
+// ClusterManagementAddOn, since its status has no field for it. The summary is
+// recomputed from the AgentHealthy conditions separately, at most once per
+// healthSummaryDelay.
+type healthController struct {
+	addonClient  addonv1alpha1client.Interface
+	addonLister  addonlistersv1beta1.ManagedClusterAddOnLister
+	cmaLister    addonlistersv1beta1.ClusterManagementAddOnLister
+	workLister   worklistersv1.ManifestWorkLister
+	leaseLister  coordinationlistersv1.LeaseLister
+	summaryQueue workqueue.TypedRateLimitingInterface[string]
+	clock        clock.Clock
+	addonName    string
+}
+
+// startHealthController starts the health controller for the addon. The addon
+// and ManifestWork informer factories must be started by the caller.
+func startHealthController(
+	ctx context.Context,
+	addonName string,
+	addonClient addonv1alpha1client.Interface,
+	kubeClient kubernetes.Interface,
+	addonInformerFactory addoninformers.SharedInformerFactory,
+	workInformerFactory workinformers.SharedInformerFactory,
+) {
+	// Only the hub leases of this addon are watched
+	leaseInformerFactory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 10*time.Minute,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", addonName).String()
+		}),
+	)
+
+	addonInformer := addonInformerFactory.Addon().V1beta1().ManagedClusterAddOns()
+	cmaInformer := addonInformerFactory.Addon().V1beta1().ClusterManagementAddOns()
+	workInformer := workInformerFactory.Work().V1().ManifestWorks()
+	leaseInformer := leaseInformerFactory.Coordination().V1().Leases()
+
+	summarySyncCtx := factory.NewSyncContext(addonName + "-health-summary")
+
+	c := &healthController{
+		addonClient:  addonClient,
+		addonLister:  addonInformer.Lister(),
+		cmaLister:    cmaInformer.Lister(),
+		workLister:   workInformer.Lister(),
+		leaseLister:  leaseInformer.Lister(),
+		summaryQueue: summarySyncCtx.Queue(),
+		clock:        clock.RealClock{},
+		addonName:    addonName,
+	}
+
+	// The periodic resync catches the leases which are no longer renewed
+	controller := factory.New().
+		WithSync(c.sync).
+		WithInformersQueueKeysFunc(
+			func(obj runtime.Object) []string {
+				accessor, _ := meta.Accessor(obj)
+
+				return []string{accessor.GetNamespace()}
+			},
+			addonInformer.Informer(), leaseInformer.Informer(),
+		).
+		// The ManifestWorks of a hosted addon are in the namespace of the hosting cluster
+		WithInformersQueueKeysFunc(
+			func(obj runtime.Object) []string {
+				accessor, _ := meta.Accessor(obj)
+				if addonNamespace, ok := accessor.GetLabels()[addonapiv1beta1.AddonNamespaceLabelKey]; ok {
+					return []string{addonNamespace}
+				}
+
+				return []string{accessor.GetNamespace()}
+			},
+			workInformer.Informer(),
+		).
+		ResyncEvery(healthResyncInterval).
+		ToController(addonName + "-health-controller")
+
+	summaryController := factory.New().
+		WithSyncContext(summarySyncCtx).
+		WithSync(c.syncSummary).
+		WithBareInformers(addonInformer.Informer(), cmaInformer.Informer()).
+		ResyncEvery(healthResyncInterval).
+		ToController(addonName + "-health-summary")
+
+	leaseInformerFactory.Start(ctx.Done())
+
+	go controller.Run(ctx, 1)
+	go summaryController.Run(ctx, 1)
+}
+
+// sync reports the health of the agent of the ManagedClusterAddOn in the
+// cluster namespace key, and queues the summary to be recomputed.
+func (c *healthController) sync(ctx context.Context, syncCtx factory.SyncContext, key string) error {
+	if key == factory.DefaultQueueKey {
+		addons, err := c.addonLister.List(labels.Everything())
+		if err != nil {
+			return fmt.Errorf("failed to list the ManagedClusterAddOns: %w", err)
+		}
+
+		for _, addon := range addons {
+			syncCtx.Queue().Add(addon.Namespace)
+		}
+
+		return nil
+	}
+
+	// The summary also changes when the ManagedClusterAddOn is removed
+	c.summaryQueue.AddAfter(healthSummaryKey, healthSummaryDelay)
+
+	addon, err := c.addonLister.ManagedClusterAddOns(key).Get(c.addonName)
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	lease, err := c.leaseLister.Leases(key).Get(c.addonName)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get the lease of the agent: %w", err)
+	}
+
+	works, err := addonWorks(c.workLister, addon)
+	if err != nil {
+		return err
+	}
+
+	// The pre-delete hook manifests are only applied when the addon is removed
+	works = slices.DeleteFunc(works, IsPreDeleteHookWork)
+
+	health, message := GetAgentHealth(addon, lease, works, c.clock.Now())
+
+	return c.setHealthCondition(ctx, addon, health, message)
+}
+
+// syncSummary sets the number of ManagedClusterAddOns of each health from their
+// AgentHealthy conditions in the agent health metric and on the
+// ClusterManagementAddOn. A ManagedClusterAddOn without the condition yet is
+// counted as unknown.
+func (c *healthController) syncSummary(ctx context.Context, _ factory.SyncContext, _ string) error {
+	addons, err := c.addonLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list the ManagedClusterAddOns: %w", err)
+	}
+
+	counts := map[AgentHealth]int{AgentHealthy: 0, AgentDegraded: 0, AgentHealthUnknown: 0}
+
+	for _, addon := range addons {
+		health := AgentHealthUnknown
+
+		condition := meta.FindStatusCondition(addon.Status.Conditions, AgentHealthyCondition)
+		if condition != nil {
+			if _, ok := healthCountAnnotations[AgentHealth(condition.Reason)]; ok {
+				health = AgentHealth(condition.Reason)
+			}
+		}
+
+		counts[health]++
+	}
+
+	for health, count := range counts {
+		agentHealth.WithLabelValues(c.addonName, string(health)).Set(float64(count))
+	}
+
+	return c.setHealthCounts(ctx, counts)
+}
+
+// setHealthCondition sets the AgentHealthy condition of the ManagedClusterAddOn
+// when it changed.
+func (c *healthController) setHealthCondition(
+	ctx context.Context, addon *addonapiv1beta1.ManagedClusterAddOn, health AgentHealth, message string,
+) error {
+	status := metav1.ConditionUnknown
+
+	switch health {
+	case AgentHealthy:
+		status = metav1.ConditionTrue
+	case AgentDegraded:
+		status = metav1.ConditionFalse
+	case AgentHealthUnknown:
+	}
+
+	newAddon := addon.DeepCopy()
+	if !meta.SetStatusCondition(&newAddon.Status.Conditions, metav1.Condition{
+		Type:    AgentHealthyCondition,
+		Status:  status,
+		Reason:  string(health),
+		Message: message,
+	}) {
+		return nil
+	}
+
+	addonPatcher := patcher.NewPatcher[
+		*addonapiv1beta1.ManagedClusterAddOn,
+		addonapiv1beta1.ManagedClusterAddOnSpec,
+		addonapiv1beta1.ManagedClusterAddOnStatus](c.addonClient.AddonV1beta1().ManagedClusterAddOns(addon.Namespace))
+
+	if _, err := addonPatcher.PatchStatus(ctx, newAddon, newAddon.Status, addon.Status); err != nil {
+		return fmt.Errorf("failed to update the %s condition: %w", AgentHealthyCondition, err)
+	}
+
+	return nil
+}
+
+// setHealthCounts sets the number of ManagedClusterAddOns of each health in the
+// annotations of the ClusterManagementAddOn when they changed.
+func (c *healthController) setHealthCounts(ctx context.Context, counts map[AgentHealth]int) error {
+	cma, err := c.cmaLister.Get(c.addonName)
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	annotations := map[string]string{}
+
+	for health, count := range counts {
+		annotations[healthCountAnnotations[health]] = strconv.Itoa(count)
+	}
+
+	changed := false
+
+	for key, value := range annotations {
+		if cma.GetAnnotations()[key] != value {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": annotations}})
+	if err != nil {
+		return fmt.Errorf("failed to encode the ClusterManagementAddOn patch: %w", err)
+	}
+
+	_, err = c.addonClient.AddonV1beta1().ClusterManagementAddOns().Patch(
+		ctx, c.addonName, types.MergePatchType, patch, metav1.PatchOptions{},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update the health summary of the ClusterManagementAddOn: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationlistersv1 "k8s.io/client-go/listers/coordination/v1"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/ptr"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonfake "open-cluster-management.io/api/client/addon/clientset/versioned/fake"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	worklistersv1 "open-cluster-management.io/api/client/work/listers/work/v1"
+	workv1 "open-cluster-management.io/api/work/v1"
+	"open-cluster-management.io/sdk-go/pkg/basecontroller/factory"
+)
+
+func TestGetAgentHealth(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	addonWithAvailable := func(status metav1.ConditionStatus) *addonapiv1beta1.ManagedClusterAddOn {
+		return &addonapiv1beta1.ManagedClusterAddOn{
+			Status: addonapiv1beta1.ManagedClusterAddOnStatus{
+				Conditions: []metav1.Condition{{
+					Type:    addonapiv1beta1.ManagedClusterAddOnConditionAvailable,
+					Status:  status,
+					Message: "Addon agent is unavailable",
+				}},
+			},
+		}
+	}
+
+	leaseRenewedAt := func(renewTime time.Time) *coordinationv1.Lease {
+		return &coordinationv1.Lease{
+			Spec: coordinationv1.LeaseSpec{RenewTime: &metav1.MicroTime{Time: renewTime}},
+		}
+	}
+
+	workWithReplicas := func(replicas, ready int64) *workv1.ManifestWork {
+		return &workv1.ManifestWork{
+			Status: workv1.ManifestWorkStatus{
+				ResourceStatus: workv1.ManifestResourceStatus{
+					Manifests: []workv1.ManifestCondition{{
+						ResourceMeta: workv1.ManifestResourceMeta{
+							Group:     "apps",
+							Resource:  "deployments",
+							Namespace: "open-cluster-management-agent-addon",
+							Name:      "governance-policy-framework",
+						},
+						StatusFeedbacks: workv1.StatusFeedbackResult{
+							Values: []workv1.FeedbackValue{
+								{Name: "Replicas", Value: workv1.FieldValue{Integer: ptr.To(replicas)}},
+								{Name: "ReadyReplicas", Value: workv1.FieldValue{Integer: ptr.To(ready)}},
+							},
+						},
+					}},
+				},
+			},
+		}
+	}
+
+	tests := map[string]struct {
+		addon           *addonapiv1beta1.ManagedClusterAddOn
+		lease           *coordinationv1.Lease
+		works           []*workv1.ManifestWork
+		expectedHealth  AgentHealth
+		expectedMessage string
+	}{
+		"no Available condition": {
+			addon:           &addonapiv1beta1.ManagedClusterAddOn{},
+			expectedHealth:  AgentHealthUnknown,
+			expectedMessage: "The availability of the addon is unknown",
+		},
+		"offline cluster ignores the stale sources": {
+			addon:           addonWithAvailable(metav1.ConditionUnknown),
+			lease:           leaseRenewedAt(now.Add(-time.Hour)),
+			works:           []*workv1.ManifestWork{workWithReplicas(1, 0)},
+			expectedHealth:  AgentHealthUnknown,
+			expectedMessage: "The availability of the addon is unknown",
+		},
+		"available with a fresh lease and ready Deployment": {
+			addon:           addonWithAvailable(metav1.ConditionTrue),
+			lease:           leaseRenewedAt(now.Add(-time.Minute)),
+			works:           []*workv1.ManifestWork{workWithReplicas(2, 2)},
+			expectedHealth:  AgentHealthy,
+			expectedMessage: AgentHealthyMessage,
+		},
+		"available without a hub lease or feedback": {
+			addon:           addonWithAvailable(metav1.ConditionTrue),
+			works:           []*workv1.ManifestWork{{}},
+			expectedHealth:  AgentHealthy,
+			expectedMessage: AgentHealthyMessage,
+		},
+		"unavailable": {
+			addon:           addonWithAvailable(metav1.ConditionFalse),
+			expectedHealth:  AgentDegraded,
+			expectedMessage: "The addon is not available: Addon agent is unavailable",
+		},
+		"stale lease": {
+			addon:           addonWithAvailable(metav1.ConditionTrue),
+			lease:           leaseRenewedAt(now.Add(-10 * time.Minute)),
+			expectedHealth:  AgentDegraded,
+			expectedMessage: "The agent last reconciled at 2026-01-01T11:50:00Z",
+		},
+		"unready Deployment and stale lease": {
+			addon:          addonWithAvailable(metav1.ConditionTrue),
+			lease:          leaseRenewedAt(now.Add(-10 * time.Minute)),
+			works:          []*workv1.ManifestWork{workWithReplicas(2, 1)},
+			expectedHealth: AgentDegraded,
+			expectedMessage: "The agent last reconciled at 2026-01-01T11:50:00Z; the Deployment " +
+				"open-cluster-management-agent-addon/governance-policy-framework has 1 of 2 ready replicas",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			health, message := GetAgentHealth(test.addon, test.lease, test.works, now)
+
+			if health != test.expectedHealth {
+				t.Fatalf("expected health %s, got %s", test.expectedHealth, health)
+			}
+
+			if message != test.expectedMessage {
+				t.Fatalf("expected message %q, got %q", test.expectedMessage, message)
+			}
+		})
+	}
+}
+
+func TestHealthControllerSync(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	addonInCluster := func(namespace string, conditions ...metav1.Condition) *addonapiv1beta1.ManagedClusterAddOn {
+		return &addonapiv1beta1.ManagedClusterAddOn{
+			ObjectMeta: metav1.ObjectMeta{Name: "governance-policy-framework", Namespace: namespace},
+			Status:     addonapiv1beta1.ManagedClusterAddOnStatus{Conditions: conditions},
+		}
+	}
+
+	available := metav1.Condition{
+		Type:   addonapiv1beta1.ManagedClusterAddOnConditionAvailable,
+		Status: metav1.ConditionTrue,
+	}
+	cma := &addonapiv1beta1.ClusterManagementAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "governance-policy-framework"},
+	}
+	addons := []*addonapiv1beta1.ManagedClusterAddOn{addonInCluster("cluster1", available), addonInCluster("cluster2")}
+
+	client := addonfake.NewSimpleClientset(cma, addons[0], addons[1])
+	addonIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	cmaIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	for _, addon := range addons {
+		if err := addonIndexer.Add(addon); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cmaIndexer.Add(cma); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &healthController{
+		addonClient: client,
+		addonLister: addonlistersv1beta1.NewManagedClusterAddOnLister(addonIndexer),
+		cmaLister:   addonlistersv1beta1.NewClusterManagementAddOnLister(cmaIndexer),
+		workLister: worklistersv1.NewManifestWorkLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})),
+		leaseLister: coordinationlistersv1.NewLeaseLister(
+			cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		summaryQueue: workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]()),
+		clock:        clocktesting.NewFakeClock(now),
+		addonName:    "governance-policy-framework",
+	}
+	defer c.summaryQueue.ShutDown()
+
+	// Only the ManagedClusterAddOn in the synced cluster namespace is updated
+	if err := c.sync(context.TODO(), factory.NewSyncContext("test"), "cluster1"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	patched := []string{}
+
+	for _, action := range client.Actions() {
+		if patch, ok := action.(clienttesting.PatchAction); ok {
+			patched = append(patched, patch.GetNamespace()+"/"+patch.GetName())
+		}
+	}
+
+	if len(patched) != 1 || patched[0] != "cluster1/governance-policy-framework" {
+		t.Fatalf("expected only the cluster1 ManagedClusterAddOn to be patched, got: %v", patched)
+	}
+
+	updated, err := client.AddonV1beta1().ManagedClusterAddOns("cluster1").Get(
+		context.TODO(), "governance-policy-framework", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	condition := meta.FindStatusCondition(updated.Status.Conditions, AgentHealthyCondition)
+	if condition == nil || condition.Reason != string(AgentHealthy) {
+		t.Fatalf("expected the agent to be healthy, got: %v", condition)
+	}
+
+	// The summary is counted from the AgentHealthy conditions, without one counting as unknown
+	if err := addonIndexer.Update(updated); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.syncSummary(context.TODO(), nil, healthSummaryKey); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	updatedCMA, err := client.AddonV1beta1().ClusterManagementAddOns().Get(
+		context.TODO(), "governance-policy-framework", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{HealthyCountAnnotation: "1", DegradedCountAnnotation: "0", UnknownCountAnnotation: "1"}
+
+	for key, value := range expected {
+		if updatedCMA.Annotations[key] != value {
+			t.Fatalf("expected the %s annotation to be %s, got: %v", key, value, updatedCMA.Annotations)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package addon
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"open-cluster-management.io/addon-framework/pkg/addonmanager"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonv1alpha1client "open-cluster-management.io/api/client/addon/clientset/versioned"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+// TriggerOnHostingClusterChange adds an event handler to the ManagedCluster
+// informer to update the hosted addons when their hosting cluster is created or
+// its labels or ClusterClaims change, since the hosting cluster values, such as
+// its Kubernetes distribution, are derived from them.
+func TriggerOnHostingClusterChange(
+	ctx context.Context,
+	mgr addonmanager.AddonManager,
+	addonName string,
+	addonClient addonv1alpha1client.Interface,
+	clusterInformer cache.SharedIndexInformer,
+) error {
+	addonInformerFactory := newAddonInformerFactory(addonClient, addonName)
+	addonLister := addonInformerFactory.Addon().V1beta1().ManagedClusterAddOns().Lister()
+
+	_, err := clusterInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			if cluster, ok := obj.(*clusterv1.ManagedCluster); ok {
+				triggerHostedAddons(mgr, addonName, addonLister, cluster.Name)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj any) {
+			oldCluster, oldOK := oldObj.(*clusterv1.ManagedCluster)
+			newCluster, newOK := newObj.(*clusterv1.ManagedCluster)
+
+			if oldOK && newOK && hostingValuesChanged(oldCluster, newCluster) {
+				triggerHostedAddons(mgr, addonName, addonLister, newCluster.Name)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add the hosting cluster event handler: %w", err)
+	}
+
+	addonInformerFactory.Start(ctx.Done())
+
+	return nil
+}
+
+// hostingValuesChanged returns whether the ManagedCluster fields used for the
+// hosting cluster values changed.
+func hostingValuesChanged(oldCluster, newCluster *clusterv1.ManagedCluster) bool {
+	return !equality.Semantic.DeepEqual(oldCluster.Labels, newCluster.Labels) ||
+		!equality.Semantic.DeepEqual(oldCluster.Status.ClusterClaims, newCluster.Status.ClusterClaims)
+}
+
+// triggerHostedAddons triggers an update of the addons hosted on the cluster.
+func triggerHostedAddons(
+	mgr addonmanager.AddonManager,
+	addonName string,
+	addonLister addonlistersv1beta1.ManagedClusterAddOnLister,
+	hostingClusterName string,
+) {
+	addons, err := addonLister.List(labels.Everything())
+	if err != nil {
+		log.Error(err, "Failed to list the ManagedClusterAddOns", "addon", addonName)
+
+		return
+	}
+
+	for _, addon := range addons {
+		if addon.Annotations[addonapiv1beta1.HostingClusterNameAnnotationKey] == hostingClusterName {
+			mgr.Trigger(addon.Namespace, addonName)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"slices"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"open-cluster-management.io/addon-framework/pkg/addonmanager"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+type triggerRecorder struct {
+	addonmanager.AddonManager
+	triggered []string
+}
+
+func (r *triggerRecorder) Trigger(clusterName, addonName string) {
+	r.triggered = append(r.triggered, clusterName+"/"+addonName)
+}
+
+func TestHostingValuesChanged(t *testing.T) {
+	cluster := &clusterv1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"vendor": "Other"}}}
+
+	relabeled := cluster.DeepCopy()
+	relabeled.Labels["vendor"] = "OpenShift"
+
+	claimed := cluster.DeepCopy()
+	claimed.Status.ClusterClaims = []clusterv1.ManagedClusterClaim{{Name: "product.open-cluster-management.io"}}
+
+	heartbeat := cluster.DeepCopy()
+	heartbeat.Status.Conditions = []metav1.Condition{{Type: clusterv1.ManagedClusterConditionAvailable}}
+
+	if !hostingValuesChanged(cluster, relabeled) || !hostingValuesChanged(cluster, claimed) {
+		t.Fatal("expected label and ClusterClaim changes to be detected")
+	}
+
+	if hostingValuesChanged(cluster, heartbeat) {
+		t.Fatal("expected a status condition change to be ignored")
+	}
+}
+
+func TestTriggerHostedAddons(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	for _, namespace := range []string{"hosted1", "hosted2", "other"} {
+		hostingCluster := "hosting"
+		if namespace == "other" {
+			hostingCluster = "other-hosting"
+		}
+
+		err := indexer.Add(&addonapiv1beta1.ManagedClusterAddOn{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "config-policy-controller",
+				Namespace:   namespace,
+				Annotations: map[string]string{addonapiv1beta1.HostingClusterNameAnnotationKey: hostingCluster},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := indexer.Add(&addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Namespace: "hosting"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mgr := &triggerRecorder{}
+
+	triggerHostedAddons(mgr, "config-policy-controller", addonlistersv1beta1.NewManagedClusterAddOnLister(indexer),
+		"hosting")
+
+	slices.Sort(mgr.triggered)
+
+	expected := []string{"hosted1/config-policy-controller", "hosted2/config-policy-controller"}
+	if !slices.Equal(mgr.triggered, expected) {
+		t.Fatalf("expected the hosted addons %v to be triggered, got %v", expected, mgr.triggered)
+	}
+}
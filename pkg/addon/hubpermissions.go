@@ -0,0 +1,270 @@
+package addon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/openshift/library-go/pkg/controller/controllercmd"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	rbaclistersv1 "k8s.io/client-go/listers/rbac/v1"
+	"k8s.io/utils/clock"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonv1alpha1client "open-cluster-management.io/api/client/addon/clientset/versioned"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	"open-cluster-management.io/sdk-go/pkg/basecontroller/factory"
+)
+
+const (
+	// staleHubPermissionsGracePeriod is how long a hub RoleBinding can exist without its ManagedClusterAddOn
+	// before it's deleted, so that the RoleBinding of a new addon isn't deleted before it's in the informer cache.
+	staleHubPermissionsGracePeriod = 5 * time.Minute
+	hubPermissionsResyncInterval   = 10 * time.Minute
+)
+
+// hubPermissions applies the permissions of the addon agent in the cluster
+// namespaces on the hub. The client, the parsed manifests and the resource cache
+// are shared by all the clusters, so that the permissions which didn't change
+// since they were last applied aren't updated again.
+type hubPermissions struct {
+	clients        *resourceapply.ClientHolder
+	recorder       events.Recorder
+	cache          *lockedResourceCache
+	manifests      []*template.Template
+	addonName      string
+	useClusterRole bool
+}
+
+func newHubPermissions(
+	kubeClient kubernetes.Interface,
+	recorder events.Recorder,
+	addonName string,
+	files []string,
+	filesystem fs.FS,
+	useClusterRole bool,
+) (*hubPermissions, error) {
+	manifests := make([]*template.Template, 0, len(files))
+
+	for _, file := range files {
+		content, err := fs.ReadFile(filesystem, file)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest, err := template.New(file).Parse(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+
+		manifests = append(manifests, manifest)
+	}
+
+	return &hubPermissions{
+		clients:        resourceapply.NewKubeClientHolder(kubeClient),
+		recorder:       recorder,
+		cache:          &lockedResourceCache{cache: resourceapply.NewResourceCache()},
+		manifests:      manifests,
+		addonName:      addonName,
+		useClusterRole: useClusterRole,
+	}, nil
+}
+
+// apply renders the manifests for the addon and applies them. The manifests
+// are owned by the ManagedClusterAddOn, so that they're garbage collected with
+// it, and bind the agent with the User when it is set, which is the
+// ServiceAccount user of an agent registered with a token, and with the Group
+// otherwise.
+func (h *hubPermissions) apply(ctx context.Context, addon *addonapiv1beta1.ManagedClusterAddOn) error {
+	groupIdx := 0 // 0 is a cluster-specific group
+
+	if h.useClusterRole {
+		groupIdx = 1 // 1 is a group for the entire addon
+	}
+
+	user, token := tokenAgentUser(addon)
+	if token && user == "" {
+		return ErrAgentUserNotReported
+	}
+
+	groups := agent.DefaultGroups(addon.Namespace, h.addonName)
+	config := struct {
+		ClusterName string
+		Group       string
+		User        string
+		AddonName   string
+		AddonUID    string
+	}{
+		ClusterName: addon.Namespace,
+		Group:       groups[groupIdx],
+		User:        user,
+		AddonName:   addon.Name,
+		AddonUID:    string(addon.UID),
+	}
+
+	for _, manifest := range h.manifests {
+		var rendered bytes.Buffer
+
+		if err := manifest.Execute(&rendered, config); err != nil {
+			return fmt.Errorf("failed to render %s: %w", manifest.Name(), err)
+		}
+
+		results := resourceapply.ApplyDirectly(ctx, h.clients, h.recorder, h.cache,
+			func(string) ([]byte, error) { return rendered.Bytes(), nil },
+			manifest.Name(),
+		)
+
+		for _, result := range results {
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+	}
+
+	return nil
+}
+
+// lockedResourceCache guards the resource cache, which isn't safe for concurrent
+// use, since the permissions of several clusters can be applied at the same time.
+type lockedResourceCache struct {
+	lock  sync.Mutex
+	cache resourceapply.ResourceCache
+}
+
+func (c *lockedResourceCache) UpdateCachedResourceMetadata(required runtime.Object, actual runtime.Object) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cache.UpdateCachedResourceMetadata(required, actual)
+}
+
+func (c *lockedResourceCache) SafeToSkipApply(required runtime.Object, existing runtime.Object) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.cache.SafeToSkipApply(required, existing)
+}
+
+// hubPermissionsCleanup deletes the RoleBindings granting the addon agent access
+// in the cluster namespaces on the hub when the ManagedClusterAddOn no longer
+// exists. The RoleBindings are owned by the ManagedClusterAddOn and garbage
+// collected with it, so this removes the RoleBindings created before they were
+// owned, and the ones left in the namespace of a removed ManagedCluster.
+type hubPermissionsCleanup struct {
+	kubeClient    kubernetes.Interface
+	bindingLister rbaclistersv1.RoleBindingLister
+	addonLister   addonlistersv1beta1.ManagedClusterAddOnLister
+	clock         clock.Clock
+	addonName     string
+	bindingName   string
+}
+
+// StartHubPermissionsCleanup starts the controller deleting the stale hub
+// RoleBindings with the given name of the addon. The RoleBindings which fail to
+// be deleted are logged and counted in a metric.
+func StartHubPermissionsCleanup(
+	ctx context.Context, controllerContext *controllercmd.ControllerContext, addonName string, bindingName string,
+) error {
+	kubeClient, err := kubernetes.NewForConfig(controllerContext.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create the Kubernetes client: %w", err)
+	}
+
+	addonClient, err := addonv1alpha1client.NewForConfig(controllerContext.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve addon client: %w", err)
+	}
+
+	// Only the RoleBindings of this addon are watched
+	kubeInformerFactory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 10*time.Minute,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", bindingName).String()
+		}),
+	)
+	addonInformerFactory := newAddonInformerFactory(addonClient, addonName)
+
+	bindingInformer := kubeInformerFactory.Rbac().V1().RoleBindings()
+	addonInformer := addonInformerFactory.Addon().V1beta1().ManagedClusterAddOns()
+
+	c := &hubPermissionsCleanup{
+		kubeClient:    kubeClient,
+		bindingLister: bindingInformer.Lister(),
+		addonLister:   addonInformer.Lister(),
+		clock:         clock.RealClock{},
+		addonName:     addonName,
+		bindingName:   bindingName,
+	}
+
+	// The periodic resync deletes the RoleBindings once they're older than the grace period
+	controller := factory.New().
+		WithSync(c.sync).
+		WithInformers(bindingInformer.Informer(), addonInformer.Informer()).
+		ResyncEvery(hubPermissionsResyncInterval).
+		ToController(addonName + "-hub-permissions-cleanup")
+
+	kubeInformerFactory.Start(ctx.Done())
+	addonInformerFactory.Start(ctx.Done())
+
+	go controller.Run(ctx, 1)
+
+	return nil
+}
+
+func (c *hubPermissionsCleanup) sync(ctx context.Context, _ factory.SyncContext, _ string) error {
+	bindings, err := c.bindingLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list the hub RoleBindings: %w", err)
+	}
+
+	leftovers := 0
+
+	var errs error
+
+	for _, binding := range bindings {
+		if binding.Name != c.bindingName || binding.DeletionTimestamp != nil ||
+			c.clock.Since(binding.CreationTimestamp.Time) < staleHubPermissionsGracePeriod {
+			continue
+		}
+
+		_, err := c.addonLister.ManagedClusterAddOns(binding.Namespace).Get(c.addonName)
+		if err == nil {
+			continue
+		}
+
+		if !k8serrors.IsNotFound(err) {
+			return err
+		}
+
+		log.Info("Deleting the hub RoleBinding of a removed addon",
+			"addon", c.addonName, "namespace", binding.Namespace, "name", binding.Name)
+
+		err = c.kubeClient.RbacV1().RoleBindings(binding.Namespace).Delete(ctx, binding.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &binding.UID},
+		})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			log.Error(err, "Failed to delete the hub RoleBinding of a removed addon",
+				"addon", c.addonName, "namespace", binding.Namespace, "name", binding.Name)
+
+			leftovers++
+
+			errs = errors.Join(errs, err)
+		}
+	}
+
+	staleHubPermissions.WithLabelValues(c.addonName).Set(float64(leftovers))
+
+	return errs
+}
@@ -0,0 +1,262 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/openshift/library-go/pkg/operator/events"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	rbaclistersv1 "k8s.io/client-go/listers/rbac/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+)
+
+var testHubPermissionsFS = fstest.MapFS{
+	"role.yaml": &fstest.MapFile{Data: []byte(`apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: open-cluster-management:config-policy-controller-hub
+rules:
+- apiGroups:
+  - coordination.k8s.io
+  resources:
+  - leases
+  verbs:
+  - create
+`)},
+	"rolebinding.yaml": &fstest.MapFile{Data: []byte(`kind: RoleBinding
+apiVersion: rbac.authorization.k8s.io/v1
+metadata:
+  name: "open-cluster-management:config-policy-controller-hub"
+  namespace: "{{ .ClusterName }}"
+  ownerReferences:
+    - apiVersion: addon.open-cluster-management.io/v1beta1
+      kind: ManagedClusterAddOn
+      name: "{{ .AddonName }}"
+      uid: "{{ .AddonUID }}"
+roleRef:
+  kind: ClusterRole
+  name: open-cluster-management:config-policy-controller-hub
+  apiGroup: rbac.authorization.k8s.io
+subjects:
+  {{- if .User }}
+  - apiGroup: rbac.authorization.k8s.io
+    kind: User
+    name: "{{ .User }}"
+  {{- else }}
+  - apiGroup: rbac.authorization.k8s.io
+    kind: Group
+    name: "{{ .Group }}"
+  {{- end }}
+`)},
+}
+
+func newTestHubPermissions(t testing.TB, kubeClient kubernetes.Interface) *hubPermissions {
+	t.Helper()
+
+	permissions, err := newHubPermissions(kubeClient,
+		events.NewInMemoryRecorder("test", clock.RealClock{}), "config-policy-controller",
+		[]string{"role.yaml", "rolebinding.yaml"}, testHubPermissionsFS, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return permissions
+}
+
+func testAddon(clusterName string) *addonapiv1beta1.ManagedClusterAddOn {
+	return &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "config-policy-controller",
+			Namespace: clusterName,
+			UID:       types.UID(clusterName + "-uid"),
+		},
+	}
+}
+
+func TestHubPermissionsApply(t *testing.T) {
+	client := fake.NewClientset()
+	permissions := newTestHubPermissions(t, client)
+
+	for _, clusterName := range []string{"cluster1", "cluster2"} {
+		if err := permissions.apply(context.TODO(), testAddon(clusterName)); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		binding, err := client.RbacV1().RoleBindings(clusterName).Get(context.TODO(),
+			"open-cluster-management:config-policy-controller-hub", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedGroup := "system:open-cluster-management:cluster:" + clusterName + ":addon:config-policy-controller"
+		if len(binding.Subjects) != 1 || binding.Subjects[0].Name != expectedGroup {
+			t.Fatalf("expected the RoleBinding subject to be %s, got: %v", expectedGroup, binding.Subjects)
+		}
+
+		if len(binding.OwnerReferences) != 1 || binding.OwnerReferences[0].UID != types.UID(clusterName+"-uid") {
+			t.Fatalf("expected the RoleBinding to be owned by the addon, got: %v", binding.OwnerReferences)
+		}
+	}
+
+	tokenAddon := testAddon("cluster3")
+	tokenAddon.Status.Registrations = []addonapiv1beta1.RegistrationConfig{{
+		Type:       addonapiv1beta1.KubeClient,
+		KubeClient: &addonapiv1beta1.KubeClientConfig{Driver: TokenRegistrationDriver},
+	}}
+
+	if err := permissions.apply(context.TODO(), tokenAddon); !errors.Is(err, ErrAgentUserNotReported) {
+		t.Fatalf("expected the agent user not to be reported, got: %v", err)
+	}
+
+	tokenUser := "system:serviceaccount:cluster3:config-policy-controller-agent"
+	tokenAddon.Status.Registrations[0].KubeClient.Subject.User = tokenUser
+
+	if err := permissions.apply(context.TODO(), tokenAddon); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	binding, err := client.RbacV1().RoleBindings("cluster3").Get(context.TODO(),
+		"open-cluster-management:config-policy-controller-hub", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(binding.Subjects) != 1 || binding.Subjects[0].Kind != rbacv1.UserKind || binding.Subjects[0].Name != tokenUser {
+		t.Fatalf("expected the RoleBinding subject to be the user %s, got: %v", tokenUser, binding.Subjects)
+	}
+
+	client.ClearActions()
+
+	// The unchanged permissions are skipped
+	if err := permissions.apply(context.TODO(), testAddon("cluster1")); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "get" {
+			t.Fatalf("expected the unchanged permissions not to be updated, got: %v", action)
+		}
+	}
+}
+
+// BenchmarkHubPermissions compares applying the unchanged hub permissions of
+// many clusters with a client and resource cache created for each cluster, and
+// with the ones shared by all the clusters.
+func BenchmarkHubPermissions(b *testing.B) {
+	const clusters = 100
+
+	client := fake.NewClientset()
+	shared := newTestHubPermissions(b, client)
+
+	for i := range clusters {
+		if err := shared.apply(context.TODO(), testAddon(fmt.Sprintf("cluster%d", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("per call", func(b *testing.B) {
+		for i := 0; b.Loop(); i++ {
+			// The client isn't used since there's no hub, but its creation is part of the cost
+			if _, err := kubernetes.NewForConfig(&rest.Config{Host: "https://hub.example.com"}); err != nil {
+				b.Fatal(err)
+			}
+
+			permissions := newTestHubPermissions(b, client)
+
+			if err := permissions.apply(context.TODO(), testAddon(fmt.Sprintf("cluster%d", i%clusters))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("shared", func(b *testing.B) {
+		for i := 0; b.Loop(); i++ {
+			if err := shared.apply(context.TODO(), testAddon(fmt.Sprintf("cluster%d", i%clusters))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestHubPermissionsCleanup(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	bindingName := "open-cluster-management:config-policy-controller-hub"
+
+	binding := func(namespace string, age time.Duration) *rbacv1.RoleBinding {
+		return &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              bindingName,
+				Namespace:         namespace,
+				CreationTimestamp: metav1.NewTime(now.Add(-age)),
+			},
+		}
+	}
+
+	bindings := []*rbacv1.RoleBinding{
+		// The addon still exists
+		binding("cluster1", time.Hour),
+		// The addon was removed
+		binding("cluster2", time.Hour),
+		// The addon may not be in the cache yet
+		binding("cluster3", time.Minute),
+	}
+
+	bindingIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	objects := []runtime.Object{}
+
+	for _, b := range bindings {
+		if err := bindingIndexer.Add(b); err != nil {
+			t.Fatal(err)
+		}
+
+		objects = append(objects, b)
+	}
+
+	addonIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	err := addonIndexer.Add(&addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Namespace: "cluster1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := fake.NewClientset(objects...)
+
+	c := &hubPermissionsCleanup{
+		kubeClient:    client,
+		bindingLister: rbaclistersv1.NewRoleBindingLister(bindingIndexer),
+		addonLister:   addonlistersv1beta1.NewManagedClusterAddOnLister(addonIndexer),
+		clock:         clocktesting.NewFakeClock(now),
+		addonName:     "config-policy-controller",
+		bindingName:   bindingName,
+	}
+
+	if err := c.sync(context.TODO(), nil, ""); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	for namespace, expectDeleted := range map[string]bool{"cluster1": false, "cluster2": true, "cluster3": false} {
+		_, err := client.RbacV1().RoleBindings(namespace).Get(context.TODO(), bindingName, metav1.GetOptions{})
+		if deleted := k8serrors.IsNotFound(err); deleted != expectDeleted {
+			t.Fatalf("expected the RoleBinding in %s to be deleted: %v, got error: %v", namespace, expectDeleted, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package addon
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	manifestsDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "policy_addon_manifests_duration_seconds",
+			Help:    "The time in seconds to generate the manifests of an addon for a managed cluster",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		},
+		[]string{"addon_name"},
+	)
+	manifestsErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "policy_addon_manifests_errors_total",
+			Help: "The number of times the manifests of an addon failed to be generated, excluding paused addons",
+		},
+		[]string{"addon_name"},
+	)
+	pausedAddons = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "policy_addon_paused",
+			Help: "The number of ManagedClusterAddOns of an addon with paused updates",
+		},
+		[]string{"addon_name"},
+	)
+	rejectedValues = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "policy_addon_rejected_values_total",
+			Help: "The number of times an annotation or customized variable value was newly rejected on a " +
+				"ManagedClusterAddOn",
+		},
+		[]string{"addon_name", "source", "key"},
+	)
+	permissionConfigErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "policy_addon_permission_config_errors_total",
+			Help: "The number of times the hub permissions of an addon failed to be applied for a managed cluster",
+		},
+		[]string{"addon_name"},
+	)
+	csrApprovals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "policy_addon_csr_approvals_total",
+			Help: "The number of CertificateSigningRequests of an addon that were approved",
+		},
+		[]string{"addon_name"},
+	)
+	agentHealth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "policy_addon_agents",
+			Help: "The number of ManagedClusterAddOns of an addon by the health of their agent",
+		},
+		[]string{"addon_name", "health"},
+	)
+	staleHubPermissions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "policy_addon_stale_hub_permissions",
+			Help: "The number of hub RoleBindings of an addon removed from a cluster which failed to be deleted",
+		},
+		[]string{"addon_name"},
+	)
+	oversizedManifests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "policy_addon_oversized_manifests_total",
+			Help: "The number of times the manifests of an addon started approaching or exceeding the " +
+				"ManifestWork size limit",
+		},
+		[]string{"addon_name"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		manifestsDuration,
+		manifestsErrors,
+		pausedAddons,
+		rejectedValues,
+		permissionConfigErrors,
+		csrApprovals,
+		agentHealth,
+		staleHubPermissions,
+		oversizedManifests,
+	)
+}
+
+// invalidValueErrors returns the InvalidValueErrors in the possibly joined error.
+func invalidValueErrors(err error) []*InvalidValueError {
+	if err == nil {
+		return nil
+	}
+
+	if invalidErr, ok := err.(*InvalidValueError); ok { //nolint:errorlint // Unwrapping would skip joined errors
+		return []*InvalidValueError{invalidErr}
+	}
+
+	if joined, ok := err.(interface{ Unwrap() []error }); ok { //nolint:errorlint // Joined errors are traversed
+		invalidErrs := []*InvalidValueError{}
+
+		for _, e := range joined.Unwrap() {
+			invalidErrs = append(invalidErrs, invalidValueErrors(e)...)
+		}
+
+		return invalidErrs
+	}
+
+	var invalidErr *InvalidValueError
+	if errors.As(err, &invalidErr) {
+		return []*InvalidValueError{invalidErr}
+	}
+
+	return nil
+}
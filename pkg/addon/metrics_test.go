@@ -0,0 +1,43 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestInvalidValueErrors(t *testing.T) {
+	qpsErr := &InvalidValueError{Source: AnnotationSource, Key: ClientQPSAnnotation, Err: ErrValueOutOfRange}
+	logErr := &InvalidValueError{Source: CustomizedVariableSource, Key: "logLevel", Err: ErrValueOutOfRange}
+
+	invalidErrs := invalidValueErrors(errors.Join(qpsErr, errors.Join(nil, logErr), errors.New("other")))
+	if len(invalidErrs) != 2 || invalidErrs[0] != qpsErr || invalidErrs[1] != logErr {
+		t.Fatalf("expected the two InvalidValueErrors, got: %v", invalidErrs)
+	}
+
+	wrapped := fmt.Errorf("wrapped: %w", qpsErr)
+	if invalidErrs := invalidValueErrors(wrapped); len(invalidErrs) != 1 || invalidErrs[0] != qpsErr {
+		t.Fatalf("expected the wrapped InvalidValueError, got: %v", invalidErrs)
+	}
+
+	if invalidErrs := invalidValueErrors(nil); len(invalidErrs) != 0 {
+		t.Fatalf("expected no InvalidValueErrors, got: %v", invalidErrs)
+	}
+}
+
+func TestSetPaused(t *testing.T) {
+	c := &pauseController{addonName: "test-addon", paused: sets.New[string]()}
+
+	c.setPaused("cluster1/test-addon", true)
+	c.setPaused("cluster2/test-addon", true)
+	c.setPaused("cluster1/test-addon", false)
+
+	if paused := testutil.ToFloat64(pausedAddons.WithLabelValues("test-addon")); paused != 1 {
+		t.Fatalf("expected 1 paused addon, got: %v", paused)
+	}
+}
@@ -0,0 +1,431 @@
+package addon
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/clock"
+	"open-cluster-management.io/addon-framework/pkg/addonmanager"
+	"open-cluster-management.io/addon-framework/pkg/addonmanager/constants"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonv1alpha1client "open-cluster-management.io/api/client/addon/clientset/versioned"
+	addoninformers "open-cluster-management.io/api/client/addon/informers/externalversions"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	workinformers "open-cluster-management.io/api/client/work/informers/externalversions"
+	worklistersv1 "open-cluster-management.io/api/client/work/listers/work/v1"
+	workv1 "open-cluster-management.io/api/work/v1"
+	"open-cluster-management.io/sdk-go/pkg/basecontroller/factory"
+	"open-cluster-management.io/sdk-go/pkg/patcher"
+)
+
+const (
+	// PolicyAddonPauseUntilAnnotation pauses updates to the addon until the RFC3339 timestamp in its value.
+	PolicyAddonPauseUntilAnnotation = "policy-addon-pause-until"
+
+	// PausedCondition is the ManagedClusterAddOn condition type reporting whether updates to the addon's
+	// ManifestWorks are paused.
+	PausedCondition         = "Paused"
+	PausedReason            = "PauseAnnotation"
+	HubPausedReason         = "HubPauseAnnotation"
+	ResumedReason           = "Resumed"
+	InvalidPauseUntilReason = "InvalidPauseUntil"
+	DeletingReason          = "AddonDeleting"
+)
+
+// PauseState describes whether updates to the ManifestWorks of an addon are paused.
+type PauseState struct {
+	Paused bool
+	// Until is when the pause expires. It is zero when the pause does not expire
+	// or when the addon is not paused.
+	Until   time.Time
+	Reason  string
+	Message string
+	// Err is set when the pause-until annotation could not be parsed.
+	Err error
+}
+
+// GetPauseState returns the pause state of the addon at the given time. The
+// annotations on the ClusterManagementAddOn pause the addon on every cluster
+// and take precedence over the annotations on the ManagedClusterAddOn. An
+// invalid annotation on the ClusterManagementAddOn is reported, but doesn't
+// resume the ManagedClusterAddOns paused by their own annotations. The
+// ClusterManagementAddOn may be nil. A ManagedClusterAddOn being deleted is
+// never paused, so that its pre-delete hook cleans up the agent.
+func GetPauseState(
+	addon *addonapiv1beta1.ManagedClusterAddOn, cma *addonapiv1beta1.ClusterManagementAddOn, now time.Time,
+) PauseState {
+	if !addon.DeletionTimestamp.IsZero() {
+		return PauseState{
+			Reason:  DeletingReason,
+			Message: "Updates to the addon ManifestWorks are not paused while the addon is deleted",
+		}
+	}
+
+	var invalid *PauseState
+
+	if cma != nil {
+		paused, until, err := pauseFromAnnotations(cma.GetAnnotations(), now)
+		if err != nil {
+			invalid = &PauseState{
+				Reason: InvalidPauseUntilReason,
+				Message: fmt.Sprintf("Ignoring the %s annotation on the ClusterManagementAddOn: %v",
+					PolicyAddonPauseUntilAnnotation, err),
+				Err: err,
+			}
+		}
+
+		if paused {
+			return PauseState{
+				Paused:  true,
+				Until:   until,
+				Reason:  HubPausedReason,
+				Message: pauseMessage("ClusterManagementAddOn", until),
+			}
+		}
+	}
+
+	paused, until, err := pauseFromAnnotations(addon.GetAnnotations(), now)
+	if err != nil && invalid == nil {
+		invalid = &PauseState{
+			Reason: InvalidPauseUntilReason,
+			Message: fmt.Sprintf("Ignoring the %s annotation on the ManagedClusterAddOn: %v",
+				PolicyAddonPauseUntilAnnotation, err),
+			Err: err,
+		}
+	}
+
+	if paused {
+		state := PauseState{
+			Paused:  true,
+			Until:   until,
+			Reason:  PausedReason,
+			Message: pauseMessage("ManagedClusterAddOn", until),
+		}
+
+		if invalid != nil {
+			state.Message += ". " + invalid.Message
+			state.Err = invalid.Err
+		}
+
+		return state
+	}
+
+	if invalid != nil {
+		return *invalid
+	}
+
+	return PauseState{
+		Reason:  ResumedReason,
+		Message: "Updates to the addon ManifestWorks are not paused",
+	}
+}
+
+// pauseFromAnnotations returns whether the annotations pause the addon at the
+// given time, and when that pause expires. The policy-addon-pause annotation
+// pauses the addon indefinitely, regardless of the policy-addon-pause-until
+// annotation.
+func pauseFromAnnotations(annotations map[string]string, now time.Time) (bool, time.Time, error) {
+	if annotations[PolicyAddonPauseAnnotation] == "true" {
+		return true, time.Time{}, nil
+	}
+
+	val, ok := annotations[PolicyAddonPauseUntilAnnotation]
+	if !ok {
+		return false, time.Time{}, nil
+	}
+
+	until, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("failed to parse the RFC3339 timestamp '%s': %w", val, err)
+	}
+
+	if !now.Before(until) {
+		return false, time.Time{}, nil
+	}
+
+	return true, until, nil
+}
+
+func pauseMessage(kind string, until time.Time) string {
+	if until.IsZero() {
+		return fmt.Sprintf("Updates to the addon ManifestWorks are paused by the %s annotation on the %s",
+			PolicyAddonPauseAnnotation, kind)
+	}
+
+	return fmt.Sprintf("Updates to the addon ManifestWorks are paused by the %s annotation on the %s until %s",
+		PolicyAddonPauseUntilAnnotation, kind, until.Format(time.RFC3339))
+}
+
+// pauseController reports the pause state of the ManagedClusterAddOns of an
+// addon in the Paused condition, and triggers the addon-framework to update
+// the ManifestWorks of an addon when it is resumed.
+type pauseController struct {
+	addonClient addonv1alpha1client.Interface
+	addonLister addonlistersv1beta1.ManagedClusterAddOnLister
+	cmaLister   addonlistersv1beta1.ClusterManagementAddOnLister
+	workLister  worklistersv1.ManifestWorkLister
+	mgr         addonmanager.AddonManager
+	clock       clock.Clock
+	addonName   string
+	// paused is the set of ManagedClusterAddOn keys with paused updates. It is
+	// only accessed by the single sync worker.
+	paused sets.Set[string]
+}
+
+// newAddonInformerFactory returns an informer factory for the
+// ManagedClusterAddOns and the ClusterManagementAddOn of the addon.
+func newAddonInformerFactory(
+	addonClient addonv1alpha1client.Interface, addonName string,
+) addoninformers.SharedInformerFactory {
+	// Only the ManagedClusterAddOns and the ClusterManagementAddOn of this addon are watched
+	return addoninformers.NewSharedInformerFactoryWithOptions(addonClient, 10*time.Minute,
+		addoninformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", addonName).String()
+		}),
+	)
+}
+
+// startPauseController starts the pause controller for the addon. The informer
+// factories must be started by the caller. The returned controller is also used
+// by the PolicyAgentAddon to check the pause state.
+func startPauseController(
+	ctx context.Context,
+	mgr addonmanager.AddonManager,
+	addonName string,
+	addonClient addonv1alpha1client.Interface,
+	addonInformerFactory addoninformers.SharedInformerFactory,
+	workInformerFactory workinformers.SharedInformerFactory,
+) *pauseController {
+	addonInformer := addonInformerFactory.Addon().V1beta1().ManagedClusterAddOns()
+	cmaInformer := addonInformerFactory.Addon().V1beta1().ClusterManagementAddOns()
+
+	c := &pauseController{
+		addonClient: addonClient,
+		addonLister: addonInformer.Lister(),
+		cmaLister:   cmaInformer.Lister(),
+		workLister:  workInformerFactory.Work().V1().ManifestWorks().Lister(),
+		mgr:         mgr,
+		clock:       clock.RealClock{},
+		addonName:   addonName,
+		paused:      sets.New[string](),
+	}
+
+	controller := factory.New().
+		WithSync(c.sync).
+		WithInformersQueueKeysFunc(
+			func(obj runtime.Object) []string {
+				key, _ := cache.MetaNamespaceKeyFunc(obj)
+
+				return []string{key}
+			},
+			addonInformer.Informer(),
+		).
+		WithInformersQueueKeysFunc(c.cmaQueueKeys, cmaInformer.Informer()).
+		ToController(addonName + "-pause-controller")
+
+	go controller.Run(ctx, 1)
+
+	return c
+}
+
+// cmaQueueKeys enqueues every ManagedClusterAddOn of the addon when its
+// ClusterManagementAddOn changes.
+func (c *pauseController) cmaQueueKeys(_ runtime.Object) []string {
+	addons, err := c.addonLister.List(labels.Everything())
+	if err != nil {
+		log.Error(err, "Failed to list the ManagedClusterAddOns")
+
+		return nil
+	}
+
+	keys := make([]string, 0, len(addons))
+
+	for _, addon := range addons {
+		keys = append(keys, addon.Namespace+"/"+addon.Name)
+	}
+
+	return keys
+}
+
+func (c *pauseController) sync(ctx context.Context, syncCtx factory.SyncContext, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil //nolint:nilerr // An invalid key can't be retried
+	}
+
+	addon, err := c.addonLister.ManagedClusterAddOns(namespace).Get(name)
+	if k8serrors.IsNotFound(err) {
+		c.setPaused(key, false)
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	cma, err := c.cmaLister.Get(name)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	now := c.clock.Now()
+	state := GetPauseState(addon, cma, now)
+
+	c.setPaused(key, state.Paused)
+
+	if !state.Until.IsZero() {
+		syncCtx.Queue().AddAfter(key, state.Until.Sub(now))
+	}
+
+	existing := meta.FindStatusCondition(addon.Status.Conditions, PausedCondition)
+	// Only report the condition once the addon has been paused or given an invalid pause
+	if existing == nil && !state.Paused && state.Err == nil {
+		return nil
+	}
+
+	status := metav1.ConditionFalse
+	if state.Paused {
+		status = metav1.ConditionTrue
+	}
+
+	newAddon := addon.DeepCopy()
+	meta.SetStatusCondition(&newAddon.Status.Conditions, metav1.Condition{
+		Type:    PausedCondition,
+		Status:  status,
+		Reason:  state.Reason,
+		Message: state.Message,
+	})
+
+	addonPatcher := patcher.NewPatcher[
+		*addonapiv1beta1.ManagedClusterAddOn,
+		addonapiv1beta1.ManagedClusterAddOnSpec,
+		addonapiv1beta1.ManagedClusterAddOnStatus](c.addonClient.AddonV1beta1().ManagedClusterAddOns(namespace))
+
+	if _, err := addonPatcher.PatchStatus(ctx, newAddon, newAddon.Status, addon.Status); err != nil {
+		return fmt.Errorf("failed to update the %s condition: %w", PausedCondition, err)
+	}
+
+	if existing != nil && existing.Status == metav1.ConditionTrue && !state.Paused {
+		log.Info("Resuming updates to the addon", "namespace", namespace, "name", name)
+
+		c.mgr.Trigger(namespace, name)
+	}
+
+	return nil
+}
+
+// setPaused records whether the ManagedClusterAddOn is paused in the paused
+// addons metric.
+func (c *pauseController) setPaused(key string, paused bool) {
+	if paused {
+		c.paused.Insert(key)
+	} else {
+		c.paused.Delete(key)
+	}
+
+	pausedAddons.WithLabelValues(c.addonName).Set(float64(c.paused.Len()))
+}
+
+// pauseState returns the current pause state of the addon.
+func (c *pauseController) pauseState(addon *addonapiv1beta1.ManagedClusterAddOn) (PauseState, error) {
+	cma, err := c.cmaLister.Get(addon.Name)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return PauseState{}, err
+	}
+
+	return GetPauseState(addon, cma, c.clock.Now()), nil
+}
+
+// deployedObjects returns the objects in the ManifestWorks of the addon, so
+// that the ManifestWorks of a paused addon are kept as they are, including the
+// edits made to them on the hub.
+func (c *pauseController) deployedObjects(addon *addonapiv1beta1.ManagedClusterAddOn) ([]runtime.Object, error) {
+	works, err := addonWorks(c.workLister, addon)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []runtime.Object{}
+
+	for _, work := range works {
+		for _, manifest := range work.Spec.Workload.Manifests {
+			obj := &unstructured.Unstructured{}
+			if err := obj.UnmarshalJSON(manifest.Raw); err != nil {
+				return nil, fmt.Errorf("failed to decode a manifest of the ManifestWork %s/%s: %w",
+					work.Namespace, work.Name, err)
+			}
+
+			objects = append(objects, obj)
+		}
+	}
+
+	return objects, nil
+}
+
+// addonWorks returns the ManifestWorks of the addon sorted by namespace and
+// name. The ManifestWorks of a hosted addon are also in the namespace of the
+// hosting cluster, labeled with the cluster name, so the labeled ManifestWorks
+// of the addons hosted on the cluster aren't included.
+func addonWorks(
+	workLister worklistersv1.ManifestWorkLister, addon *addonapiv1beta1.ManagedClusterAddOn,
+) ([]*workv1.ManifestWork, error) {
+	namespaceWorks, err := workLister.ManifestWorks(addon.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the ManifestWorks of the addon: %w", err)
+	}
+
+	works := []*workv1.ManifestWork{}
+
+	for _, work := range namespaceWorks {
+		addonNamespace, ok := work.Labels[addonapiv1beta1.AddonNamespaceLabelKey]
+		if ok && addonNamespace != addon.Namespace {
+			continue
+		}
+
+		works = append(works, work)
+	}
+
+	hostingClusterName := addon.GetAnnotations()[addonapiv1beta1.HostingClusterNameAnnotationKey]
+	if hostingClusterName != "" && hostingClusterName != addon.Namespace {
+		hostedWorks, err := workLister.ManifestWorks(hostingClusterName).List(labels.SelectorFromSet(labels.Set{
+			addonapiv1beta1.AddonNamespaceLabelKey: addon.Namespace,
+		}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the hosted ManifestWorks of the addon: %w", err)
+		}
+
+		works = append(works, hostedWorks...)
+	}
+
+	slices.SortFunc(works, func(a, b *workv1.ManifestWork) int {
+		return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+	})
+
+	return works, nil
+}
+
+// IsPreDeleteHookWork returns whether the ManifestWork is the pre-delete hook
+// ManifestWork of its addon, which is only applied when the addon is removed.
+func IsPreDeleteHookWork(work *workv1.ManifestWork) bool {
+	addonName := work.Labels[addonapiv1beta1.AddonLabelKey]
+
+	if addonNamespace, ok := work.Labels[addonapiv1beta1.AddonNamespaceLabelKey]; ok &&
+		work.Name == constants.PreDeleteHookHostingWorkName(addonNamespace, addonName) {
+		return true
+	}
+
+	return work.Name == constants.PreDeleteHookWorkName(addonName)
+}
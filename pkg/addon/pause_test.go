@@ -0,0 +1,274 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	worklistersv1 "open-cluster-management.io/api/client/work/listers/work/v1"
+	workv1 "open-cluster-management.io/api/work/v1"
+)
+
+func TestGetPauseState(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	addonWithAnnotations := func(annotations map[string]string) *addonapiv1beta1.ManagedClusterAddOn {
+		return &addonapiv1beta1.ManagedClusterAddOn{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+	}
+
+	tests := map[string]struct {
+		addon          *addonapiv1beta1.ManagedClusterAddOn
+		cma            *addonapiv1beta1.ClusterManagementAddOn
+		expectedPaused bool
+		expectedUntil  time.Time
+		expectedReason string
+		expectedErr    bool
+	}{
+		"not paused": {
+			addon:          addonWithAnnotations(nil),
+			expectedReason: ResumedReason,
+		},
+		"paused indefinitely": {
+			addon:          addonWithAnnotations(map[string]string{PolicyAddonPauseAnnotation: "true"}),
+			expectedPaused: true,
+			expectedReason: PausedReason,
+		},
+		"paused until a future time": {
+			addon: addonWithAnnotations(map[string]string{
+				PolicyAddonPauseUntilAnnotation: "2026-01-01T13:00:00Z",
+			}),
+			expectedPaused: true,
+			expectedUntil:  now.Add(time.Hour),
+			expectedReason: PausedReason,
+		},
+		"pause until has expired": {
+			addon: addonWithAnnotations(map[string]string{
+				PolicyAddonPauseUntilAnnotation: "2026-01-01T11:00:00Z",
+			}),
+			expectedReason: ResumedReason,
+		},
+		"invalid pause until is ignored": {
+			addon:          addonWithAnnotations(map[string]string{PolicyAddonPauseUntilAnnotation: "tomorrow"}),
+			expectedReason: InvalidPauseUntilReason,
+			expectedErr:    true,
+		},
+		"invalid hub-wide pause until keeps the addon paused": {
+			addon: addonWithAnnotations(map[string]string{PolicyAddonPauseAnnotation: "true"}),
+			cma: &addonapiv1beta1.ClusterManagementAddOn{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{PolicyAddonPauseUntilAnnotation: "tomorrow"},
+				},
+			},
+			expectedPaused: true,
+			expectedReason: PausedReason,
+			expectedErr:    true,
+		},
+		"invalid hub-wide pause until is ignored": {
+			addon: addonWithAnnotations(nil),
+			cma: &addonapiv1beta1.ClusterManagementAddOn{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{PolicyAddonPauseUntilAnnotation: "tomorrow"},
+				},
+			},
+			expectedReason: InvalidPauseUntilReason,
+			expectedErr:    true,
+		},
+		"deleted addon is not paused": {
+			addon: &addonapiv1beta1.ManagedClusterAddOn{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations:       map[string]string{PolicyAddonPauseAnnotation: "true"},
+					DeletionTimestamp: &metav1.Time{Time: now},
+				},
+			},
+			cma: &addonapiv1beta1.ClusterManagementAddOn{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{PolicyAddonPauseAnnotation: "true"}},
+			},
+			expectedReason: DeletingReason,
+		},
+		"hub-wide pause takes precedence": {
+			addon: addonWithAnnotations(map[string]string{
+				PolicyAddonPauseUntilAnnotation: "2026-01-01T13:00:00Z",
+			}),
+			cma: &addonapiv1beta1.ClusterManagementAddOn{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{PolicyAddonPauseAnnotation: "true"}},
+			},
+			expectedPaused: true,
+			expectedReason: HubPausedReason,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			state := GetPauseState(test.addon, test.cma, now)
+
+			if state.Paused != test.expectedPaused {
+				t.Fatalf("expected paused to be %v, got: %v", test.expectedPaused, state.Paused)
+			}
+
+			if !state.Until.Equal(test.expectedUntil) {
+				t.Fatalf("expected until to be %v, got: %v", test.expectedUntil, state.Until)
+			}
+
+			if state.Reason != test.expectedReason {
+				t.Fatalf("expected reason %s, got: %s", test.expectedReason, state.Reason)
+			}
+
+			if (state.Err != nil) != test.expectedErr {
+				t.Fatalf("expected an error to be reported: %v, got: %v", test.expectedErr, state.Err)
+			}
+		})
+	}
+}
+
+func TestPauseDeployedObjects(t *testing.T) {
+	manifest := func(kind, name string) workv1.Manifest {
+		return workv1.Manifest{RawExtension: runtime.RawExtension{
+			Raw: []byte(`{"apiVersion":"v1","kind":"` + kind + `","metadata":{"name":"` + name + `"}}`),
+		}}
+	}
+
+	works := []*workv1.ManifestWork{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "addon-config-policy-controller-deploy-1", Namespace: "cluster1"},
+			Spec: workv1.ManifestWorkSpec{Workload: workv1.ManifestsTemplate{
+				Manifests: []workv1.Manifest{manifest("ConfigMap", "edited")},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "addon-config-policy-controller-deploy-0", Namespace: "cluster1"},
+			Spec: workv1.ManifestWorkSpec{Workload: workv1.ManifestsTemplate{
+				Manifests: []workv1.Manifest{manifest("ServiceAccount", "agent")},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "addon-config-policy-controller-deploy-hosting-cluster1-0",
+				Namespace: "hosting",
+				Labels:    map[string]string{addonapiv1beta1.AddonNamespaceLabelKey: "cluster1"},
+			},
+			Spec: workv1.ManifestWorkSpec{Workload: workv1.ManifestsTemplate{
+				Manifests: []workv1.Manifest{manifest("Secret", "hosted")},
+			}},
+		},
+		{
+			// The ManifestWork of an addon hosted on cluster1
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "addon-config-policy-controller-deploy-hosting-cluster3-0",
+				Namespace: "cluster1",
+				Labels:    map[string]string{addonapiv1beta1.AddonNamespaceLabelKey: "cluster3"},
+			},
+			Spec: workv1.ManifestWorkSpec{Workload: workv1.ManifestsTemplate{
+				Manifests: []workv1.Manifest{manifest("Secret", "cluster3")},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "addon-config-policy-controller-deploy-0", Namespace: "cluster2"},
+			Spec: workv1.ManifestWorkSpec{Workload: workv1.ManifestsTemplate{
+				Manifests: []workv1.Manifest{manifest("ServiceAccount", "other")},
+			}},
+		},
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+
+	for _, work := range works {
+		if err := indexer.Add(work); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &pauseController{workLister: worklistersv1.NewManifestWorkLister(indexer)}
+
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Namespace: "cluster1"},
+	}
+
+	hostedAddon := addon.DeepCopy()
+	hostedAddon.Annotations = map[string]string{addonapiv1beta1.HostingClusterNameAnnotationKey: "hosting"}
+
+	tests := map[string]struct {
+		addon         *addonapiv1beta1.ManagedClusterAddOn
+		expectedNames []string
+	}{
+		"the manifests of the addon ManifestWorks are kept": {
+			addon:         addon,
+			expectedNames: []string{"agent", "edited"},
+		},
+		"the manifests of the hosted addon ManifestWorks are kept": {
+			addon:         hostedAddon,
+			expectedNames: []string{"agent", "edited", "hosted"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			objects, err := c.deployedObjects(test.addon)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+
+			names := []string{}
+
+			for _, obj := range objects {
+				accessor, err := meta.Accessor(obj)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				names = append(names, accessor.GetName())
+			}
+
+			if !slices.Equal(names, test.expectedNames) {
+				t.Fatalf("expected the objects %v, got: %v", test.expectedNames, names)
+			}
+		})
+	}
+}
+
+func TestIsPreDeleteHookWork(t *testing.T) {
+	tests := map[string]struct {
+		name     string
+		labels   map[string]string
+		expected bool
+	}{
+		"pre-delete hook ManifestWork": {
+			name:     "addon-config-policy-controller-pre-delete",
+			labels:   map[string]string{addonapiv1beta1.AddonLabelKey: "config-policy-controller"},
+			expected: true,
+		},
+		"hosted pre-delete hook ManifestWork": {
+			name: "addon-config-policy-controller-pre-delete-hosting-cluster1",
+			labels: map[string]string{
+				addonapiv1beta1.AddonLabelKey:          "config-policy-controller",
+				addonapiv1beta1.AddonNamespaceLabelKey: "cluster1",
+			},
+			expected: true,
+		},
+		"deploy ManifestWork": {
+			name:   "addon-config-policy-controller-deploy-0",
+			labels: map[string]string{addonapiv1beta1.AddonLabelKey: "config-policy-controller"},
+		},
+		"ManifestWork of another addon": {
+			name:   "addon-config-policy-controller-pre-delete",
+			labels: map[string]string{addonapiv1beta1.AddonLabelKey: "cert-policy-controller"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			work := &workv1.ManifestWork{ObjectMeta: metav1.ObjectMeta{Name: test.name, Labels: test.labels}}
+
+			if IsPreDeleteHookWork(work) != test.expected {
+				t.Fatalf("expected IsPreDeleteHookWork to be %v", test.expected)
+			}
+		})
+	}
+}
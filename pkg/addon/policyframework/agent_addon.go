@@ -3,20 +3,26 @@ package policyframework
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/openshift/library-go/pkg/controller/controllercmd"
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"open-cluster-management.io/addon-framework/pkg/addonfactory"
 	"open-cluster-management.io/addon-framework/pkg/addonmanager"
 	"open-cluster-management.io/addon-framework/pkg/agent"
 	"open-cluster-management.io/addon-framework/pkg/utils"
 	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
 	addonv1alpha1client "open-cluster-management.io/api/client/addon/clientset/versioned"
+	addoninformers "open-cluster-management.io/api/client/addon/informers/externalversions"
+	addonlistersv1alpha1 "open-cluster-management.io/api/client/addon/listers/addon/v1alpha1"
 	clusterv1client "open-cluster-management.io/api/client/cluster/clientset/versioned"
 	clusterv1informers "open-cluster-management.io/api/client/cluster/informers/externalversions"
 	clusterlistersv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
@@ -28,9 +34,14 @@ import (
 
 const (
 	addonName                   = "governance-policy-framework"
+	gatekeeperSyncAddonName     = "governance-policy-gatekeeper-sync"
 	onMulticlusterHubAnnotation = "addon.open-cluster-management.io/on-multicluster-hub"
 	// Should only be set when the hub cluster is imported in a global hub
 	syncPoliciesOnMulticlusterHubAnnotation = "policy.open-cluster-management.io/sync-policies-on-multicluster-hub"
+	imageEnvVar                             = "GOVERNANCE_POLICY_FRAMEWORK_ADDON_IMAGE"
+	imageKey                                = "governance_policy_framework_addon"
+	// hubRoleBindingName is the name of the RoleBinding granting the agent access in its cluster namespace
+	hubRoleBindingName = "open-cluster-management:policy-framework-hub"
 )
 
 type policyFrameworkUserValues struct {
@@ -39,6 +50,7 @@ type policyFrameworkUserValues struct {
 	SyncPoliciesOnMulticlusterHub bool `json:"syncPoliciesOnMulticlusterHub,string,omitempty"`
 	OnMulticlusterHub             bool `json:"onMulticlusterHub,string,omitempty"`
 	OrphanClusterNamespace        bool `json:"orphanClusterNamespace,string,omitempty"`
+	GatekeeperSyncDisabled        bool `json:"gatekeeperSyncDisabled,string,omitempty"`
 }
 
 var (
@@ -49,6 +61,9 @@ var (
 	//go:embed manifests/managedclusterchart/templates/_helpers.tpl
 	FS embed.FS
 
+	// defaultImages returns the default images of the agent, from the chart or the environment variable
+	defaultImages = policyaddon.NewDefaultImagesFunc(FS, "manifests/managedclusterchart", imageKey, imageEnvVar)
+
 	log = ctrl.Log.WithName("policyframework")
 
 	agentPermissionFiles = []string{
@@ -74,19 +89,36 @@ func getSkeletonValues() policyFrameworkUserValues {
 	}
 }
 
-func getValuesFromAnnotations(clusterClient clusterlistersv1.ManagedClusterLister) func(*clusterv1.ManagedCluster,
-	*addonapiv1beta1.ManagedClusterAddOn,
+func getSkeletonValuesFunc(
+	_ *clusterv1.ManagedCluster, _ *addonapiv1beta1.ManagedClusterAddOn,
 ) (addonfactory.Values, error) {
+	return addonfactory.JsonStructToValues(getSkeletonValues())
+}
+
+func getClusterValues(
+	clusterClient clusterlistersv1.ManagedClusterLister,
+	addonClient addonlistersv1alpha1.ManagedClusterAddOnLister,
+) addonfactory.GetValuesFunc {
 	return func(
 		cluster *clusterv1.ManagedCluster, addon *addonapiv1beta1.ManagedClusterAddOn,
 	) (addonfactory.Values, error) {
-		userValues := getSkeletonValues()
+		userValues := policyFrameworkUserValues{}
 
 		err := userValues.SetCommonValues(cluster, addon, clusterClient)
 		if err != nil {
 			return nil, err
 		}
 
+		// The Gatekeeper sync is handled by its own addon when it is enabled
+		_, err = addonClient.ManagedClusterAddOns(addon.Namespace).Get(gatekeeperSyncAddonName)
+		if !k8serrors.IsNotFound(err) {
+			if err != nil {
+				return nil, err
+			}
+
+			userValues.GatekeeperSyncDisabled = true
+		}
+
 		annotations := addon.GetAnnotations()
 		hostingClusterName := annotations[addonapiv1beta1.HostingClusterNameAnnotationKey]
 
@@ -100,6 +132,7 @@ func getValuesFromAnnotations(clusterClient clusterlistersv1.ManagedClusterListe
 
 		// The ManagedClusterAddOn's annotation has higher priority,
 		// though it'd be quite unusual to set conflicting values.
+		// These describe the cluster, so they are handled with the cluster values.
 		for _, annotations := range []map[string]string{cluster.GetAnnotations(), annotations} {
 			if val, ok := annotations[onMulticlusterHubAnnotation]; ok {
 				if strings.EqualFold(val, "true") {
@@ -118,62 +151,131 @@ func getValuesFromAnnotations(clusterClient clusterlistersv1.ManagedClusterListe
 			}
 		}
 
-		if err := userValues.SetCommonValuesFromAnnotations(addon); err != nil {
-			log.Error(err, "failed to set common values from annotations")
-		}
-
 		return addonfactory.JsonStructToValues(userValues)
 	}
 }
 
+func getValuesFromAnnotations(
+	_ *clusterv1.ManagedCluster, addon *addonapiv1beta1.ManagedClusterAddOn,
+) (addonfactory.Values, error) {
+	userValues := policyFrameworkUserValues{}
+
+	if err := userValues.setValuesFromAnnotations(addon); err != nil {
+		log.Error(err, "failed to set values from annotations")
+	}
+
+	return addonfactory.JsonStructToValues(userValues)
+}
+
+// setValuesFromAnnotations sets the values from the ManagedClusterAddOn
+// annotations. It returns an aggregated error of the rejected values.
+func (pfv *policyFrameworkUserValues) setValuesFromAnnotations(addon *addonapiv1beta1.ManagedClusterAddOn) error {
+	return errors.Join(pfv.SetCommonValuesFromAnnotations(addon), pfv.SetReplicasFromAnnotation(addon))
+}
+
 func getValuesFromCustomizedVariableValues(config addonapiv1beta1.AddOnDeploymentConfig) (addonfactory.Values, error) {
-	userValues := getSkeletonValues()
+	// Only the values set by the config are returned, so that they don't override the values of the layers below
+	userValues := policyFrameworkUserValues{}
 
-	userValuesMap, err := userValues.SetCommonValuesFromCustomizedVariables(config)
+	unknownValues, err := userValues.setValuesFromCustomizedVariables(config)
 	if err != nil {
-		log.Error(err, "error setting common addon values from customized variables")
+		log.Error(err, "error setting addon values from customized variables")
+	}
+
+	for key := range unknownValues {
+		log.Error(fmt.Errorf("unknown customized variable: %s", key), "unknown customized variable")
 	}
 
+	return addonfactory.JsonStructToValues(userValues)
+}
+
+// setValuesFromCustomizedVariables sets the values from the customized variables
+// in the deployment config. It returns a map with any unknown variables and an
+// aggregated error of the rejected values.
+func (pfv *policyFrameworkUserValues) setValuesFromCustomizedVariables(
+	config addonapiv1beta1.AddOnDeploymentConfig,
+) (map[string]string, error) {
+	userValuesMap, aggregateErr := pfv.SetCommonValuesFromCustomizedVariables(config)
+	unknownValues := map[string]string{}
+
 	variableToFuncMap := map[string]func(string) error{
+		"replicas": pfv.SetReplicas,
 		"orphanClusterNamespace": func(value string) error {
 			valBool, err := strconv.ParseBool(value)
 			if err != nil {
-				return err
+				return fmt.Errorf("failed to parse orphan cluster namespace boolean '%s' "+
+					"(falling back to the default value): %w", value, err)
 			}
 
-			userValues.OrphanClusterNamespace = valBool
+			pfv.OrphanClusterNamespace = valBool
 
 			return nil
 		},
 	}
 
-	for key, value := range userValuesMap {
-		if fn, ok := variableToFuncMap[key]; ok {
-			err := fn(value)
-			if err != nil {
-				log.Error(err, "error setting customized variable", "variable", key, "value", value)
-			}
-		} else {
-			log.Error(fmt.Errorf("unknown customized variable: %s", key), "unknown customized variable")
+	for _, key := range slices.Sorted(maps.Keys(userValuesMap)) {
+		fn, ok := variableToFuncMap[key]
+		if !ok {
+			unknownValues[key] = userValuesMap[key]
+
+			continue
+		}
+
+		if err := fn(userValuesMap[key]); err != nil {
+			aggregateErr = errors.Join(aggregateErr, &policyaddon.InvalidValueError{
+				Source: policyaddon.CustomizedVariableSource,
+				Key:    key,
+				Err:    err,
+			})
 		}
 	}
 
-	return addonfactory.JsonStructToValues(userValues)
+	images, err := defaultImages()
+	if err != nil {
+		return unknownValues, errors.Join(aggregateErr, err)
+	}
+
+	if err := pfv.SetImageFromDeploymentConfig(config, imageKey, images); err != nil {
+		aggregateErr = errors.Join(aggregateErr, err)
+	}
+
+	return unknownValues, aggregateErr
 }
 
-func GetAgentAddon(ctx context.Context, controllerContext *controllercmd.ControllerContext) (agent.AgentAddon, error) {
-	registrationOption := policyaddon.NewRegistrationOption(ctx,
-		controllerContext,
-		addonName,
-		agentPermissionFiles,
-		FS,
-		false)
+// ValidateConfiguration returns warnings for the unsupported annotations and
+// customized variables, and an aggregated error of the values rejected from the
+// ManagedClusterAddOn annotations and the deployment config.
+func ValidateConfiguration(
+	addon *addonapiv1beta1.ManagedClusterAddOn, config *addonapiv1beta1.AddOnDeploymentConfig,
+) ([]string, error) {
+	userValues := getSkeletonValues()
+	warnings := policyaddon.UnknownAnnotationWarnings(addon, policyaddon.ReplicasAnnotation)
+
+	err := userValues.setValuesFromAnnotations(addon)
+
+	if config != nil {
+		unknownValues, configErr := userValues.setValuesFromCustomizedVariables(*config)
+		warnings = append(warnings, policyaddon.UnknownVariableWarnings(addonName, unknownValues)...)
+		err = errors.Join(err, configErr, policyaddon.ValidateHostedInstallNamespace(*config, addon.Namespace))
+	}
+
+	return warnings, err
+}
 
+// GetAgentAddon returns the agent addon using new hub clients. The addons hosted
+// on a ManagedCluster are updated when the hosting cluster changes.
+func GetAgentAddon(
+	ctx context.Context, mgr addonmanager.AddonManager, controllerContext *controllercmd.ControllerContext,
+) (agent.AgentAddon, error) {
 	addonClient, err := addonv1alpha1client.NewForConfig(controllerContext.KubeConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve addon client: %w", err)
 	}
 
+	addonInformer := addoninformers.NewSharedInformerFactory(addonClient, 10*time.Minute).
+		Addon().V1alpha1().ManagedClusterAddOns()
+	go addonInformer.Informer().Run(ctx.Done())
+
 	clusterClient, err := clusterv1client.NewForConfig(controllerContext.KubeConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize a managed cluster client: %w", err)
@@ -183,53 +285,100 @@ func GetAgentAddon(ctx context.Context, controllerContext *controllercmd.Control
 		Cluster().V1().ManagedClusters()
 	go clusterInformer.Informer().Run(ctx.Done())
 
-	return addonfactory.NewAgentAddonFactory(addonName, FS, "manifests/managedclusterchart").
+	err = policyaddon.TriggerOnHostingClusterChange(ctx, mgr, addonName, addonClient, clusterInformer.Informer())
+	if err != nil {
+		return nil, err
+	}
+
+	return BuildAgentAddon(ctx, controllerContext, policyaddon.AgentAddonClients{
+		AddonClient:   addonClient,
+		ClusterClient: clusterClient,
+		ClusterLister: clusterInformer.Lister(),
+		AddonLister:   addonInformer.Lister(),
+	})
+}
+
+// BuildAgentAddon builds the agent addon using the provided hub clients.
+func BuildAgentAddon(
+	ctx context.Context,
+	controllerContext *controllercmd.ControllerContext,
+	clients policyaddon.AgentAddonClients,
+) (agent.AgentAddon, error) {
+	registrationOption := policyaddon.NewRegistrationOption(ctx,
+		controllerContext,
+		addonName,
+		agentPermissionFiles,
+		FS,
+		false)
+
+	values := GetAddonValues(clients)
+
+	agentAddon, err := addonfactory.NewAgentAddonFactory(addonName, FS, "manifests/managedclusterchart").
 		WithConfigGVRs(utils.AddOnDeploymentConfigGVR).
-		WithGetValuesFuncs(
-			getValuesFromAnnotations(clusterInformer.Lister()),
-			addonfactory.GetValuesFromAddonAnnotation,
-			addonfactory.GetAddOnDeploymentConfigValues(
-				utils.NewAddOnDeploymentConfigGetter(addonClient),
-				addonfactory.ToAddOnNodePlacementValues,
-				addonfactory.ToAddOnResourceRequirementsValues,
-				getValuesFromCustomizedVariableValues,
-			),
-			policyaddon.MandateValues,
-			mandateImageFromEnv,
-		).
-		WithManagedClusterClient(clusterClient).
+		WithGetValuesFuncs(values.GetValuesFuncs()...).
+		WithManagedClusterClient(clients.ClusterClient).
 		WithAgentRegistrationOption(registrationOption).
 		WithAgentInstallNamespace(
-			policyaddon.
-				CommonAgentInstallNamespaceFromDeploymentConfigFunc(utils.NewAddOnDeploymentConfigGetter(addonClient)),
+			policyaddon.CommonAgentInstallNamespaceFromDeploymentConfigFunc(ctx, addonName, clients.AddonClient),
 		).
 		WithScheme(policyaddon.Scheme).
 		WithAgentHostedModeEnabledOption().
+		WithAgentHealthProber(policyaddon.NewAgentHealthProber()).
 		BuildHelmAgentAddon()
+	if err != nil {
+		return nil, err
+	}
+
+	return &policyaddon.ValuesAgentAddon{AgentAddon: agentAddon, Values: values}, nil
+}
+
+// GetAddonValues returns the sources of the addon values using the provided hub
+// clients.
+func GetAddonValues(clients policyaddon.AgentAddonClients) *policyaddon.AddonValues {
+	return policyaddon.NewAddonValues().
+		Add(policyaddon.SkeletonLayer, "skeleton", getSkeletonValuesFunc).
+		Add(policyaddon.SkeletonLayer, "image-env", getImageValuesFromEnv).
+		Add(policyaddon.ClusterLayer, "cluster", getClusterValues(clients.ClusterLister, clients.AddonLister)).
+		AddDeploymentConfig("AddOnDeploymentConfig", addonfactory.GetAddOnDeploymentConfigValues(
+			utils.NewAddOnDeploymentConfigGetter(clients.AddonClient),
+			addonfactory.ToAddOnNodePlacementValues,
+			addonfactory.ToAddOnResourceRequirementsValues,
+			getValuesFromCustomizedVariableValues,
+		)).
+		Add(policyaddon.AnnotationLayer, "annotations", getValuesFromAnnotations).
+		Add(policyaddon.AnnotationLayer, "values-annotation", addonfactory.GetValuesFromAddonAnnotation).
+		Add(policyaddon.MandatedLayer, "uninstall", policyaddon.MandateValues)
 }
 
 func GetAndAddAgent(
 	ctx context.Context, mgr addonmanager.AddonManager, controllerContext *controllercmd.ControllerContext,
 ) error {
-	return policyaddon.GetAndAddAgent(ctx, mgr, addonName, controllerContext, GetAgentAddon)
+	err := policyaddon.GetAndAddAgent(ctx, mgr, addonName, controllerContext, GetAgentAddon, ValidateConfiguration)
+	if err != nil {
+		return err
+	}
+
+	return policyaddon.StartHubPermissionsCleanup(ctx, controllerContext, addonName, hubRoleBindingName)
 }
 
-// mandateImageFromEnv ensures that if the environment variable for the image is
-// set to a non-empty value, that value is used in the chart.
-func mandateImageFromEnv(
+// getImageValuesFromEnv sets the image from the environment variable, when it
+// is set to a non-empty value, as the default image of the fleet. The image
+// customized variable and the registry mirrors of a deployment config override
+// it for the clusters using that config.
+func getImageValuesFromEnv(
 	_ *clusterv1.ManagedCluster,
 	_ *addonapiv1beta1.ManagedClusterAddOn,
 ) (addonfactory.Values, error) {
 	values := addonfactory.Values{}
 
-	img := os.Getenv("GOVERNANCE_POLICY_FRAMEWORK_ADDON_IMAGE")
+	img := os.Getenv(imageEnvVar)
 	if img == "" {
 		return values, nil
 	}
 
 	values["global"] = map[string]any{
 		"imageOverrides": map[string]any{
-			"governance_policy_framework_addon": img,
+			imageKey: img,
 		},
 	}
 
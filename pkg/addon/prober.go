@@ -0,0 +1,101 @@
+package addon
+
+import (
+	"errors"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+	workv1 "open-cluster-management.io/api/work/v1"
+)
+
+// deploymentFeedback is the status of a Deployment from the status feedback of
+// a ManifestWork.
+type deploymentFeedback struct {
+	replicas          int64
+	readyReplicas     int64
+	availableReplicas int64
+}
+
+// getDeploymentFeedback returns the status of a Deployment from the status
+// feedback of a ManifestWork. The returned bool is false when there is no
+// feedback.
+func getDeploymentFeedback(status workv1.StatusFeedbackResult) (deploymentFeedback, bool) {
+	feedback := deploymentFeedback{}
+	found := false
+
+	for _, value := range status.Values {
+		if value.Value.Integer == nil {
+			continue
+		}
+
+		switch value.Name {
+		case "Replicas":
+			feedback.replicas = *value.Value.Integer
+			found = true
+		case "ReadyReplicas":
+			feedback.readyReplicas = *value.Value.Integer
+		case "AvailableReplicas":
+			feedback.availableReplicas = *value.Value.Integer
+		}
+	}
+
+	return feedback, found
+}
+
+// NewAgentHealthProber returns a health prober setting the Available condition
+// of the ManagedClusterAddOn from the status feedback of the agent Deployments,
+// so that a crash-looping agent is unavailable without waiting for its lease to
+// expire.
+func NewAgentHealthProber() *agent.HealthProber {
+	return &agent.HealthProber{
+		Type: agent.HealthProberTypeWork,
+		WorkProber: &agent.WorkHealthProber{
+			ProbeFields: []agent.ProbeField{{
+				ResourceIdentifier: workv1.ResourceIdentifier{
+					Group:     appsv1.GroupName,
+					Resource:  "deployments",
+					Name:      "*",
+					Namespace: "*",
+				},
+				// The well known status of a Deployment has its replicas, ready replicas, and available replicas
+				ProbeRules: []workv1.FeedbackRule{{Type: workv1.WellKnownStatusType}},
+			}},
+			HealthChecker: AgentDeploymentHealthChecker,
+		},
+	}
+}
+
+// AgentDeploymentHealthChecker returns an error describing the agent
+// Deployments without any available replica, such as when the agent is
+// crash-looping. A Deployment scaled to zero is not checked, and neither is a
+// Deployment whose status isn't reported yet, since it is still pending rather
+// than failing. The addon-framework sets the Available condition to Unknown
+// when no Deployment status is reported.
+func AgentDeploymentHealthChecker(
+	results []agent.FieldResult, _ *clusterv1.ManagedCluster, _ *addonapiv1beta1.ManagedClusterAddOn,
+) error {
+	var errs error
+
+	for _, result := range results {
+		identifier := result.ResourceIdentifier
+
+		feedback, ok := getDeploymentFeedback(result.FeedbackResult)
+		if !ok {
+			continue
+		}
+
+		if feedback.replicas == 0 || feedback.availableReplicas > 0 {
+			continue
+		}
+
+		errs = errors.Join(errs, fmt.Errorf(
+			"the Deployment %s/%s has no available replicas (%d of %d ready), its pods may be crash-looping",
+			identifier.Namespace, identifier.Name, feedback.readyReplicas, feedback.replicas,
+		))
+	}
+
+	return errs
+}
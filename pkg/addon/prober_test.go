@@ -0,0 +1,73 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"testing"
+
+	"k8s.io/utils/ptr"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	workv1 "open-cluster-management.io/api/work/v1"
+)
+
+func TestAgentDeploymentHealthChecker(t *testing.T) {
+	fieldResult := func(values map[string]int64) agent.FieldResult {
+		result := agent.FieldResult{
+			ResourceIdentifier: workv1.ResourceIdentifier{
+				Group:     "apps",
+				Resource:  "deployments",
+				Namespace: "open-cluster-management-agent-addon",
+				Name:      "config-policy-controller",
+			},
+		}
+
+		for name, value := range values {
+			result.FeedbackResult.Values = append(result.FeedbackResult.Values,
+				workv1.FeedbackValue{Name: name, Value: workv1.FieldValue{Integer: ptr.To(value)}})
+		}
+
+		return result
+	}
+
+	tests := map[string]struct {
+		results     []agent.FieldResult
+		expectedErr string
+	}{
+		"available": {
+			results: []agent.FieldResult{fieldResult(map[string]int64{
+				"Replicas": 2, "ReadyReplicas": 1, "AvailableReplicas": 1,
+			})},
+		},
+		"scaled to zero": {
+			results: []agent.FieldResult{fieldResult(map[string]int64{"Replicas": 0})},
+		},
+		"crash-looping": {
+			results: []agent.FieldResult{fieldResult(map[string]int64{
+				"Replicas": 1, "ReadyReplicas": 0, "AvailableReplicas": 0,
+			})},
+			expectedErr: "the Deployment open-cluster-management-agent-addon/config-policy-controller has no " +
+				"available replicas (0 of 1 ready), its pods may be crash-looping",
+		},
+		"no feedback yet": {
+			results: []agent.FieldResult{fieldResult(map[string]int64{})},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := AgentDeploymentHealthChecker(test.results, nil, nil)
+
+			if test.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || err.Error() != test.expectedErr {
+				t.Fatalf("expected error %q, got: %v", test.expectedErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package addon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+const (
+	// RegistrationDriverAnnotation is the ClusterManagementAddOn annotation selecting how the addon agents
+	// authenticate to the hub.
+	RegistrationDriverAnnotation = "policy-addon-registration-driver"
+
+	// CSRRegistrationDriver registers the addon agents with client certificates issued from CSRs.
+	CSRRegistrationDriver = "csr"
+	// TokenRegistrationDriver registers the addon agents with hub ServiceAccount tokens.
+	TokenRegistrationDriver = "token"
+)
+
+// ErrAgentUserNotReported is returned when the addon agent registered with a
+// token has not reported its hub user yet, so its hub permissions can't be bound.
+var ErrAgentUserNotReported = errors.New("the addon agent has not reported its hub user")
+
+// driverKubeClientRegistration is a kubeClient registration requesting the
+// authentication driver of the addon agent.
+type driverKubeClientRegistration struct {
+	agent.KubeClientRegistration
+	Driver string
+}
+
+func (r *driverKubeClientRegistration) RegistrationAPI() addonapiv1beta1.RegistrationConfig {
+	registration := r.KubeClientRegistration.RegistrationAPI()
+
+	if r.Driver != "" {
+		if registration.KubeClient == nil {
+			registration.KubeClient = &addonapiv1beta1.KubeClientConfig{}
+		}
+
+		registration.KubeClient.Driver = r.Driver
+	}
+
+	return registration
+}
+
+// GetRegistrationDriver returns the registration driver configured with the
+// annotation of the ClusterManagementAddOn. An empty string lets the klusterlet
+// use its default driver.
+func GetRegistrationDriver(cma *addonapiv1beta1.ClusterManagementAddOn) (string, error) {
+	if cma == nil {
+		return "", nil
+	}
+
+	switch driver := cma.Annotations[RegistrationDriverAnnotation]; driver {
+	case "", CSRRegistrationDriver, TokenRegistrationDriver:
+		return driver, nil
+	default:
+		return "", fmt.Errorf("the %s annotation has an invalid value %q, expected %s or %s",
+			RegistrationDriverAnnotation, driver, CSRRegistrationDriver, TokenRegistrationDriver)
+	}
+}
+
+// registrationConfigurations returns the kubeClient registration of the addon
+// agent with the driver configured on the ClusterManagementAddOn. The token
+// driver isn't supported when the hub permissions are shared by all the
+// clusters, since they're bound to the default group of the addon.
+func registrationConfigurations(
+	addonName string,
+	getCMALister func() (addonlistersv1beta1.ClusterManagementAddOnLister, error),
+	useClusterRole bool,
+) agent.RegistrationConfigurationsFunc {
+	return func(
+		_ context.Context, cluster *clusterv1.ManagedCluster, _ *addonapiv1beta1.ManagedClusterAddOn,
+	) ([]agent.RegistrationConfig, error) {
+		cmaLister, err := getCMALister()
+		if err != nil {
+			return nil, err
+		}
+
+		cma, err := cmaLister.Get(addonName)
+		if err != nil {
+			if !k8serrors.IsNotFound(err) {
+				return nil, fmt.Errorf("failed to get the ClusterManagementAddOn %s: %w", addonName, err)
+			}
+
+			cma = nil
+		}
+
+		driver, err := GetRegistrationDriver(cma)
+		if err != nil {
+			return nil, err
+		}
+
+		if driver == TokenRegistrationDriver && useClusterRole {
+			return nil, fmt.Errorf("the %s registration driver is not supported by the addon %s",
+				TokenRegistrationDriver, addonName)
+		}
+
+		return []agent.RegistrationConfig{
+			&driverKubeClientRegistration{
+				KubeClientRegistration: agent.KubeClientRegistration{
+					User:   agent.DefaultUser(cluster.Name, addonName, addonName),
+					Groups: agent.DefaultGroups(cluster.Name, addonName),
+				},
+				Driver: driver,
+			},
+		}, nil
+	}
+}
+
+// tokenAgentUser returns the hub user reported by the addon agent when it's
+// registered with a token, which is its ServiceAccount on the hub.
+func tokenAgentUser(addon *addonapiv1beta1.ManagedClusterAddOn) (user string, token bool) {
+	for _, registration := range addon.Status.Registrations {
+		if registration.Type != addonapiv1beta1.KubeClient || registration.KubeClient == nil {
+			continue
+		}
+
+		if registration.KubeClient.Driver == TokenRegistrationDriver {
+			return registration.KubeClient.Subject.User, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,100 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+func TestRegistrationConfigurations(t *testing.T) {
+	cma := func(driver string) []runtime.Object {
+		return []runtime.Object{&addonapiv1beta1.ClusterManagementAddOn{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "config-policy-controller",
+				Annotations: map[string]string{RegistrationDriverAnnotation: driver},
+			},
+		}}
+	}
+
+	tests := map[string]struct {
+		objects        []runtime.Object
+		useClusterRole bool
+		expectedDriver string
+		expectedErr    string
+	}{
+		"no ClusterManagementAddOn": {},
+		"csr driver": {
+			objects:        cma(CSRRegistrationDriver),
+			expectedDriver: CSRRegistrationDriver,
+		},
+		"token driver": {
+			objects:        cma(TokenRegistrationDriver),
+			expectedDriver: TokenRegistrationDriver,
+		},
+		"token driver with shared permissions": {
+			objects:        cma(TokenRegistrationDriver),
+			useClusterRole: true,
+			expectedErr:    "the token registration driver is not supported by the addon config-policy-controller",
+		},
+		"invalid driver": {
+			objects: cma("password"),
+			expectedErr: `the policy-addon-registration-driver annotation has an invalid value "password", ` +
+				"expected csr or token",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cmaIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			for _, obj := range test.objects {
+				if err := cmaIndexer.Add(obj); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cmaLister := addonlistersv1beta1.NewClusterManagementAddOnLister(cmaIndexer)
+			configurations := registrationConfigurations("config-policy-controller",
+				func() (addonlistersv1beta1.ClusterManagementAddOnLister, error) { return cmaLister, nil },
+				test.useClusterRole)
+
+			configs, err := configurations(context.TODO(),
+				&clusterv1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster1"}}, nil)
+
+			if test.expectedErr != "" {
+				if err == nil || err.Error() != test.expectedErr {
+					t.Fatalf("expected error %q, got: %v", test.expectedErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+
+			if len(configs) != 1 {
+				t.Fatalf("expected one registration, got: %v", configs)
+			}
+
+			registration := configs[0].RegistrationAPI()
+			if registration.Type != addonapiv1beta1.KubeClient || registration.KubeClient.Driver != test.expectedDriver {
+				t.Fatalf("expected a kubeClient registration with the driver %q, got: %v",
+					test.expectedDriver, registration)
+			}
+
+			expectedUser := "system:open-cluster-management:cluster:cluster1:addon:config-policy-controller:" +
+				"agent:config-policy-controller"
+			if registration.KubeClient.Subject.User != expectedUser {
+				t.Fatalf("expected the user %s, got: %s", expectedUser, registration.KubeClient.Subject.User)
+			}
+		})
+	}
+}
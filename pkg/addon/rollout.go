@@ -0,0 +1,567 @@
+package addon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+	"open-cluster-management.io/addon-framework/pkg/addonmanager"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addoninformers "open-cluster-management.io/api/client/addon/informers/externalversions"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	workinformers "open-cluster-management.io/api/client/work/informers/externalversions"
+	worklistersv1 "open-cluster-management.io/api/client/work/listers/work/v1"
+	workv1 "open-cluster-management.io/api/work/v1"
+)
+
+const (
+	// RolloutMaxConcurrencyAnnotation on the ClusterManagementAddOn enables the progressive rollout of agent
+	// images, and sets how many clusters, or what percentage of clusters, can be updating at once.
+	RolloutMaxConcurrencyAnnotation = "policy-addon-rollout-max-concurrency"
+	// RolloutMaxFailuresAnnotation on the ClusterManagementAddOn sets how many updated clusters, or what
+	// percentage of clusters, can be unavailable before the rollout is paused. It defaults to 0.
+	RolloutMaxFailuresAnnotation = "policy-addon-rollout-max-failures"
+
+	// ImageRolloutCondition is the ManagedClusterAddOn condition type reporting whether the agent images are
+	// updated on the cluster when a rollout strategy is set.
+	ImageRolloutCondition = "ImageRollout"
+	ImageUpdatedReason    = "Updated"
+	ImagePendingReason    = "Pending"
+	RolloutPausedReason   = "RolloutPaused"
+)
+
+// ErrInvalidRolloutStrategy is returned when the rollout annotations on the
+// ClusterManagementAddOn can't be parsed.
+var ErrInvalidRolloutStrategy = errors.New("invalid rollout strategy")
+
+// RolloutStrategy limits how many clusters receive new agent images at once.
+type RolloutStrategy struct {
+	MaxConcurrency intstr.IntOrString
+	MaxFailures    intstr.IntOrString
+}
+
+// GetRolloutStrategy returns the image rollout strategy set in the annotations
+// of the ClusterManagementAddOn, or nil when new images are rolled out to every
+// cluster at once. The ClusterManagementAddOn may be nil.
+func GetRolloutStrategy(cma *addonapiv1beta1.ClusterManagementAddOn) (*RolloutStrategy, error) {
+	maxConcurrency, ok := cma.GetAnnotations()[RolloutMaxConcurrencyAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	strategy := &RolloutStrategy{
+		MaxConcurrency: intstr.Parse(maxConcurrency),
+		MaxFailures:    intstr.FromInt32(0),
+	}
+
+	if maxFailures, ok := cma.GetAnnotations()[RolloutMaxFailuresAnnotation]; ok {
+		strategy.MaxFailures = intstr.Parse(maxFailures)
+	}
+
+	// Validate the values with an arbitrary number of clusters
+	concurrency, failures, err := strategy.scaledValues(100)
+	if err != nil {
+		return nil, err
+	}
+
+	if concurrency < 1 || failures < 0 {
+		return nil, fmt.Errorf("%w: the %s annotation must be positive and the %s annotation can't be negative",
+			ErrInvalidRolloutStrategy, RolloutMaxConcurrencyAnnotation, RolloutMaxFailuresAnnotation)
+	}
+
+	return strategy, nil
+}
+
+// limits returns the maximum number of clusters updating at once, which is at
+// least 1, and the maximum number of unavailable updated clusters for the
+// total number of clusters.
+func (s *RolloutStrategy) limits(total int) (int, int, error) {
+	concurrency, failures, err := s.scaledValues(total)
+
+	return max(concurrency, 1), failures, err
+}
+
+// scaledValues returns the concurrency, rounded up, and the failures, rounded
+// down, for the total number of clusters.
+func (s *RolloutStrategy) scaledValues(total int) (int, int, error) {
+	concurrency, err := intstr.GetScaledValueFromIntOrPercent(&s.MaxConcurrency, total, true)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %s: %w", ErrInvalidRolloutStrategy, RolloutMaxConcurrencyAnnotation, err)
+	}
+
+	failures, err := intstr.GetScaledValueFromIntOrPercent(&s.MaxFailures, total, false)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %s: %w", ErrInvalidRolloutStrategy, RolloutMaxFailuresAnnotation, err)
+	}
+
+	return concurrency, failures, nil
+}
+
+// containerImages are the images of the Deployment containers, by the
+// Deployment namespace and name and the container name.
+type containerImages map[string]string
+
+func containerKey(namespace, name, container string) string {
+	return namespace + "/" + name + "/" + container
+}
+
+// includes returns whether every container image in other is the same in ci.
+func (ci containerImages) includes(other containerImages) bool {
+	for key, image := range other {
+		if ci[key] != image {
+			return false
+		}
+	}
+
+	return true
+}
+
+func deploymentImages(objects []runtime.Object) containerImages {
+	images := containerImages{}
+
+	for _, obj := range objects {
+		deployment, ok := obj.(*appsv1.Deployment)
+		if !ok {
+			continue
+		}
+
+		podSpec := deployment.Spec.Template.Spec
+
+		for _, container := range slices.Concat(podSpec.InitContainers, podSpec.Containers) {
+			images[containerKey(deployment.Namespace, deployment.Name, container.Name)] = container.Image
+		}
+	}
+
+	return images
+}
+
+// manifestDeployment is the subset of a Deployment manifest needed to get its images.
+type manifestDeployment struct {
+	metav1.TypeMeta `json:",inline"`
+	Metadata        struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		Template struct {
+			Spec struct {
+				InitContainers []corev1.Container `json:"initContainers"`
+				Containers     []corev1.Container `json:"containers"`
+			} `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+}
+
+// workState is the state of the agent Deployments in the ManifestWorks of an
+// addon on a cluster.
+type workState struct {
+	images containerImages
+	// applied is whether the latest spec of every ManifestWork was applied.
+	applied bool
+}
+
+// cachedWorkImages caches the images parsed from a ManifestWork version.
+type cachedWorkImages struct {
+	resourceVersion string
+	images          containerImages
+}
+
+// imageRollout holds back new agent images on clusters according to the
+// rollout strategy of the addon.
+type imageRollout struct {
+	addonName   string
+	addonLister addonlistersv1beta1.ManagedClusterAddOnLister
+	cmaLister   addonlistersv1beta1.ClusterManagementAddOnLister
+	workLister  worklistersv1.ManifestWorkLister
+	mgr         addonmanager.AddonManager
+
+	lock sync.Mutex
+	// admitted are the images each cluster was allowed to update to, until its ManifestWorks are updated.
+	admitted map[string]containerImages
+	// held are the clusters with image updates held back, which are triggered when the rollout progresses.
+	held       sets.Set[string]
+	imageCache map[string]cachedWorkImages
+}
+
+// newImageRollout returns the image rollout for the addon. The informer
+// factories must be started by the caller.
+func newImageRollout(
+	mgr addonmanager.AddonManager,
+	addonName string,
+	addonInformerFactory addoninformers.SharedInformerFactory,
+	workInformerFactory workinformers.SharedInformerFactory,
+) (*imageRollout, error) {
+	addonInformer := addonInformerFactory.Addon().V1beta1().ManagedClusterAddOns()
+	cmaInformer := addonInformerFactory.Addon().V1beta1().ClusterManagementAddOns()
+	workInformer := workInformerFactory.Work().V1().ManifestWorks()
+
+	r := &imageRollout{
+		addonName:   addonName,
+		addonLister: addonInformer.Lister(),
+		cmaLister:   cmaInformer.Lister(),
+		workLister:  workInformer.Lister(),
+		mgr:         mgr,
+		admitted:    map[string]containerImages{},
+		held:        sets.New[string](),
+		imageCache:  map[string]cachedWorkImages{},
+	}
+
+	// The rollout can progress when the availability of an addon or the status of a ManifestWork changes
+	handlers := []struct {
+		informer cache.SharedIndexInformer
+		changed  func(oldObj, newObj any) bool
+	}{
+		{addonInformer.Informer(), availabilityChanged},
+		{workInformer.Informer(), workStatusChanged},
+		{cmaInformer.Informer(), func(_, _ any) bool { return true }},
+	}
+
+	for _, handler := range handlers {
+		_, err := handler.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj any) {
+				if handler.changed(oldObj, newObj) {
+					r.triggerHeld()
+				}
+			},
+			DeleteFunc: func(_ any) { r.triggerHeld() },
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to add the image rollout event handler: %w", err)
+		}
+	}
+
+	_, err := workInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{DeleteFunc: r.evictWorkImages})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add the image rollout event handler: %w", err)
+	}
+
+	return r, nil
+}
+
+// evictWorkImages removes the cached images of a deleted ManifestWork.
+func (r *imageRollout) evictWorkImages(obj any) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	work, ok := obj.(*workv1.ManifestWork)
+	if !ok {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.imageCache, work.Namespace+"/"+work.Name)
+}
+
+func availabilityChanged(oldObj, newObj any) bool {
+	oldAddon, ok := oldObj.(*addonapiv1beta1.ManagedClusterAddOn)
+	if !ok {
+		return true
+	}
+
+	newAddon, ok := newObj.(*addonapiv1beta1.ManagedClusterAddOn)
+	if !ok {
+		return true
+	}
+
+	oldCondition := meta.FindStatusCondition(oldAddon.Status.Conditions, addonapiv1beta1.ManagedClusterAddOnConditionAvailable)
+	newCondition := meta.FindStatusCondition(newAddon.Status.Conditions, addonapiv1beta1.ManagedClusterAddOnConditionAvailable)
+
+	if oldCondition == nil || newCondition == nil {
+		return oldCondition != newCondition
+	}
+
+	return oldCondition.Status != newCondition.Status
+}
+
+func workStatusChanged(oldObj, newObj any) bool {
+	oldWork, ok := oldObj.(*workv1.ManifestWork)
+	if !ok {
+		return true
+	}
+
+	newWork, ok := newObj.(*workv1.ManifestWork)
+	if !ok {
+		return true
+	}
+
+	return workApplied(oldWork) != workApplied(newWork)
+}
+
+func workApplied(work *workv1.ManifestWork) bool {
+	condition := meta.FindStatusCondition(work.Status.Conditions, workv1.WorkApplied)
+
+	return condition != nil && condition.Status == metav1.ConditionTrue &&
+		condition.ObservedGeneration == work.Generation
+}
+
+// triggerHeld triggers the addon-framework to regenerate the manifests of the
+// clusters with held back images.
+func (r *imageRollout) triggerHeld() {
+	r.lock.Lock()
+	held := r.held.UnsortedList()
+	r.held.Clear()
+	r.lock.Unlock()
+
+	for _, clusterName := range held {
+		r.mgr.Trigger(clusterName, r.addonName)
+	}
+}
+
+// worksByCluster returns the ManifestWorks of the addon agent by cluster name,
+// excluding the pre-delete hook manifests which are only applied when the addon
+// is removed. The ManifestWorks of a hosted addon are in the namespace of the
+// hosting cluster, and are labeled with the cluster name.
+func worksByCluster(works []*workv1.ManifestWork) map[string][]*workv1.ManifestWork {
+	clusterWorks := map[string][]*workv1.ManifestWork{}
+
+	for _, work := range works {
+		if IsPreDeleteHookWork(work) {
+			continue
+		}
+
+		clusterName := work.Namespace
+		if addonNamespace, ok := work.Labels[addonapiv1beta1.AddonNamespaceLabelKey]; ok {
+			clusterName = addonNamespace
+		}
+
+		clusterWorks[clusterName] = append(clusterWorks[clusterName], work)
+	}
+
+	return clusterWorks
+}
+
+// workStates returns the state of the agent Deployments in the ManifestWorks of
+// the addon, by cluster name.
+func (r *imageRollout) workStates() (map[string]*workState, error) {
+	works, err := r.workLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the ManifestWorks: %w", err)
+	}
+
+	states := map[string]*workState{}
+
+	for clusterName, clusterWorks := range worksByCluster(works) {
+		state := &workState{images: containerImages{}, applied: true}
+		states[clusterName] = state
+
+		for _, work := range clusterWorks {
+			state.applied = state.applied && workApplied(work)
+
+			for key, image := range r.workImages(work) {
+				state.images[key] = image
+			}
+		}
+	}
+
+	return states, nil
+}
+
+func (r *imageRollout) workImages(work *workv1.ManifestWork) containerImages {
+	cacheKey := work.Namespace + "/" + work.Name
+
+	if cached, ok := r.imageCache[cacheKey]; ok && cached.resourceVersion == work.ResourceVersion {
+		return cached.images
+	}
+
+	images := containerImages{}
+
+	for _, manifest := range work.Spec.Workload.Manifests {
+		deployment := manifestDeployment{}
+		if err := json.Unmarshal(manifest.Raw, &deployment); err != nil || deployment.Kind != "Deployment" {
+			continue
+		}
+
+		podSpec := deployment.Spec.Template.Spec
+
+		for _, container := range slices.Concat(podSpec.InitContainers, podSpec.Containers) {
+			key := containerKey(deployment.Metadata.Namespace, deployment.Metadata.Name, container.Name)
+			images[key] = container.Image
+		}
+	}
+
+	r.imageCache[cacheKey] = cachedWorkImages{resourceVersion: work.ResourceVersion, images: images}
+
+	return images
+}
+
+// holdBackImages replaces the images of the rendered Deployments with the
+// images applied on the cluster when the rollout strategy doesn't allow the
+// cluster to update its images yet, and reports the ImageRollout condition on
+// the addon.
+func (r *imageRollout) holdBackImages(addon *addonapiv1beta1.ManagedClusterAddOn, objects []runtime.Object) error {
+	cma, err := r.cmaLister.Get(addon.Name)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	strategy, err := GetRolloutStrategy(cma)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if strategy == nil {
+		delete(r.admitted, addon.Namespace)
+		r.held.Delete(addon.Namespace)
+		meta.RemoveStatusCondition(&addon.Status.Conditions, ImageRolloutCondition)
+
+		return nil
+	}
+
+	states, err := r.workStates()
+	if err != nil {
+		return err
+	}
+
+	desired := deploymentImages(objects)
+	current, deployed := states[addon.Namespace]
+
+	// New clusters are installed with the desired images, and only the images of existing containers are rolled out
+	if !deployed || r.imagesUpdated(current.images, desired) {
+		delete(r.admitted, addon.Namespace)
+		r.held.Delete(addon.Namespace)
+		setImageRolloutCondition(addon, metav1.ConditionTrue, ImageUpdatedReason,
+			"The agent images are updated on the cluster")
+
+		return nil
+	}
+
+	if admitted, ok := r.admitted[addon.Namespace]; ok && admitted.includes(desired) && desired.includes(admitted) {
+		setImageRolloutCondition(addon, metav1.ConditionTrue, ImageUpdatedReason,
+			"The agent images are being updated on the cluster")
+
+		return nil
+	}
+
+	addons, err := r.addonLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list the ManagedClusterAddOns: %w", err)
+	}
+
+	maxConcurrency, maxFailures, err := strategy.limits(len(addons))
+	if err != nil {
+		return err
+	}
+
+	updating, failed := r.progress(addons, states, desired)
+
+	switch {
+	case failed > maxFailures:
+		log.Info("Pausing the image rollout since too many updated clusters are unavailable",
+			"addon", r.addonName, "unavailable", failed, "maxFailures", maxFailures)
+
+		setImageRolloutCondition(addon, metav1.ConditionFalse, RolloutPausedReason, fmt.Sprintf(
+			"The image rollout is paused since %d updated clusters are unavailable, more than the maximum of %d",
+			failed, maxFailures))
+	case updating >= maxConcurrency:
+		setImageRolloutCondition(addon, metav1.ConditionFalse, ImagePendingReason, fmt.Sprintf(
+			"Waiting for %d clusters to finish updating their agent images before updating this cluster", updating))
+	default:
+		r.admitted[addon.Namespace] = desired
+		r.held.Delete(addon.Namespace)
+		setImageRolloutCondition(addon, metav1.ConditionTrue, ImageUpdatedReason,
+			"The agent images are being updated on the cluster")
+
+		return nil
+	}
+
+	r.held.Insert(addon.Namespace)
+	replaceImages(objects, current.images)
+
+	return nil
+}
+
+// imagesUpdated returns whether the current images are the desired images for
+// every container that is deployed.
+func (r *imageRollout) imagesUpdated(current, desired containerImages) bool {
+	for key, image := range desired {
+		if currentImage, ok := current[key]; ok && currentImage != image {
+			return false
+		}
+	}
+
+	return true
+}
+
+// progress returns the number of other clusters updating to the desired
+// images, and how many of those are unavailable.
+func (r *imageRollout) progress(
+	addons []*addonapiv1beta1.ManagedClusterAddOn, states map[string]*workState, desired containerImages,
+) (updating int, failed int) {
+	for _, addon := range addons {
+		state, deployed := states[addon.Namespace]
+		updated := deployed && state.images.includes(desired)
+
+		if updated && state.applied {
+			delete(r.admitted, addon.Namespace)
+		}
+
+		admitted, isAdmitted := r.admitted[addon.Namespace]
+		if !updated && !(isAdmitted && admitted.includes(desired)) {
+			continue
+		}
+
+		available := meta.FindStatusCondition(addon.Status.Conditions,
+			addonapiv1beta1.ManagedClusterAddOnConditionAvailable)
+
+		switch {
+		case available != nil && available.Status == metav1.ConditionFalse:
+			failed++
+			updating++
+		case !updated || !state.applied || available == nil || available.Status != metav1.ConditionTrue:
+			updating++
+		}
+	}
+
+	return updating, failed
+}
+
+// replaceImages sets the images of the Deployment containers to the given
+// images, for the containers which have one.
+func replaceImages(objects []runtime.Object, images containerImages) {
+	for _, obj := range objects {
+		deployment, ok := obj.(*appsv1.Deployment)
+		if !ok {
+			continue
+		}
+
+		podSpec := &deployment.Spec.Template.Spec
+
+		for _, containers := range [][]corev1.Container{podSpec.InitContainers, podSpec.Containers} {
+			for i := range containers {
+				key := containerKey(deployment.Namespace, deployment.Name, containers[i].Name)
+				if image, ok := images[key]; ok {
+					containers[i].Image = image
+				}
+			}
+		}
+	}
+}
+
+func setImageRolloutCondition(
+	addon *addonapiv1beta1.ManagedClusterAddOn, status metav1.ConditionStatus, reason, message string,
+) {
+	meta.SetStatusCondition(&addon.Status.Conditions, metav1.Condition{
+		Type:    ImageRolloutCondition,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
@@ -0,0 +1,259 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	worklistersv1 "open-cluster-management.io/api/client/work/listers/work/v1"
+	workv1 "open-cluster-management.io/api/work/v1"
+)
+
+func TestGetRolloutStrategy(t *testing.T) {
+	tests := map[string]struct {
+		annotations         map[string]string
+		expectedConcurrency int
+		expectedFailures    int
+		expectedErr         bool
+		expectedNil         bool
+	}{
+		"no annotations": {
+			expectedNil: true,
+		},
+		"batch size": {
+			annotations:         map[string]string{RolloutMaxConcurrencyAnnotation: "5"},
+			expectedConcurrency: 5,
+		},
+		"percentages": {
+			annotations: map[string]string{
+				RolloutMaxConcurrencyAnnotation: "1%",
+				RolloutMaxFailuresAnnotation:    "3%",
+			},
+			expectedConcurrency: 1,
+		},
+		"zero concurrency": {
+			annotations: map[string]string{RolloutMaxConcurrencyAnnotation: "0"},
+			expectedErr: true,
+		},
+		"invalid percentage": {
+			annotations: map[string]string{
+				RolloutMaxConcurrencyAnnotation: "10%",
+				RolloutMaxFailuresAnnotation:    "a%",
+			},
+			expectedErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cma := &addonapiv1beta1.ClusterManagementAddOn{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-addon", Annotations: test.annotations},
+			}
+
+			strategy, err := GetRolloutStrategy(cma)
+			if test.expectedErr {
+				if !errors.Is(err, ErrInvalidRolloutStrategy) {
+					t.Fatalf("expected an ErrInvalidRolloutStrategy error, got: %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+
+			if test.expectedNil {
+				if strategy != nil {
+					t.Fatalf("expected no strategy, got: %+v", strategy)
+				}
+
+				return
+			}
+
+			// Percentages of 20 clusters round the concurrency up and the failures down
+			concurrency, failures, err := strategy.limits(20)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+
+			if concurrency != test.expectedConcurrency || failures != test.expectedFailures {
+				t.Fatalf("expected limits %d and %d, got: %d and %d",
+					test.expectedConcurrency, test.expectedFailures, concurrency, failures)
+			}
+		})
+	}
+}
+
+func testDeployment(image string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "open-cluster-management-agent-addon"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "manager", Image: image}},
+		}}},
+	}
+}
+
+func TestHoldBackImages(t *testing.T) {
+	addonIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	workIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	cmaIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	err := cmaIndexer.Add(&addonapiv1beta1.ClusterManagementAddOn{ObjectMeta: metav1.ObjectMeta{
+		Name:        "test-addon",
+		Annotations: map[string]string{RolloutMaxConcurrencyAnnotation: "1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := json.Marshal(testDeployment("agent:old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, clusterName := range []string{"cluster1", "cluster2", "cluster3"} {
+		addon := &addonapiv1beta1.ManagedClusterAddOn{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-addon", Namespace: clusterName},
+		}
+		meta.SetStatusCondition(&addon.Status.Conditions, metav1.Condition{
+			Type:   addonapiv1beta1.ManagedClusterAddOnConditionAvailable,
+			Status: metav1.ConditionTrue,
+		})
+
+		work := &workv1.ManifestWork{
+			ObjectMeta: metav1.ObjectMeta{Name: "addon-test-addon-deploy-0", Namespace: clusterName},
+			Spec: workv1.ManifestWorkSpec{Workload: workv1.ManifestsTemplate{
+				Manifests: []workv1.Manifest{{RawExtension: runtime.RawExtension{Raw: raw}}},
+			}},
+		}
+		meta.SetStatusCondition(&work.Status.Conditions, metav1.Condition{
+			Type:   workv1.WorkApplied,
+			Status: metav1.ConditionTrue,
+		})
+
+		if err := addonIndexer.Add(addon); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := workIndexer.Add(work); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &imageRollout{
+		addonName:   "test-addon",
+		addonLister: addonlistersv1beta1.NewManagedClusterAddOnLister(addonIndexer),
+		cmaLister:   addonlistersv1beta1.NewClusterManagementAddOnLister(cmaIndexer),
+		workLister:  worklistersv1.NewManifestWorkLister(workIndexer),
+		admitted:    map[string]containerImages{},
+		held:        sets.New[string](),
+		imageCache:  map[string]cachedWorkImages{},
+	}
+
+	holdBackImages := func(clusterName string) (string, *metav1.Condition) {
+		t.Helper()
+
+		addon := &addonapiv1beta1.ManagedClusterAddOn{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-addon", Namespace: clusterName},
+		}
+		deployment := testDeployment("agent:new")
+
+		if err := r.holdBackImages(addon, []runtime.Object{deployment}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		return deployment.Spec.Template.Spec.Containers[0].Image,
+			meta.FindStatusCondition(addon.Status.Conditions, ImageRolloutCondition)
+	}
+
+	image, condition := holdBackImages("cluster1")
+	if image != "agent:new" || condition.Status != metav1.ConditionTrue {
+		t.Fatalf("expected the first cluster to be updated, got %s and condition: %+v", image, condition)
+	}
+
+	image, condition = holdBackImages("cluster2")
+	if image != "agent:old" || condition.Reason != ImagePendingReason || !r.held.Has("cluster2") {
+		t.Fatalf("expected the second cluster to be held back, got %s and condition: %+v", image, condition)
+	}
+
+	// Regenerating the manifests of an admitted cluster keeps the new images
+	image, _ = holdBackImages("cluster1")
+	if image != "agent:new" {
+		t.Fatalf("expected the admitted cluster to keep the new image, got %s", image)
+	}
+
+	// Once the first cluster is updated but unavailable, the rollout is paused
+	updatedRaw, err := json.Marshal(testDeployment("agent:new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	work := &workv1.ManifestWork{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "addon-test-addon-deploy-0", Namespace: "cluster1", ResourceVersion: "2",
+		},
+		Spec: workv1.ManifestWorkSpec{Workload: workv1.ManifestsTemplate{
+			Manifests: []workv1.Manifest{{RawExtension: runtime.RawExtension{Raw: updatedRaw}}},
+		}},
+	}
+	meta.SetStatusCondition(&work.Status.Conditions, metav1.Condition{
+		Type: workv1.WorkApplied, Status: metav1.ConditionTrue,
+	})
+
+	unavailable := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-addon", Namespace: "cluster1"},
+	}
+	meta.SetStatusCondition(&unavailable.Status.Conditions, metav1.Condition{
+		Type:   addonapiv1beta1.ManagedClusterAddOnConditionAvailable,
+		Status: metav1.ConditionFalse,
+	})
+
+	if err := workIndexer.Update(work); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := addonIndexer.Update(unavailable); err != nil {
+		t.Fatal(err)
+	}
+
+	image, condition = holdBackImages("cluster2")
+	if image != "agent:old" || condition.Reason != RolloutPausedReason {
+		t.Fatalf("expected the rollout to be paused, got %s and condition: %+v", image, condition)
+	}
+
+	// When the first cluster is available again, the next cluster can update
+	if err := addonIndexer.Update(&addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-addon", Namespace: "cluster1"},
+		Status: addonapiv1beta1.ManagedClusterAddOnStatus{Conditions: []metav1.Condition{{
+			Type:   addonapiv1beta1.ManagedClusterAddOnConditionAvailable,
+			Status: metav1.ConditionTrue,
+		}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	image, condition = holdBackImages("cluster2")
+	if image != "agent:new" || condition.Status != metav1.ConditionTrue {
+		t.Fatalf("expected the second cluster to be updated, got %s and condition: %+v", image, condition)
+	}
+
+	// The cached images of a deleted ManifestWork are evicted
+	r.evictWorkImages(cache.DeletedFinalStateUnknown{Key: "cluster1/addon-test-addon-deploy-0", Obj: work})
+
+	if _, ok := r.imageCache["cluster1/addon-test-addon-deploy-0"]; ok {
+		t.Fatal("expected the images of the deleted ManifestWork to be evicted from the cache")
+	}
+}
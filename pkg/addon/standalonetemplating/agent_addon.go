@@ -49,13 +49,6 @@ func getValues(
 }
 
 func getAgentAddon(ctx context.Context, controllerContext *controllercmd.ControllerContext) (agent.AgentAddon, error) {
-	registrationOption := policyaddon.NewRegistrationOption(ctx,
-		controllerContext,
-		addonName,
-		agentPermissionFiles,
-		FS,
-		true)
-
 	addonClient, err := addonv1alpha1client.NewForConfig(controllerContext.KubeConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve addon client: %w", err)
@@ -66,23 +59,56 @@ func getAgentAddon(ctx context.Context, controllerContext *controllercmd.Control
 		return nil, fmt.Errorf("failed to initialize a managed cluster client: %w", err)
 	}
 
-	return addonfactory.NewAgentAddonFactory(addonName, FS, "manifests/managedclusterchart").
+	return BuildAgentAddon(ctx, controllerContext, policyaddon.AgentAddonClients{
+		AddonClient:   addonClient,
+		ClusterClient: clusterClient,
+	})
+}
+
+// BuildAgentAddon builds the agent addon using the provided hub clients.
+func BuildAgentAddon(
+	ctx context.Context,
+	controllerContext *controllercmd.ControllerContext,
+	clients policyaddon.AgentAddonClients,
+) (agent.AgentAddon, error) {
+	registrationOption := policyaddon.NewRegistrationOption(ctx,
+		controllerContext,
+		addonName,
+		agentPermissionFiles,
+		FS,
+		true)
+
+	values := GetAddonValues(clients)
+
+	agentAddon, err := addonfactory.NewAgentAddonFactory(addonName, FS, "manifests/managedclusterchart").
 		WithConfigGVRs(utils.AddOnDeploymentConfigGVR).
-		WithGetValuesFuncs(
-			addonfactory.GetAddOnDeploymentConfigValues(
-				utils.NewAddOnDeploymentConfigGetter(addonClient),
-				addonfactory.ToAddOnNodePlacementValues,
-				addonfactory.ToAddOnCustomizedVariableValues,
-			),
-			getValues).
-		WithManagedClusterClient(clusterClient).
+		WithGetValuesFuncs(values.GetValuesFuncs()...).
+		WithManagedClusterClient(clients.ClusterClient).
 		WithAgentRegistrationOption(registrationOption).
 		WithAgentInstallNamespace(
-			policyaddon.
-				CommonAgentInstallNamespaceFromDeploymentConfigFunc(utils.NewAddOnDeploymentConfigGetter(addonClient)),
+			policyaddon.CommonAgentInstallNamespaceFromDeploymentConfigFunc(ctx, addonName, clients.AddonClient),
 		).
 		WithAgentHostedModeEnabledOption().
 		BuildHelmAgentAddon()
+	if err != nil {
+		return nil, err
+	}
+
+	return &policyaddon.ValuesAgentAddon{AgentAddon: agentAddon, Values: values}, nil
+}
+
+// GetAddonValues returns the sources of the addon values using the provided hub
+// clients. This addon has no typed values, so the customized variables of the
+// AddOnDeploymentConfig are passed to the chart as is.
+func GetAddonValues(clients policyaddon.AgentAddonClients) *policyaddon.AddonValues {
+	return policyaddon.NewAddonValues().
+		AddDeploymentConfig("AddOnDeploymentConfig", addonfactory.GetAddOnDeploymentConfigValues(
+			utils.NewAddOnDeploymentConfigGetter(clients.AddonClient),
+			addonfactory.ToAddOnNodePlacementValues,
+			addonfactory.ToAddOnCustomizedVariableValues,
+		)).
+		Add(policyaddon.MandatedLayer, "hub-group", getValues).
+		Add(policyaddon.MandatedLayer, "uninstall", policyaddon.MandateValues)
 }
 
 type StandaloneAgentAddon struct {
@@ -0,0 +1,229 @@
+package addon
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"open-cluster-management.io/addon-framework/pkg/addonfactory"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+// ValuesLayer is a level of the values precedence of the governance addons.
+// Values from a higher layer override the values from the layers below it.
+type ValuesLayer int
+
+const (
+	// SkeletonLayer are the defaults of the addon which aren't in its Helm chart.
+	SkeletonLayer ValuesLayer = iota
+	// ClusterLayer are the values derived from the ManagedCluster and the hub, such as the cluster vendor.
+	ClusterLayer
+	// DefaultDeploymentConfigLayer is the AddOnDeploymentConfig from the default config or an install strategy
+	// placement of the ClusterManagementAddOn.
+	DefaultDeploymentConfigLayer
+	// ClusterDeploymentConfigLayer is the AddOnDeploymentConfig set in the configs of the ManagedClusterAddOn.
+	// Only one of the deployment config layers has values for an addon.
+	ClusterDeploymentConfigLayer
+	// AnnotationLayer are the ManagedClusterAddOn annotations.
+	AnnotationLayer
+	// MandatedLayer are the values set regardless of user overrides.
+	MandatedLayer
+)
+
+var valuesLayerNames = map[ValuesLayer]string{
+	SkeletonLayer:                "skeleton",
+	ClusterLayer:                 "cluster",
+	DefaultDeploymentConfigLayer: "default-deployment-config",
+	ClusterDeploymentConfigLayer: "deployment-config",
+	AnnotationLayer:              "annotations",
+	MandatedLayer:                "mandated",
+}
+
+func (l ValuesLayer) String() string {
+	if name, ok := valuesLayerNames[l]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("layer-%d", int(l))
+}
+
+// ValueOrigin is a merged value and the source which set it.
+type ValueOrigin struct {
+	Value  any
+	Layer  ValuesLayer
+	Source string
+}
+
+// String returns the layer and the source name, such as "annotations/annotations".
+func (o ValueOrigin) String() string {
+	return o.Layer.String() + "/" + o.Source
+}
+
+// FormatProvenance returns a line for each value with its origin, sorted by
+// path, such as `logLevel: 2  # annotations/annotations`. The values are JSON
+// encoded.
+func FormatProvenance(origins map[string]ValueOrigin) (string, error) {
+	var builder strings.Builder
+
+	for _, path := range slices.Sorted(maps.Keys(origins)) {
+		value, err := json.Marshal(origins[path].Value)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode the %s value: %w", path, err)
+		}
+
+		fmt.Fprintf(&builder, "%s: %s  # %s\n", path, value, origins[path])
+	}
+
+	return builder.String(), nil
+}
+
+type valuesSource struct {
+	layer     ValuesLayer
+	name      string
+	getValues addonfactory.GetValuesFunc
+}
+
+// AddonValues assembles the Helm values of an addon from the sources added at
+// each layer, so that every addon applies the same precedence.
+type AddonValues struct {
+	sources []valuesSource
+}
+
+// ValuesProvider is implemented by agent addons built from AddonValues.
+type ValuesProvider interface {
+	AddonValues() *AddonValues
+}
+
+// ValuesAgentAddon is an agent addon built from AddonValues, so that the origin
+// of its values can be reported.
+type ValuesAgentAddon struct {
+	agent.AgentAddon
+	Values *AddonValues
+}
+
+// AddonValues returns the sources of the addon values.
+func (va *ValuesAgentAddon) AddonValues() *AddonValues {
+	return va.Values
+}
+
+// NewAddonValues returns an AddonValues without any sources.
+func NewAddonValues() *AddonValues {
+	return &AddonValues{}
+}
+
+// Add adds a source of values at the layer. Sources at the same layer are
+// applied in the order they are added.
+func (av *AddonValues) Add(layer ValuesLayer, name string, getValues addonfactory.GetValuesFunc) *AddonValues {
+	av.sources = append(av.sources, valuesSource{layer: layer, name: name, getValues: getValues})
+
+	return av
+}
+
+// AddDeploymentConfig adds the values from the AddOnDeploymentConfig at the
+// DefaultDeploymentConfigLayer or the ClusterDeploymentConfigLayer, depending
+// on where the config is set, so that the provenance tells them apart. Both are
+// below the annotations.
+func (av *AddonValues) AddDeploymentConfig(name string, getValues addonfactory.GetValuesFunc) *AddonValues {
+	defaultValues, clusterValues := DeploymentConfigValuesFuncs(getValues)
+
+	return av.Add(DefaultDeploymentConfigLayer, name, defaultValues).
+		Add(ClusterDeploymentConfigLayer, name, clusterValues)
+}
+
+func (av *AddonValues) orderedSources() []valuesSource {
+	return slices.SortedStableFunc(slices.Values(av.sources), func(a, b valuesSource) int {
+		return int(a.layer) - int(b.layer)
+	})
+}
+
+// GetValuesFuncs returns the functions to pass to the addonfactory, from the
+// lowest to the highest precedence.
+func (av *AddonValues) GetValuesFuncs() []addonfactory.GetValuesFunc {
+	sources := av.orderedSources()
+	funcs := make([]addonfactory.GetValuesFunc, 0, len(sources))
+
+	for _, source := range sources {
+		funcs = append(funcs, source.getValues)
+	}
+
+	return funcs
+}
+
+// Provenance returns the merged values for the addon on the cluster, and each
+// value with its origin by its dot-separated path. A value's origin is the
+// highest precedence source which changed it, so a source repeating a lower
+// value doesn't take ownership of it. The built-in values of the addonfactory,
+// such as the install namespace, aren't included.
+func (av *AddonValues) Provenance(
+	cluster *clusterv1.ManagedCluster, addon *addonapiv1beta1.ManagedClusterAddOn,
+) (addonfactory.Values, map[string]ValueOrigin, error) {
+	merged := addonfactory.Values{}
+	origins := map[string]ValueOrigin{}
+
+	for _, source := range av.orderedSources() {
+		values, err := source.getValues(cluster, addon)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get the %s values from the %s layer: %w",
+				source.name, source.layer, err)
+		}
+
+		current := flattenValues(merged)
+
+		for path, value := range flattenValues(values) {
+			if currentValue, ok := current[path]; ok && equality.Semantic.DeepEqual(currentValue, value) {
+				continue
+			}
+
+			origins[path] = ValueOrigin{Layer: source.layer, Source: source.name}
+		}
+
+		merged = addonfactory.MergeValues(merged, values)
+	}
+
+	// Remove the origins of nested values replaced by a value which isn't a map
+	final := flattenValues(merged)
+	for path, origin := range origins {
+		value, ok := final[path]
+		if !ok {
+			delete(origins, path)
+
+			continue
+		}
+
+		origin.Value = value
+		origins[path] = origin
+	}
+
+	return merged, origins, nil
+}
+
+// flattenValues returns the values which aren't maps by their dot-separated
+// path.
+func flattenValues(values map[string]any) map[string]any {
+	flattened := map[string]any{}
+
+	var flatten func(prefix []string, values map[string]any)
+
+	flatten = func(prefix []string, values map[string]any) {
+		for key, value := range values {
+			path := append(slices.Clone(prefix), key)
+
+			if nested, ok := value.(map[string]any); ok && len(nested) != 0 {
+				flatten(path, nested)
+
+				continue
+			}
+
+			flattened[strings.Join(path, ".")] = value
+		}
+	}
+
+	flatten(nil, values)
+
+	return flattened
+}
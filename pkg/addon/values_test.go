@@ -0,0 +1,124 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"errors"
+	"testing"
+
+	"open-cluster-management.io/addon-framework/pkg/addonfactory"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+func staticValues(values addonfactory.Values) addonfactory.GetValuesFunc {
+	return func(*clusterv1.ManagedCluster, *addonapiv1beta1.ManagedClusterAddOn) (addonfactory.Values, error) {
+		return values, nil
+	}
+}
+
+func TestAddonValuesProvenance(t *testing.T) {
+	// The sources are added out of order to check that the layers determine the precedence
+	values := NewAddonValues().
+		Add(MandatedLayer, "mandated", staticValues(addonfactory.Values{"uninstall": "true"})).
+		Add(AnnotationLayer, "annotations", staticValues(addonfactory.Values{
+			"logLevel": 2,
+			"global":   map[string]any{"imagePullPolicy": "IfNotPresent"},
+		})).
+		Add(SkeletonLayer, "skeleton", staticValues(addonfactory.Values{
+			"logLevel": 0,
+			"global":   map[string]any{"imagePullPolicy": "IfNotPresent", "imagePullSecret": "secret"},
+		})).
+		Add(ClusterLayer, "cluster", staticValues(addonfactory.Values{"uninstall": "false"}))
+
+	merged, origins, err := values.Provenance(&clusterv1.ManagedCluster{}, &addonapiv1beta1.ManagedClusterAddOn{})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if merged["logLevel"] != 2 || merged["uninstall"] != "true" {
+		t.Fatalf("expected the higher layers to override the lower ones, got: %v", merged)
+	}
+
+	expected := map[string]ValueOrigin{
+		"logLevel":               {Value: 2, Layer: AnnotationLayer, Source: "annotations"},
+		"uninstall":              {Value: "true", Layer: MandatedLayer, Source: "mandated"},
+		"global.imagePullSecret": {Value: "secret", Layer: SkeletonLayer, Source: "skeleton"},
+		// Repeating a lower value doesn't change its origin
+		"global.imagePullPolicy": {Value: "IfNotPresent", Layer: SkeletonLayer, Source: "skeleton"},
+	}
+
+	if len(origins) != len(expected) {
+		t.Fatalf("expected %d origins, got: %v", len(expected), origins)
+	}
+
+	for path, origin := range expected {
+		if origins[path] != origin {
+			t.Fatalf("expected the origin of %s to be %+v, got: %+v", path, origin, origins[path])
+		}
+	}
+
+	funcs := values.GetValuesFuncs()
+	if len(funcs) != 4 {
+		t.Fatalf("expected 4 values functions, got: %d", len(funcs))
+	}
+
+	first, _ := funcs[0](nil, nil)
+	if first["logLevel"] != 0 {
+		t.Fatalf("expected the skeleton values first, got: %v", first)
+	}
+}
+
+func TestAddonValuesDeploymentConfigBelowAnnotations(t *testing.T) {
+	configReferent := addonapiv1beta1.ConfigReferent{Namespace: "open-cluster-management", Name: "edge-config"}
+	configGroupResource := addonapiv1beta1.ConfigGroupResource{
+		Group:    "addon.open-cluster-management.io",
+		Resource: "addondeploymentconfigs",
+	}
+
+	// The config is set on the ManagedClusterAddOn, which used to take precedence over the annotations
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		Spec: addonapiv1beta1.ManagedClusterAddOnSpec{
+			Configs: []addonapiv1beta1.AddOnConfig{{
+				ConfigGroupResource: configGroupResource,
+				ConfigReferent:      configReferent,
+			}},
+		},
+		Status: addonapiv1beta1.ManagedClusterAddOnStatus{
+			ConfigReferences: []addonapiv1beta1.ConfigReference{{
+				ConfigGroupResource: configGroupResource,
+				DesiredConfig:       &addonapiv1beta1.ConfigSpecHash{ConfigReferent: configReferent, SpecHash: "hash"},
+			}},
+		},
+	}
+
+	values := NewAddonValues().
+		Add(AnnotationLayer, "annotations", staticValues(addonfactory.Values{"logLevel": 2})).
+		AddDeploymentConfig("AddOnDeploymentConfig", staticValues(addonfactory.Values{"logLevel": 3, "clientQPS": 20}))
+
+	merged, origins, err := values.Provenance(&clusterv1.ManagedCluster{}, addon)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if merged["logLevel"] != 2 || merged["clientQPS"] != 20 {
+		t.Fatalf("expected the annotations to override the deployment config, got: %v", merged)
+	}
+
+	if origins["clientQPS"].Layer != ClusterDeploymentConfigLayer {
+		t.Fatalf("expected the clientQPS origin to be the deployment config, got: %v", origins["clientQPS"])
+	}
+}
+
+func TestAddonValuesProvenanceError(t *testing.T) {
+	errTest := errors.New("test error")
+
+	values := NewAddonValues().Add(ClusterLayer, "cluster",
+		func(*clusterv1.ManagedCluster, *addonapiv1beta1.ManagedClusterAddOn) (addonfactory.Values, error) {
+			return nil, errTest
+		})
+
+	if _, _, err := values.Provenance(nil, nil); !errors.Is(err, errTest) {
+		t.Fatalf("expected the source error, got: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package addon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	addonapiv1alpha1 "open-cluster-management.io/api/addon/v1alpha1"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addoninformers "open-cluster-management.io/api/client/addon/informers/externalversions"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	clusterv1informers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	clusterlistersv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+	"open-cluster-management.io/sdk-go/pkg/basecontroller/factory"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// ValuesReportSuffix is appended to the addon name for the name of the ConfigMap reporting its values.
+	ValuesReportSuffix = "-values"
+	// ValuesReportValuesKey is the ConfigMap key of the merged Helm values.
+	ValuesReportValuesKey = "values.yaml"
+	// ValuesReportProvenanceKey is the ConfigMap key of each value with the layer and source which set it.
+	ValuesReportProvenanceKey = "provenance"
+
+	valuesReportResyncInterval = 10 * time.Minute
+)
+
+// ReportValues sets whether the values of each ManagedClusterAddOn are
+// reported in a ConfigMap in the cluster namespace on the hub.
+var ReportValues = true
+
+// valuesReporter writes the values of each ManagedClusterAddOn, and where they
+// came from, to a ConfigMap next to it on the hub. The report is written by its
+// own controller rather than when the manifests are generated, since rendering
+// the provenance of every value is only needed when the inputs change.
+type valuesReporter struct {
+	client        kubernetes.Interface
+	values        *AddonValues
+	addonName     string
+	addonLister   addonlistersv1beta1.ManagedClusterAddOnLister
+	clusterLister clusterlistersv1.ManagedClusterLister
+
+	// reported is the hash of the data last written to each ConfigMap, by namespace and name. It is only
+	// accessed by the single sync worker.
+	reported map[string]string
+}
+
+func newValuesReporter(client kubernetes.Interface) *valuesReporter {
+	return &valuesReporter{client: client, reported: map[string]string{}}
+}
+
+// startValuesReporter starts the controller reporting the values of the
+// ManagedClusterAddOns of the addon when they or their cluster change. The
+// informer factories must be started by the caller.
+func startValuesReporter(
+	ctx context.Context,
+	addonName string,
+	values *AddonValues,
+	kubeClient kubernetes.Interface,
+	clusterInformerFactory clusterv1informers.SharedInformerFactory,
+	addonInformerFactory addoninformers.SharedInformerFactory,
+) {
+	addonInformer := addonInformerFactory.Addon().V1beta1().ManagedClusterAddOns()
+	clusterInformer := clusterInformerFactory.Cluster().V1().ManagedClusters()
+
+	r := newValuesReporter(kubeClient)
+	r.values = values
+	r.addonName = addonName
+	r.addonLister = addonInformer.Lister()
+	r.clusterLister = clusterInformer.Lister()
+
+	controller := factory.New().
+		WithSync(r.sync).
+		WithInformersQueueKeysFunc(
+			func(obj runtime.Object) []string {
+				key, _ := cache.MetaNamespaceKeyFunc(obj)
+
+				return []string{key}
+			},
+			addonInformer.Informer(),
+		).
+		// The ManagedClusterAddOn of the addon is in the namespace named after the cluster
+		WithInformersQueueKeysFunc(
+			func(obj runtime.Object) []string {
+				key, _ := cache.MetaNamespaceKeyFunc(obj)
+
+				return []string{key + "/" + addonName}
+			},
+			clusterInformer.Informer(),
+		).
+		ResyncEvery(valuesReportResyncInterval).
+		ToController(addonName + "-values-report")
+
+	go controller.Run(ctx, 1)
+}
+
+func (r *valuesReporter) sync(ctx context.Context, syncCtx factory.SyncContext, key string) error {
+	if key == factory.DefaultQueueKey {
+		addons, err := r.addonLister.List(labels.Everything())
+		if err != nil {
+			return err
+		}
+
+		for _, addon := range addons {
+			syncCtx.Queue().Add(addon.Namespace + "/" + addon.Name)
+		}
+
+		return nil
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil //nolint:nilerr // An invalid key can't be retried
+	}
+
+	addon, err := r.addonLister.ManagedClusterAddOns(namespace).Get(name)
+	if k8serrors.IsNotFound(err) {
+		// The ConfigMap is garbage collected with the ManagedClusterAddOn
+		delete(r.reported, namespace+"/"+name+ValuesReportSuffix)
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !addon.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	cluster, err := r.clusterLister.Get(namespace)
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.report(ctx, r.values, cluster, addon)
+}
+
+// report writes the values report of the addon when it changed since the last
+// report.
+func (r *valuesReporter) report(
+	ctx context.Context,
+	addonValues *AddonValues,
+	cluster *clusterv1.ManagedCluster,
+	addon *addonapiv1beta1.ManagedClusterAddOn,
+) error {
+	values, origins, err := addonValues.Provenance(cluster, addon)
+	if err != nil {
+		return err
+	}
+
+	valuesYAML, err := yaml.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("failed to encode the values: %w", err)
+	}
+
+	provenance, err := FormatProvenance(origins)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]string{
+		ValuesReportValuesKey:     string(valuesYAML),
+		ValuesReportProvenanceKey: provenance,
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(data[ValuesReportValuesKey]))
+	hash.Write([]byte{0})
+	hash.Write([]byte(data[ValuesReportProvenanceKey]))
+
+	dataHash := hex.EncodeToString(hash.Sum(nil))
+
+	name := addon.Name + ValuesReportSuffix
+	key := addon.Namespace + "/" + name
+
+	if r.reported[key] == dataHash {
+		return nil
+	}
+
+	configMaps := r.client.CoreV1().ConfigMaps(addon.Namespace)
+
+	existing, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: addon.Namespace,
+				Labels:    map[string]string{addonapiv1beta1.AddonLabelKey: addon.Name},
+				// The report is removed with the ManagedClusterAddOn
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: addonapiv1alpha1.GroupVersion.String(),
+					Kind:       "ManagedClusterAddOn",
+					Name:       addon.Name,
+					UID:        addon.UID,
+				}},
+			},
+			Data: data,
+		}
+
+		if _, err := configMaps.Create(ctx, configMap, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create the ConfigMap %s: %w", key, err)
+		}
+
+		r.reported[key] = dataHash
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to get the ConfigMap %s: %w", key, err)
+	}
+
+	if !maps.Equal(existing.Data, data) {
+		existing.Data = data
+
+		if _, err := configMaps.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update the ConfigMap %s: %w", key, err)
+		}
+	}
+
+	r.reported[key] = dataHash
+
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package addon
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"open-cluster-management.io/addon-framework/pkg/addonfactory"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	clusterlistersv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+	"open-cluster-management.io/sdk-go/pkg/basecontroller/factory"
+)
+
+func TestValuesReport(t *testing.T) {
+	client := fake.NewClientset()
+	reporter := newValuesReporter(client)
+
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-addon", Namespace: "cluster1", UID: "uid"},
+	}
+	logLevel := 2
+
+	values := NewAddonValues().
+		Add(SkeletonLayer, "skeleton", staticValues(addonfactory.Values{"clientQPS": 30})).
+		Add(AnnotationLayer, "annotations",
+			func(*clusterv1.ManagedCluster, *addonapiv1beta1.ManagedClusterAddOn) (addonfactory.Values, error) {
+				return addonfactory.Values{"logLevel": logLevel}, nil
+			})
+
+	if err := reporter.report(context.TODO(), values, &clusterv1.ManagedCluster{}, addon); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	configMap, err := client.CoreV1().ConfigMaps("cluster1").Get(context.TODO(), "test-addon-values", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the ConfigMap to be created, got: %v", err)
+	}
+
+	if configMap.OwnerReferences[0].UID != "uid" {
+		t.Fatalf("expected the ConfigMap to be owned by the addon, got: %v", configMap.OwnerReferences)
+	}
+
+	if !strings.Contains(configMap.Data[ValuesReportProvenanceKey], "logLevel: 2  # annotations/annotations") ||
+		!strings.Contains(configMap.Data[ValuesReportValuesKey], "clientQPS: 30") {
+		t.Fatalf("unexpected ConfigMap data: %v", configMap.Data)
+	}
+
+	// Unchanged values aren't written again
+	actions := len(client.Actions())
+
+	if err := reporter.report(context.TODO(), values, &clusterv1.ManagedCluster{}, addon); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if len(client.Actions()) != actions {
+		t.Fatalf("expected no API calls for unchanged values, got: %v", client.Actions()[actions:])
+	}
+
+	logLevel = 4
+
+	if err := reporter.report(context.TODO(), values, &clusterv1.ManagedCluster{}, addon); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	configMap, err = client.CoreV1().ConfigMaps("cluster1").Get(context.TODO(), "test-addon-values", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(configMap.Data[ValuesReportProvenanceKey], "logLevel: 4  # annotations/annotations") {
+		t.Fatalf("expected the ConfigMap to be updated, got: %v", configMap.Data)
+	}
+}
+
+func TestValuesReportSync(t *testing.T) {
+	client := fake.NewClientset()
+	addonIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	clusterIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	reporter := newValuesReporter(client)
+	reporter.values = NewAddonValues().Add(SkeletonLayer, "skeleton", staticValues(addonfactory.Values{"clientQPS": 30}))
+	reporter.addonLister = addonlistersv1beta1.NewManagedClusterAddOnLister(addonIndexer)
+	reporter.clusterLister = clusterlistersv1.NewManagedClusterLister(clusterIndexer)
+
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-addon", Namespace: "cluster1"},
+	}
+	syncCtx := factory.NewSyncContext("test")
+
+	if err := addonIndexer.Add(addon); err != nil {
+		t.Fatal(err)
+	}
+
+	// The report waits for the ManagedCluster
+	if err := reporter.sync(context.TODO(), syncCtx, "cluster1/test-addon"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if len(client.Actions()) != 0 {
+		t.Fatalf("expected no report without the ManagedCluster, got: %v", client.Actions())
+	}
+
+	if err := clusterIndexer.Add(&clusterv1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reporter.sync(context.TODO(), syncCtx, "cluster1/test-addon"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	_, err := client.CoreV1().ConfigMaps("cluster1").Get(context.TODO(), "test-addon-values", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the ConfigMap to be created, got: %v", err)
+	}
+
+	// The reported hash is forgotten with the ManagedClusterAddOn
+	if err := addonIndexer.Delete(addon); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reporter.sync(context.TODO(), syncCtx, "cluster1/test-addon"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if len(reporter.reported) != 0 {
+		t.Fatalf("expected the report of the deleted addon to be forgotten, got: %v", reporter.reported)
+	}
+}
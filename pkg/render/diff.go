@@ -0,0 +1,348 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonv1alpha1client "open-cluster-management.io/api/client/addon/clientset/versioned"
+	addonlistersv1alpha1 "open-cluster-management.io/api/client/addon/listers/addon/v1alpha1"
+	clusterv1client "open-cluster-management.io/api/client/cluster/clientset/versioned"
+	clusterlistersv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	workv1client "open-cluster-management.io/api/client/work/clientset/versioned"
+	workv1 "open-cluster-management.io/api/work/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	policyaddon "open-cluster-management.io/governance-policy-addon-controller/pkg/addon"
+)
+
+// DiffOptions contains the options for the diff command.
+type DiffOptions struct {
+	Clusters []string
+}
+
+// DiffClients contains the hub clients used by the diff command. They are only
+// used to get and list resources.
+type DiffClients struct {
+	AddonClient   addonv1alpha1client.Interface
+	ClusterClient clusterv1client.Interface
+	WorkClient    workv1client.Interface
+}
+
+// NewDiffCommand returns the diff command, which compares the manifests this
+// binary would deploy for every governance ManagedClusterAddOn on the hub to
+// the ManifestWorks currently applied.
+func NewDiffCommand() *cobra.Command {
+	opts := &DiffOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "diff",
+		Short: "Compare the addon manifests of this version to the ManifestWorks applied on the hub",
+		Long: "Render the manifests of every governance ManagedClusterAddOn on the hub with the charts and values of " +
+			"this binary, and print a summary per cluster of the objects that differ from the currently applied " +
+			"ManifestWorks. The hub is only read from, so this can be run before upgrading the controller.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return opts.Run(cmd.Context(), cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&opts.Clusters, "cluster", nil,
+		"Only compare the addons of these managed clusters (default all)")
+
+	return cmd
+}
+
+// Run connects to the hub from the kubeconfig and writes the differences to out.
+func (o *DiffOptions) Run(ctx context.Context, out io.Writer) error {
+	kubeConfig, err := ctrl.GetConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get the hub kubeconfig: %w", err)
+	}
+
+	addonClient, err := addonv1alpha1client.NewForConfig(kubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve addon client: %w", err)
+	}
+
+	clusterClient, err := clusterv1client.NewForConfig(kubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to initialize a managed cluster client: %w", err)
+	}
+
+	workClient, err := workv1client.NewForConfig(kubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to initialize a ManifestWork client: %w", err)
+	}
+
+	return Diff(ctx, DiffClients{
+		AddonClient:   addonClient,
+		ClusterClient: clusterClient,
+		WorkClient:    workClient,
+	}, o.Clusters, out)
+}
+
+// objectDiff is a summary of the differences between the rendered and the
+// applied manifests of an addon on a cluster.
+type objectDiff struct {
+	added   []string
+	removed []string
+	changed []string
+}
+
+func (d objectDiff) empty() bool {
+	return len(d.added) == 0 && len(d.removed) == 0 && len(d.changed) == 0
+}
+
+// Diff writes a summary per cluster of the differences between the rendered
+// manifests and the applied ManifestWorks of every governance
+// ManagedClusterAddOn. When clusters is not empty, only the addons of those
+// clusters are compared.
+func Diff(ctx context.Context, clients DiffClients, clusters []string, out io.Writer) error {
+	clusterList, err := clients.ClusterClient.ClusterV1().ManagedClusters().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list the ManagedClusters: %w", err)
+	}
+
+	addonList, err := clients.AddonClient.AddonV1beta1().ManagedClusterAddOns(metav1.NamespaceAll).List(
+		ctx, metav1.ListOptions{},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to list the ManagedClusterAddOns: %w", err)
+	}
+
+	clusterIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for i := range clusterList.Items {
+		if err := clusterIndexer.Add(&clusterList.Items[i]); err != nil {
+			return err
+		}
+	}
+
+	addonIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for i := range addonList.Items {
+		if err := addonIndexer.Add(agent.ToV1alpha1Addon(&addonList.Items[i])); err != nil {
+			return err
+		}
+	}
+
+	clusterLister := clusterlistersv1.NewManagedClusterLister(clusterIndexer)
+
+	agentAddons, err := buildAgentAddons(ctx, policyaddon.AgentAddonClients{
+		AddonClient:   clients.AddonClient,
+		ClusterClient: clients.ClusterClient,
+		ClusterLister: clusterLister,
+		AddonLister:   addonlistersv1alpha1.NewManagedClusterAddOnLister(addonIndexer),
+	})
+	if err != nil {
+		return err
+	}
+
+	addons := slices.SortedFunc(slices.Values(addonList.Items), func(a, b addonapiv1beta1.ManagedClusterAddOn) int {
+		return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+	})
+
+	// The applied objects of each addon by cluster name, listed once per addon
+	appliedByAddon := map[string]map[string]map[string]*unstructured.Unstructured{}
+	changedCount := 0
+	comparedCount := 0
+
+	for i := range addons {
+		addon := &addons[i]
+
+		agentAddon, ok := agentAddons[addon.Name]
+		if !ok || (len(clusters) != 0 && !slices.Contains(clusters, addon.Namespace)) {
+			continue
+		}
+
+		cluster, err := clusterLister.Get(addon.Namespace)
+		if err != nil {
+			fmt.Fprintf(out, "%s/%s: skipped: %v\n", addon.Namespace, addon.Name, err)
+
+			continue
+		}
+
+		if _, ok := appliedByAddon[addon.Name]; !ok {
+			appliedByAddon[addon.Name], err = listAppliedObjects(ctx, clients.WorkClient, addon.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		comparedCount++
+
+		objects, err := agentAddon.Manifests(ctx, cluster, addon.DeepCopy())
+		if err != nil {
+			fmt.Fprintf(out, "%s/%s: failed to render the manifests: %v\n", addon.Namespace, addon.Name, err)
+
+			continue
+		}
+
+		diff, err := diffObjects(objects, appliedByAddon[addon.Name][addon.Namespace])
+		if err != nil {
+			return err
+		}
+
+		if diff.empty() {
+			fmt.Fprintf(out, "%s/%s: no changes\n", addon.Namespace, addon.Name)
+
+			continue
+		}
+
+		changedCount++
+
+		fmt.Fprintf(out, "%s/%s: %d changed, %d added, %d removed\n", addon.Namespace, addon.Name,
+			len(diff.changed), len(diff.added), len(diff.removed))
+
+		for _, change := range []struct {
+			action string
+			keys   []string
+		}{{"changed", diff.changed}, {"added", diff.added}, {"removed", diff.removed}} {
+			for _, key := range change.keys {
+				fmt.Fprintf(out, "  %s: %s\n", change.action, key)
+			}
+		}
+	}
+
+	fmt.Fprintf(out, "%d of %d addons would change\n", changedCount, comparedCount)
+
+	return nil
+}
+
+// listAppliedObjects returns the objects in the ManifestWorks of the addon by
+// cluster name and object key. The ManifestWorks of a hosted addon are in the
+// namespace of the hosting cluster, and are labeled with the cluster name. The
+// CRDs can be in a separate ManifestWork in the cluster namespace.
+func listAppliedObjects(
+	ctx context.Context, workClient workv1client.Interface, addonName string,
+) (map[string]map[string]*unstructured.Unstructured, error) {
+	works := []workv1.ManifestWork{}
+
+	for _, label := range []string{addonapiv1beta1.AddonLabelKey, policyaddon.CRDWorkLabel} {
+		list, err := workClient.WorkV1().ManifestWorks(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+			LabelSelector: label + "=" + addonName,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the ManifestWorks of the %s addon: %w", addonName, err)
+		}
+
+		works = append(works, list.Items...)
+	}
+
+	applied := map[string]map[string]*unstructured.Unstructured{}
+
+	for i := range works {
+		work := &works[i]
+
+		// The pre-delete hook manifests are only applied when the addon is removed
+		if policyaddon.IsPreDeleteHookWork(work) {
+			continue
+		}
+
+		clusterName := work.Namespace
+		if addonNamespace, ok := work.Labels[addonapiv1beta1.AddonNamespaceLabelKey]; ok {
+			clusterName = addonNamespace
+		}
+
+		if applied[clusterName] == nil {
+			applied[clusterName] = map[string]*unstructured.Unstructured{}
+		}
+
+		for _, manifest := range work.Spec.Workload.Manifests {
+			obj, err := manifestToUnstructured(manifest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode a manifest of the ManifestWork %s/%s: %w",
+					work.Namespace, work.Name, err)
+			}
+
+			applied[clusterName][objectKey(obj)] = obj
+		}
+	}
+
+	return applied, nil
+}
+
+func manifestToUnstructured(manifest workv1.Manifest) (*unstructured.Unstructured, error) {
+	raw := manifest.Raw
+	if raw == nil && manifest.Object != nil {
+		var err error
+
+		raw, err = json.Marshal(manifest.Object)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	obj := &unstructured.Unstructured{}
+
+	return obj, obj.UnmarshalJSON(raw)
+}
+
+// diffObjects compares the rendered objects to the applied objects, by key. The
+// pre-delete hook objects are skipped, since they're only applied in a separate
+// ManifestWork when the addon is removed.
+func diffObjects(rendered []runtime.Object, applied map[string]*unstructured.Unstructured) (objectDiff, error) {
+	diff := objectDiff{}
+	renderedKeys := map[string]bool{}
+
+	for _, renderedObj := range rendered {
+		// Use the same JSON serialization as the ManifestWork manifests
+		raw, err := json.Marshal(renderedObj)
+		if err != nil {
+			return diff, err
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(raw); err != nil {
+			return diff, err
+		}
+
+		if _, ok := obj.GetAnnotations()[addonapiv1beta1.AddonPreDeleteHookAnnotationKey]; ok {
+			continue
+		}
+
+		key := objectKey(obj)
+		renderedKeys[key] = true
+
+		appliedObj, ok := applied[key]
+		if !ok {
+			diff.added = append(diff.added, key)
+		} else if !equality.Semantic.DeepEqual(obj.Object, appliedObj.Object) {
+			diff.changed = append(diff.changed, key)
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(applied)) {
+		if !renderedKeys[key] {
+			diff.removed = append(diff.removed, key)
+		}
+	}
+
+	slices.Sort(diff.added)
+	slices.Sort(diff.changed)
+
+	return diff, nil
+}
+
+func objectKey(obj *unstructured.Unstructured) string {
+	name := obj.GetName()
+	if obj.GetNamespace() != "" {
+		name = obj.GetNamespace() + "/" + name
+	}
+
+	return fmt.Sprintf("%s %s %s", obj.GetAPIVersion(), obj.GetKind(), name)
+}
@@ -0,0 +1,176 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package render
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonfake "open-cluster-management.io/api/client/addon/clientset/versioned/fake"
+	addonlistersv1alpha1 "open-cluster-management.io/api/client/addon/listers/addon/v1alpha1"
+	clusterfake "open-cluster-management.io/api/client/cluster/clientset/versioned/fake"
+	clusterlistersv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	workfake "open-cluster-management.io/api/client/work/clientset/versioned/fake"
+	workv1 "open-cluster-management.io/api/work/v1"
+
+	policyaddon "open-cluster-management.io/governance-policy-addon-controller/pkg/addon"
+)
+
+func TestDiff(t *testing.T) {
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "cert-policy-controller", Namespace: "cluster1"},
+	}
+	otherAddon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "work-manager", Namespace: "cluster1"},
+	}
+
+	clients := DiffClients{
+		AddonClient:   addonfake.NewSimpleClientset(addon, otherAddon),
+		ClusterClient: clusterfake.NewSimpleClientset(testCluster()),
+	}
+
+	// Build the applied ManifestWork from the current manifests
+	agentAddons, err := buildAgentAddons(context.TODO(), policyaddon.AgentAddonClients{
+		AddonClient:   clients.AddonClient,
+		ClusterClient: clients.ClusterClient,
+		ClusterLister: clusterlistersv1.NewManagedClusterLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := agentAddons[addon.Name].Manifests(context.TODO(), testCluster(), addon.DeepCopy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := []workv1.Manifest{}
+
+	for _, obj := range objects {
+		raw, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		manifests = append(manifests, workv1.Manifest{RawExtension: runtime.RawExtension{Raw: raw}})
+	}
+
+	// Change the first manifest, drop the last one, and add an extra one
+	changed := map[string]any{}
+	if err := json.Unmarshal(manifests[0].Raw, &changed); err != nil {
+		t.Fatal(err)
+	}
+
+	changed["metadata"].(map[string]any)["labels"] = map[string]any{"changed": "true"}
+	manifests[0].Raw, _ = json.Marshal(changed)
+	manifests = manifests[:len(manifests)-1]
+
+	extra, _ := json.Marshal(&corev1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: "removed", Namespace: "open-cluster-management-agent-addon"},
+	})
+	manifests = append(manifests, workv1.Manifest{RawExtension: runtime.RawExtension{Raw: extra}})
+
+	work := &workv1.ManifestWork{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "addon-cert-policy-controller-deploy-0",
+			Namespace: "cluster1",
+			Labels:    map[string]string{addonapiv1beta1.AddonLabelKey: "cert-policy-controller"},
+		},
+		Spec: workv1.ManifestWorkSpec{Workload: workv1.ManifestsTemplate{Manifests: manifests}},
+	}
+
+	clients.WorkClient = workfake.NewSimpleClientset(work)
+	out := &bytes.Buffer{}
+
+	if err := Diff(context.TODO(), clients, nil, out); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	for _, expected := range []string{
+		"cluster1/cert-policy-controller: 1 changed, 1 added, 1 removed",
+		"removed: v1 ConfigMap open-cluster-management-agent-addon/removed",
+		"1 of 1 addons would change",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("expected the output to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestDiffSkipsPreDeleteHook(t *testing.T) {
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Namespace: "cluster1"},
+	}
+
+	clients := DiffClients{
+		AddonClient:   addonfake.NewSimpleClientset(addon),
+		ClusterClient: clusterfake.NewSimpleClientset(testCluster()),
+	}
+
+	agentAddons, err := buildAgentAddons(context.TODO(), policyaddon.AgentAddonClients{
+		AddonClient:   clients.AddonClient,
+		ClusterClient: clients.ClusterClient,
+		ClusterLister: clusterlistersv1.NewManagedClusterLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, nil)),
+		AddonLister: addonlistersv1alpha1.NewManagedClusterAddOnLister(
+			cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := agentAddons[addon.Name].Manifests(context.TODO(), testCluster(), addon.DeepCopy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The applied ManifestWork doesn't contain the pre-delete hook objects
+	manifests := []workv1.Manifest{}
+	hookCount := 0
+
+	for _, obj := range objects {
+		raw, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(string(raw), addonapiv1beta1.AddonPreDeleteHookAnnotationKey) {
+			hookCount++
+
+			continue
+		}
+
+		manifests = append(manifests, workv1.Manifest{RawExtension: runtime.RawExtension{Raw: raw}})
+	}
+
+	if hookCount == 0 {
+		t.Fatal("expected the config-policy-controller manifests to contain a pre-delete hook object")
+	}
+
+	clients.WorkClient = workfake.NewSimpleClientset(&workv1.ManifestWork{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "addon-config-policy-controller-deploy-0",
+			Namespace: "cluster1",
+			Labels:    map[string]string{addonapiv1beta1.AddonLabelKey: "config-policy-controller"},
+		},
+		Spec: workv1.ManifestWorkSpec{Workload: workv1.ManifestsTemplate{Manifests: manifests}},
+	})
+	out := &bytes.Buffer{}
+
+	if err := Diff(context.TODO(), clients, nil, out); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if !strings.Contains(out.String(), "cluster1/config-policy-controller: no changes") {
+		t.Fatalf("expected the pre-delete hook objects to be skipped, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,440 @@
+// Copyright Contributors to the Open Cluster Management project
+
+// Package render renders the manifests that the governance addons would deploy
+// to a managed cluster, either without connecting to a hub or to compare them
+// with the ManifestWorks applied on a hub.
+package render
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/openshift/library-go/pkg/controller/controllercmd"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/tools/cache"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	"open-cluster-management.io/addon-framework/pkg/utils"
+	addonapiv1alpha1 "open-cluster-management.io/api/addon/v1alpha1"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonfake "open-cluster-management.io/api/client/addon/clientset/versioned/fake"
+	addonlistersv1alpha1 "open-cluster-management.io/api/client/addon/listers/addon/v1alpha1"
+	clusterfake "open-cluster-management.io/api/client/cluster/clientset/versioned/fake"
+	clusterlistersv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+	"sigs.k8s.io/yaml"
+
+	policyaddon "open-cluster-management.io/governance-policy-addon-controller/pkg/addon"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/certpolicy"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/configpolicy"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/gatekeepersync"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/policyframework"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/standalonetemplating"
+)
+
+// AgentAddonBuilders are the functions used to build each of the agent addons
+// managed by this controller.
+var AgentAddonBuilders = []func(
+	context.Context, *controllercmd.ControllerContext, policyaddon.AgentAddonClients,
+) (agent.AgentAddon, error){
+	policyframework.BuildAgentAddon,
+	configpolicy.BuildAgentAddon,
+	standalonetemplating.BuildAgentAddon,
+	certpolicy.BuildAgentAddon,
+	gatekeepersync.BuildAgentAddon,
+}
+
+// AddonValuesGetters are the functions returning the sources of the values of
+// each agent addon, by addon name.
+var AddonValuesGetters = map[string]func(policyaddon.AgentAddonClients) *policyaddon.AddonValues{
+	"governance-policy-framework":          policyframework.GetAddonValues,
+	"config-policy-controller":             configpolicy.GetAddonValues,
+	"governance-standalone-hub-templating": standalonetemplating.GetAddonValues,
+	"cert-policy-controller":               certpolicy.GetAddonValues,
+	"governance-policy-gatekeeper-sync":    gatekeepersync.GetAddonValues,
+}
+
+var (
+	scheme  = runtime.NewScheme()
+	decoder runtime.Decoder
+)
+
+func init() {
+	for _, addToScheme := range []func(*runtime.Scheme) error{
+		clusterv1.Install,
+		addonapiv1alpha1.Install,
+		addonapiv1beta1.Install,
+	} {
+		if err := addToScheme(scheme); err != nil {
+			panic(fmt.Sprintf("Failed to add to the render scheme: %v", err))
+		}
+	}
+
+	decoder = serializer.NewCodecFactory(scheme).UniversalDeserializer()
+}
+
+// Options contains the input files for the render command.
+type Options struct {
+	ClusterFile          string
+	AddonFile            string
+	DeploymentConfigFile string
+	ExplainValues        bool
+}
+
+// NewCommand returns the render command, which prints the manifests each addon
+// in the ManagedClusterAddOn file would deploy to the given ManagedCluster.
+func NewCommand() *cobra.Command {
+	opts := &Options{}
+
+	cmd := &cobra.Command{
+		Use:   "render",
+		Short: "Render the addon manifests for a managed cluster without connecting to a hub",
+		Long: "Render the manifests that each governance addon would deploy to a managed cluster, using the same " +
+			"values as the controller. The ManagedClusterAddOn file may contain multiple YAML documents to render " +
+			"several addons at once.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return opts.Run(cmd.Context(), cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.ClusterFile, "cluster", "", "Path to a ManagedCluster YAML file")
+	cmd.Flags().StringVar(&opts.AddonFile, "addon", "", "Path to a YAML file with one or more ManagedClusterAddOns")
+	cmd.Flags().StringVar(&opts.DeploymentConfigFile, "deployment-config", "",
+		"Optional path to an AddOnDeploymentConfig YAML file applied to every ManagedClusterAddOn")
+	cmd.Flags().BoolVar(&opts.ExplainValues, "explain-values", false,
+		"Print the Helm values of each addon and where each value came from instead of the manifests")
+
+	_ = cmd.MarkFlagRequired("cluster")
+	_ = cmd.MarkFlagRequired("addon")
+
+	return cmd
+}
+
+// Run reads the input files and writes the rendered manifests to out.
+func (o *Options) Run(ctx context.Context, out io.Writer) error {
+	clusterObjs, err := readObjects(o.ClusterFile)
+	if err != nil {
+		return err
+	}
+
+	if len(clusterObjs) != 1 {
+		return fmt.Errorf("expected exactly one ManagedCluster in %s, found %d objects", o.ClusterFile, len(clusterObjs))
+	}
+
+	cluster, ok := clusterObjs[0].(*clusterv1.ManagedCluster)
+	if !ok {
+		return fmt.Errorf("expected a ManagedCluster in %s, found %T", o.ClusterFile, clusterObjs[0])
+	}
+
+	addonObjs, err := readObjects(o.AddonFile)
+	if err != nil {
+		return err
+	}
+
+	addons := make([]*addonapiv1beta1.ManagedClusterAddOn, 0, len(addonObjs))
+
+	for _, obj := range addonObjs {
+		switch addon := obj.(type) {
+		case *addonapiv1beta1.ManagedClusterAddOn:
+			addons = append(addons, addon)
+		case *addonapiv1alpha1.ManagedClusterAddOn:
+			addons = append(addons, agent.ToV1beta1Addon(addon))
+		default:
+			return fmt.Errorf("expected a ManagedClusterAddOn in %s, found %T", o.AddonFile, obj)
+		}
+	}
+
+	var config *addonapiv1beta1.AddOnDeploymentConfig
+
+	if o.DeploymentConfigFile != "" {
+		configObjs, err := readObjects(o.DeploymentConfigFile)
+		if err != nil {
+			return err
+		}
+
+		if len(configObjs) != 1 {
+			return fmt.Errorf("expected exactly one AddOnDeploymentConfig in %s, found %d objects",
+				o.DeploymentConfigFile, len(configObjs))
+		}
+
+		switch obj := configObjs[0].(type) {
+		case *addonapiv1beta1.AddOnDeploymentConfig:
+			config = obj
+		case *addonapiv1alpha1.AddOnDeploymentConfig:
+			config = &addonapiv1beta1.AddOnDeploymentConfig{}
+
+			if err := scheme.Convert(obj, config, nil); err != nil {
+				return fmt.Errorf("failed to convert the AddOnDeploymentConfig in %s: %w", o.DeploymentConfigFile, err)
+			}
+		default:
+			return fmt.Errorf("expected an AddOnDeploymentConfig in %s, found %T", o.DeploymentConfigFile, obj)
+		}
+	}
+
+	if o.ExplainValues {
+		return ExplainValues(cluster, addons, config, out)
+	}
+
+	return Render(ctx, cluster, addons, config, out)
+}
+
+// Render writes the manifests for each ManagedClusterAddOn on the cluster to
+// out as YAML documents. When a deployment config is provided, it is referenced
+// by every ManagedClusterAddOn as though the addon-framework had resolved it.
+func Render(
+	ctx context.Context,
+	cluster *clusterv1.ManagedCluster,
+	addons []*addonapiv1beta1.ManagedClusterAddOn,
+	config *addonapiv1beta1.AddOnDeploymentConfig,
+	out io.Writer,
+) error {
+	clients, hubAddons, err := newHubClients(cluster, addons, config)
+	if err != nil {
+		return err
+	}
+
+	agentAddons, err := buildAgentAddons(ctx, clients)
+	if err != nil {
+		return err
+	}
+
+	for _, addon := range hubAddons {
+		agentAddon, ok := agentAddons[addon.Name]
+		if !ok {
+			return fmt.Errorf("the ManagedClusterAddOn name %s is not a governance addon", addon.Name)
+		}
+
+		objects, err := agentAddon.Manifests(ctx, cluster, addon)
+		if err != nil {
+			return fmt.Errorf("failed to render the manifests for the %s addon: %w", addon.Name, err)
+		}
+
+		for _, obj := range objects {
+			data, err := yaml.Marshal(obj)
+			if err != nil {
+				return err
+			}
+
+			if _, err := fmt.Fprintf(out, "---\n# Source: %s\n%s", addon.Name, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// newHubClients returns fake hub clients with the cluster, the addons and the
+// deployment config, and the addons as they are on the hub. When a deployment
+// config is provided, it is referenced by every ManagedClusterAddOn as though
+// the addon-framework had resolved it.
+func newHubClients(
+	cluster *clusterv1.ManagedCluster,
+	addons []*addonapiv1beta1.ManagedClusterAddOn,
+	config *addonapiv1beta1.AddOnDeploymentConfig,
+) (policyaddon.AgentAddonClients, []*addonapiv1beta1.ManagedClusterAddOn, error) {
+	if len(addons) == 0 {
+		return policyaddon.AgentAddonClients{}, nil, errors.New("no ManagedClusterAddOns were provided")
+	}
+
+	hubObjs := []runtime.Object{}
+
+	if config != nil {
+		config = config.DeepCopy()
+		if config.Namespace == "" {
+			config.Namespace = cluster.Name
+		}
+
+		hubObjs = append(hubObjs, config)
+	}
+
+	addonIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	hubAddons := make([]*addonapiv1beta1.ManagedClusterAddOn, 0, len(addons))
+
+	for _, addon := range addons {
+		addon = addon.DeepCopy()
+
+		if addon.Namespace == "" {
+			addon.Namespace = cluster.Name
+		}
+
+		if addon.Namespace != cluster.Name {
+			return policyaddon.AgentAddonClients{}, nil, fmt.Errorf(
+				"the ManagedClusterAddOn %s/%s is not in the namespace of the ManagedCluster %s",
+				addon.Namespace, addon.Name, cluster.Name)
+		}
+
+		if config != nil {
+			if err := setDeploymentConfigReference(addon, config); err != nil {
+				return policyaddon.AgentAddonClients{}, nil, err
+			}
+		}
+
+		if err := addonIndexer.Add(agent.ToV1alpha1Addon(addon)); err != nil {
+			return policyaddon.AgentAddonClients{}, nil, err
+		}
+
+		hubAddons = append(hubAddons, addon)
+	}
+
+	clusterIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := clusterIndexer.Add(cluster); err != nil {
+		return policyaddon.AgentAddonClients{}, nil, err
+	}
+
+	return policyaddon.AgentAddonClients{
+		AddonClient:   addonfake.NewSimpleClientset(hubObjs...),
+		ClusterClient: clusterfake.NewSimpleClientset(cluster),
+		ClusterLister: clusterlistersv1.NewManagedClusterLister(clusterIndexer),
+		AddonLister:   addonlistersv1alpha1.NewManagedClusterAddOnLister(addonIndexer),
+	}, hubAddons, nil
+}
+
+// ExplainValues writes the Helm values of each ManagedClusterAddOn on the
+// cluster to out, with the layer and the source which set each value, from the
+// lowest to the highest precedence layer.
+func ExplainValues(
+	cluster *clusterv1.ManagedCluster,
+	addons []*addonapiv1beta1.ManagedClusterAddOn,
+	config *addonapiv1beta1.AddOnDeploymentConfig,
+	out io.Writer,
+) error {
+	clients, hubAddons, err := newHubClients(cluster, addons, config)
+	if err != nil {
+		return err
+	}
+
+	for _, addon := range hubAddons {
+		getAddonValues, ok := AddonValuesGetters[addon.Name]
+		if !ok {
+			return fmt.Errorf("the ManagedClusterAddOn name %s is not a governance addon", addon.Name)
+		}
+
+		_, origins, err := getAddonValues(clients).Provenance(cluster, addon)
+		if err != nil {
+			return fmt.Errorf("failed to get the values for the %s addon: %w", addon.Name, err)
+		}
+
+		if _, err := fmt.Fprintf(out, "# %s\n", addon.Name); err != nil {
+			return err
+		}
+
+		provenance, err := policyaddon.FormatProvenance(origins)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprint(out, provenance); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildAgentAddons builds each of the agent addons with the hub clients, by
+// addon name.
+func buildAgentAddons(
+	ctx context.Context, clients policyaddon.AgentAddonClients,
+) (map[string]agent.AgentAddon, error) {
+	agentAddons := map[string]agent.AgentAddon{}
+
+	for _, build := range AgentAddonBuilders {
+		agentAddon, err := build(ctx, &controllercmd.ControllerContext{}, clients)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build an agent addon: %w", err)
+		}
+
+		agentAddons[agentAddon.GetAgentAddonOptions().AddonName] = agentAddon
+	}
+
+	return agentAddons, nil
+}
+
+// setDeploymentConfigReference points the desired AddOnDeploymentConfig of the
+// addon to the provided config, replacing any existing reference.
+func setDeploymentConfigReference(
+	addon *addonapiv1beta1.ManagedClusterAddOn, config *addonapiv1beta1.AddOnDeploymentConfig,
+) error {
+	specHash, err := utils.GetAddOnDeploymentConfigSpecHash(config)
+	if err != nil {
+		return fmt.Errorf("failed to hash the AddOnDeploymentConfig %s/%s: %w", config.Namespace, config.Name, err)
+	}
+
+	configRef := addonapiv1beta1.ConfigReference{
+		ConfigGroupResource: addonapiv1beta1.ConfigGroupResource{
+			Group:    utils.AddOnDeploymentConfigGVR.Group,
+			Resource: utils.AddOnDeploymentConfigGVR.Resource,
+		},
+		DesiredConfig: &addonapiv1beta1.ConfigSpecHash{
+			ConfigReferent: addonapiv1beta1.ConfigReferent{
+				Namespace: config.Namespace,
+				Name:      config.Name,
+			},
+			SpecHash: specHash,
+		},
+	}
+
+	for i, ref := range addon.Status.ConfigReferences {
+		if ref.Group == configRef.Group && ref.Resource == configRef.Resource {
+			addon.Status.ConfigReferences[i] = configRef
+
+			return nil
+		}
+	}
+
+	addon.Status.ConfigReferences = append(addon.Status.ConfigReferences, configRef)
+
+	return nil
+}
+
+// readObjects decodes every YAML document in the file into a typed object.
+func readObjects(path string) ([]runtime.Object, error) {
+	file, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	objects := []runtime.Object{}
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(file))
+
+	for {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		jsonDoc, err := yaml.YAMLToJSON(doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+
+		// Skip empty documents, such as a leading document separator
+		if string(jsonDoc) == "null" {
+			continue
+		}
+
+		obj, _, err := decoder.Decode(jsonDoc, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
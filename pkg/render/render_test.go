@@ -0,0 +1,264 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package render
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+
+	policyaddon "open-cluster-management.io/governance-policy-addon-controller/pkg/addon"
+)
+
+func testCluster() *clusterv1.ManagedCluster {
+	return &clusterv1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster1"},
+		Status: clusterv1.ManagedClusterStatus{
+			Version: clusterv1.ManagedClusterVersion{Kubernetes: "v1.30.0"},
+		},
+	}
+}
+
+func TestRender(t *testing.T) {
+	t.Run("annotations and deployment config values are rendered", func(t *testing.T) {
+		addon := &addonapiv1beta1.ManagedClusterAddOn{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "config-policy-controller",
+				Annotations: map[string]string{"client-qps": "20"},
+			},
+		}
+		config := &addonapiv1beta1.AddOnDeploymentConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: "config"},
+			Spec: addonapiv1beta1.AddOnDeploymentConfigSpec{
+				CustomizedVariables: []addonapiv1beta1.CustomizedVariable{{Name: "logLevel", Value: "3"}},
+			},
+		}
+
+		out := &bytes.Buffer{}
+
+		err := Render(context.TODO(), testCluster(), []*addonapiv1beta1.ManagedClusterAddOn{addon}, config, out)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		for _, expected := range []string{"# Source: config-policy-controller", "--client-max-qps=20", "--log-level=3"} {
+			if !strings.Contains(out.String(), expected) {
+				t.Fatalf("expected the rendered manifests to contain %q", expected)
+			}
+		}
+
+		if addon.Namespace != "" || len(addon.Status.ConfigReferences) != 0 {
+			t.Fatal("expected the input ManagedClusterAddOn to be left unmodified")
+		}
+	})
+
+	t.Run("the gatekeeper sync addon disables the framework gatekeeper sync", func(t *testing.T) {
+		addons := []*addonapiv1beta1.ManagedClusterAddOn{
+			{ObjectMeta: metav1.ObjectMeta{Name: "governance-policy-framework"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "governance-policy-gatekeeper-sync"}},
+		}
+
+		out := &bytes.Buffer{}
+
+		err := Render(context.TODO(), testCluster(), addons, nil, out)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		for _, expected := range []string{
+			"--disable-gatekeeper-sync=true",
+			"--disable-spec-sync=true",
+		} {
+			if !strings.Contains(out.String(), expected) {
+				t.Fatalf("expected the rendered manifests to contain %q", expected)
+			}
+		}
+	})
+
+	t.Run("multiple replicas use leader election and a PodDisruptionBudget", func(t *testing.T) {
+		addon := &addonapiv1beta1.ManagedClusterAddOn{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "cert-policy-controller",
+				Annotations: map[string]string{"replicas": "2"},
+			},
+		}
+
+		out := &bytes.Buffer{}
+
+		err := Render(context.TODO(), testCluster(), []*addonapiv1beta1.ManagedClusterAddOn{addon}, nil, out)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		for _, expected := range []string{"replicas: 2", "kind: PodDisruptionBudget", "podAntiAffinity"} {
+			if !strings.Contains(out.String(), expected) {
+				t.Fatalf("expected the rendered manifests to contain %q", expected)
+			}
+		}
+
+		if strings.Contains(out.String(), "--leader-elect=false") {
+			t.Fatal("expected leader election to be enabled")
+		}
+	})
+
+	t.Run("scheduling settings are rendered from the deployment config", func(t *testing.T) {
+		addon := &addonapiv1beta1.ManagedClusterAddOn{
+			ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller"},
+		}
+		config := &addonapiv1beta1.AddOnDeploymentConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: "config"},
+			Spec: addonapiv1beta1.AddOnDeploymentConfigSpec{
+				CustomizedVariables: []addonapiv1beta1.CustomizedVariable{
+					{Name: "priorityClassName", Value: "system-cluster-critical"},
+					{
+						Name:  "topologySpreadConstraints",
+						Value: `[{"maxSkew": 1, "topologyKey": "zone", "whenUnsatisfiable": "ScheduleAnyway"}]`,
+					},
+					{Name: "podDisruptionBudgetEnabled", Value: "true"},
+					{Name: "podDisruptionBudgetMaxUnavailable", Value: "50%"},
+				},
+			},
+		}
+
+		out := &bytes.Buffer{}
+
+		err := Render(context.TODO(), testCluster(), []*addonapiv1beta1.ManagedClusterAddOn{addon}, config, out)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		for _, expected := range []string{
+			"priorityClassName: system-cluster-critical",
+			"topologyKey: zone",
+			"app: config-policy-controller",
+			"kind: PodDisruptionBudget",
+			"maxUnavailable: 50%",
+		} {
+			if !strings.Contains(out.String(), expected) {
+				t.Fatalf("expected the rendered manifests to contain %q", expected)
+			}
+		}
+	})
+
+	t.Run("registries mirror the chart default image", func(t *testing.T) {
+		t.Setenv("CONFIG_POLICY_CONTROLLER_IMAGE", "")
+
+		addon := &addonapiv1beta1.ManagedClusterAddOn{
+			ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller"},
+		}
+		config := &addonapiv1beta1.AddOnDeploymentConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: "config"},
+			Spec: addonapiv1beta1.AddOnDeploymentConfigSpec{
+				Registries: []addonapiv1beta1.ImageMirror{{
+					Source: "quay.io/stolostron",
+					Mirror: "registry.example.com/stolostron",
+				}},
+			},
+		}
+
+		out := &bytes.Buffer{}
+
+		err := Render(context.TODO(), testCluster(), []*addonapiv1beta1.ManagedClusterAddOn{addon}, config, out)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		if !strings.Contains(out.String(), "image: registry.example.com/stolostron/config-policy-controller:latest") {
+			t.Fatalf("expected the chart default image to be mirrored, got:\n%s", out.String())
+		}
+	})
+
+	t.Run("the manifests of every addon stay below the ManifestWork size limit", func(t *testing.T) {
+		addons := []*addonapiv1beta1.ManagedClusterAddOn{}
+
+		for name := range AddonValuesGetters {
+			addons = append(addons, &addonapiv1beta1.ManagedClusterAddOn{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		}
+
+		clients, hubAddons, err := newHubClients(testCluster(), addons, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		agentAddons, err := buildAgentAddons(context.TODO(), clients)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, addon := range hubAddons {
+			objects, err := agentAddons[addon.Name].Manifests(context.TODO(), testCluster(), addon)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			crds, others := policyaddon.SplitCRDs(objects)
+
+			for work, workObjects := range map[string][]runtime.Object{"CRD": crds, "agent": others} {
+				size, err := policyaddon.ManifestsSize(workObjects)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if size > policyaddon.ManifestsSizeWarning {
+					t.Errorf("expected the %s ManifestWork of the %s addon to be below %d bytes, got %d bytes",
+						work, addon.Name, policyaddon.ManifestsSizeWarning, size)
+				}
+			}
+		}
+	})
+
+	t.Run("unknown addon names are rejected", func(t *testing.T) {
+		addon := &addonapiv1beta1.ManagedClusterAddOn{
+			ObjectMeta: metav1.ObjectMeta{Name: "not-a-policy-addon"},
+		}
+
+		err := Render(context.TODO(), testCluster(), []*addonapiv1beta1.ManagedClusterAddOn{addon}, nil, &bytes.Buffer{})
+		if err == nil {
+			t.Fatal("expected an error for an unknown addon name")
+		}
+	})
+}
+
+func TestExplainValues(t *testing.T) {
+	cluster := testCluster()
+	cluster.Labels = map[string]string{"vendor": "OpenShift"}
+
+	addon := &addonapiv1beta1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "governance-policy-framework",
+			Annotations: map[string]string{"client-qps": "20", "prometheus-metrics-enabled": "false"},
+		},
+	}
+	config := &addonapiv1beta1.AddOnDeploymentConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "config"},
+		Spec: addonapiv1beta1.AddOnDeploymentConfigSpec{
+			CustomizedVariables: []addonapiv1beta1.CustomizedVariable{{Name: "logLevel", Value: "3"}},
+		},
+	}
+
+	out := &bytes.Buffer{}
+
+	err := ExplainValues(cluster, []*addonapiv1beta1.ManagedClusterAddOn{addon}, config, out)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	for _, expected := range []string{
+		"# governance-policy-framework\n",
+		`global.imagePullPolicy: "IfNotPresent"  # skeleton/skeleton`,
+		`kubernetesDistribution: "OpenShift"  # cluster/cluster`,
+		`clientQPS: 20  # annotations/annotations`,
+		`prometheus.enabled: false  # annotations/annotations`,
+		`logLevel: 3  # default-deployment-config/AddOnDeploymentConfig`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("expected the output to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+}
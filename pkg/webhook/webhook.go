@@ -0,0 +1,337 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+	"open-cluster-management.io/addon-framework/pkg/agent"
+	"open-cluster-management.io/addon-framework/pkg/utils"
+	addonapiv1alpha1 "open-cluster-management.io/api/addon/v1alpha1"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonv1alpha1client "open-cluster-management.io/api/client/addon/clientset/versioned"
+	addoninformers "open-cluster-management.io/api/client/addon/informers/externalversions"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	crwebhook "sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	policyaddon "open-cluster-management.io/governance-policy-addon-controller/pkg/addon"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/certpolicy"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/configpolicy"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/gatekeepersync"
+	"open-cluster-management.io/governance-policy-addon-controller/pkg/addon/policyframework"
+)
+
+const (
+	// ManagedClusterAddOnPath is the path the ManagedClusterAddOn validating webhook is served on.
+	ManagedClusterAddOnPath = "/validate-managedclusteraddon"
+	// AddOnDeploymentConfigPath is the path the AddOnDeploymentConfig validating webhook is served on.
+	AddOnDeploymentConfigPath = "/validate-addondeploymentconfig"
+)
+
+// Validators are the configuration validators of the governance addons, by
+// addon name. ManagedClusterAddOns with other names are always allowed.
+var Validators = map[string]policyaddon.ConfigurationValidator{
+	"governance-policy-framework":       policyframework.ValidateConfiguration,
+	"config-policy-controller":          configpolicy.ValidateConfiguration,
+	"cert-policy-controller":            certpolicy.ValidateConfiguration,
+	"governance-policy-gatekeeper-sync": gatekeepersync.ValidateConfiguration,
+}
+
+var (
+	log     = ctrl.Log.WithName("webhook")
+	scheme  = runtime.NewScheme()
+	decoder runtime.Decoder
+)
+
+func init() {
+	for _, addToScheme := range []func(*runtime.Scheme) error{
+		addonapiv1alpha1.Install,
+		addonapiv1beta1.Install,
+	} {
+		if err := addToScheme(scheme); err != nil {
+			panic(fmt.Sprintf("Failed to add to the webhook scheme: %v", err))
+		}
+	}
+
+	decoder = serializer.NewCodecFactory(scheme).UniversalDeserializer()
+}
+
+// NewServer returns a webhook server serving the validating webhooks of the
+// governance addons. The ManagedClusterAddOn informer used to find the addons
+// referencing an AddOnDeploymentConfig is started with the context.
+func NewServer(ctx context.Context, kubeConfig *rest.Config, options crwebhook.Options) (crwebhook.Server, error) {
+	addonClient, err := addonv1alpha1client.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve addon client: %w", err)
+	}
+
+	addonInformer := addoninformers.NewSharedInformerFactory(addonClient, 10*time.Minute).
+		Addon().V1beta1().ManagedClusterAddOns()
+	go addonInformer.Informer().Run(ctx.Done())
+
+	validator := &Validator{
+		AddonClient: addonClient,
+		AddonLister: addonInformer.Lister(),
+		Now:         time.Now,
+	}
+
+	server := crwebhook.NewServer(options)
+	server.Register(ManagedClusterAddOnPath, &crwebhook.Admission{Handler: validator.ManagedClusterAddOnHandler()})
+	server.Register(AddOnDeploymentConfigPath, &crwebhook.Admission{Handler: validator.AddOnDeploymentConfigHandler()})
+
+	return server, nil
+}
+
+// Validator validates the governance ManagedClusterAddOns and the
+// AddOnDeploymentConfigs they reference. Invalid values are rejected, and
+// unsupported annotations and customized variables are returned as warnings.
+type Validator struct {
+	AddonClient addonv1alpha1client.Interface
+	AddonLister addonlistersv1beta1.ManagedClusterAddOnLister
+	// Now returns the current time, which is used to validate the pause annotations.
+	Now func() time.Time
+}
+
+// ManagedClusterAddOnHandler returns the admission handler for ManagedClusterAddOns.
+func (v *Validator) ManagedClusterAddOnHandler() admission.Handler {
+	return admission.HandlerFunc(v.validateManagedClusterAddOn)
+}
+
+// AddOnDeploymentConfigHandler returns the admission handler for AddOnDeploymentConfigs.
+func (v *Validator) AddOnDeploymentConfigHandler() admission.Handler {
+	return admission.HandlerFunc(v.validateAddOnDeploymentConfig)
+}
+
+func (v *Validator) validateManagedClusterAddOn(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation == admissionv1.Delete {
+		return admission.Allowed("")
+	}
+
+	addon, err := decodeAddon(req.Object.Raw)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	validate, ok := Validators[addon.Name]
+	if !ok || !addon.DeletionTimestamp.IsZero() {
+		return admission.Allowed("")
+	}
+
+	config, err := v.getDeploymentConfig(ctx, addon)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	warnings, err := validate(addon, config)
+
+	if state := policyaddon.GetPauseState(addon, nil, v.Now()); state.Err != nil {
+		err = errors.Join(err, fmt.Errorf("invalid %s annotation: %w",
+			policyaddon.PolicyAddonPauseUntilAnnotation, state.Err))
+	}
+
+	// Updates which don't change the user-provided values, such as the finalizers set by the addon-manager, are
+	// allowed so that addons which were already invalid can still be reconciled and deleted
+	if err != nil && req.Operation == admissionv1.Update && len(req.OldObject.Raw) != 0 {
+		oldAddon, oldErr := decodeAddon(req.OldObject.Raw)
+		if oldErr != nil {
+			return admission.Errored(http.StatusBadRequest, oldErr)
+		}
+
+		if equality.Semantic.DeepEqual(oldAddon.Annotations, addon.Annotations) &&
+			equality.Semantic.DeepEqual(oldAddon.Spec.Configs, addon.Spec.Configs) {
+			return admission.Allowed("").WithWarnings(
+				append(warnings, "rejected values: "+strings.ReplaceAll(err.Error(), "\n", "; "))...)
+		}
+	}
+
+	return response(warnings, err)
+}
+
+// decodeAddon decodes a v1alpha1 or v1beta1 ManagedClusterAddOn.
+func decodeAddon(raw []byte) (*addonapiv1beta1.ManagedClusterAddOn, error) {
+	obj, _, err := decoder.Decode(raw, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typed := obj.(type) {
+	case *addonapiv1beta1.ManagedClusterAddOn:
+		return typed, nil
+	case *addonapiv1alpha1.ManagedClusterAddOn:
+		return agent.ToV1beta1Addon(typed), nil
+	default:
+		return nil, fmt.Errorf("expected a ManagedClusterAddOn, got %T", obj)
+	}
+}
+
+func (v *Validator) validateAddOnDeploymentConfig(_ context.Context, req admission.Request) admission.Response {
+	if req.Operation == admissionv1.Delete {
+		return admission.Allowed("")
+	}
+
+	obj, _, err := decoder.Decode(req.Object.Raw, nil, nil)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	config := &addonapiv1beta1.AddOnDeploymentConfig{}
+
+	switch typed := obj.(type) {
+	case *addonapiv1beta1.AddOnDeploymentConfig:
+		config = typed
+	case *addonapiv1alpha1.AddOnDeploymentConfig:
+		if err := scheme.Convert(typed, config, nil); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	default:
+		return admission.Errored(http.StatusBadRequest, fmt.Errorf("expected an AddOnDeploymentConfig, got %T", obj))
+	}
+
+	addons, err := v.referencingAddons(req.Namespace, req.Name)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	var allWarnings []string
+	var allErrs error
+
+	reported := map[string]bool{}
+
+	for _, referencing := range addons {
+		// Only the deployment config is validated, so the annotations of the ManagedClusterAddOn are ignored
+		addon := referencing.DeepCopy()
+		addon.Annotations = nil
+
+		warnings, err := Validators[addon.Name](addon, config)
+
+		for _, warning := range warnings {
+			if !slices.Contains(allWarnings, warning) {
+				allWarnings = append(allWarnings, warning)
+			}
+		}
+
+		// The same rejected values are only reported once for all the clusters of the addon
+		if err != nil && !reported[addon.Name+": "+err.Error()] {
+			reported[addon.Name+": "+err.Error()] = true
+			allErrs = errors.Join(allErrs, fmt.Errorf("%s: %w", addon.Name, err))
+		}
+	}
+
+	return response(allWarnings, allErrs)
+}
+
+// getDeploymentConfig returns the AddOnDeploymentConfig set in the configs of
+// the ManagedClusterAddOn, or nil when there is none.
+func (v *Validator) getDeploymentConfig(
+	ctx context.Context, addon *addonapiv1beta1.ManagedClusterAddOn,
+) (*addonapiv1beta1.AddOnDeploymentConfig, error) {
+	for _, config := range addon.Spec.Configs {
+		if config.Group != utils.AddOnDeploymentConfigGVR.Group ||
+			config.Resource != utils.AddOnDeploymentConfigGVR.Resource {
+			continue
+		}
+
+		namespace := config.Namespace
+		if namespace == "" {
+			namespace = addon.Namespace
+		}
+
+		adc, err := v.AddonClient.AddonV1beta1().AddOnDeploymentConfigs(namespace).Get(
+			ctx, config.Name, metav1.GetOptions{},
+		)
+		if k8serrors.IsNotFound(err) {
+			// The addon-framework reports missing configs in the ManagedClusterAddOn status
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the AddOnDeploymentConfig %s/%s: %w", namespace, config.Name, err)
+		}
+
+		return adc, nil
+	}
+
+	return nil, nil
+}
+
+// referencingAddons returns the governance ManagedClusterAddOns which use the
+// AddOnDeploymentConfig, either from their own configs or as resolved from the
+// ClusterManagementAddOn, sorted by name and namespace.
+func (v *Validator) referencingAddons(namespace, name string) ([]*addonapiv1beta1.ManagedClusterAddOn, error) {
+	addons, err := v.AddonLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the ManagedClusterAddOns: %w", err)
+	}
+
+	referent := addonapiv1beta1.ConfigReferent{Namespace: namespace, Name: name}
+	referencing := []*addonapiv1beta1.ManagedClusterAddOn{}
+
+	for _, addon := range addons {
+		if _, ok := Validators[addon.Name]; !ok {
+			continue
+		}
+
+		if usesDeploymentConfig(addon, referent) {
+			referencing = append(referencing, addon)
+		}
+	}
+
+	slices.SortFunc(referencing, func(a, b *addonapiv1beta1.ManagedClusterAddOn) int {
+		return strings.Compare(a.Name+"/"+a.Namespace, b.Name+"/"+b.Namespace)
+	})
+
+	return referencing, nil
+}
+
+func usesDeploymentConfig(addon *addonapiv1beta1.ManagedClusterAddOn, referent addonapiv1beta1.ConfigReferent) bool {
+	for _, config := range addon.Spec.Configs {
+		configReferent := config.ConfigReferent
+		if configReferent.Namespace == "" {
+			configReferent.Namespace = addon.Namespace
+		}
+
+		if config.Group == utils.AddOnDeploymentConfigGVR.Group &&
+			config.Resource == utils.AddOnDeploymentConfigGVR.Resource && configReferent == referent {
+			return true
+		}
+	}
+
+	for _, configRef := range addon.Status.ConfigReferences {
+		if configRef.Group == utils.AddOnDeploymentConfigGVR.Group &&
+			configRef.Resource == utils.AddOnDeploymentConfigGVR.Resource &&
+			configRef.DesiredConfig != nil && configRef.DesiredConfig.ConfigReferent == referent {
+			return true
+		}
+	}
+
+	return false
+}
+
+// response denies the request when there are rejected values, and otherwise
+// allows it with the warnings.
+func response(warnings []string, err error) admission.Response {
+	if err != nil {
+		log.V(1).Info("Denying the request with rejected values", "error", err.Error())
+
+		return admission.Denied("rejected values: " + strings.ReplaceAll(err.Error(), "\n", "; ")).
+			WithWarnings(warnings...)
+	}
+
+	return admission.Allowed("").WithWarnings(warnings...)
+}
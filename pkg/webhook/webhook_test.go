@@ -0,0 +1,213 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	addonapiv1beta1 "open-cluster-management.io/api/addon/v1beta1"
+	addonfake "open-cluster-management.io/api/client/addon/clientset/versioned/fake"
+	addonlistersv1beta1 "open-cluster-management.io/api/client/addon/listers/addon/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func request(t *testing.T, obj runtime.Object, kind string) admission.Request {
+	t.Helper()
+
+	obj.GetObjectKind().SetGroupVersionKind(addonapiv1beta1.SchemeGroupVersion.WithKind(kind))
+
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("failed to marshal the object: %v", err)
+	}
+
+	accessor, _ := obj.(metav1.Object)
+
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Namespace: accessor.GetNamespace(),
+		Name:      accessor.GetName(),
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+func TestValidateManagedClusterAddOn(t *testing.T) {
+	v := &Validator{
+		AddonClient: addonfake.NewSimpleClientset(),
+		Now:         time.Now,
+	}
+
+	tests := map[string]struct {
+		addonName       string
+		annotations     map[string]string
+		expectedAllowed bool
+		expectedWarning string
+	}{
+		"valid annotations": {
+			addonName:       "config-policy-controller",
+			annotations:     map[string]string{"client-qps": "20", "operator-policy-disabled": "true"},
+			expectedAllowed: true,
+		},
+		"out of range value": {
+			addonName:   "governance-policy-framework",
+			annotations: map[string]string{"client-qps": "0"},
+		},
+		"invalid pause-until": {
+			addonName:   "cert-policy-controller",
+			annotations: map[string]string{"policy-addon-pause-until": "tomorrow"},
+		},
+		"misspelled annotation": {
+			addonName:       "governance-policy-framework",
+			annotations:     map[string]string{"evaluation-concurrency": "2"},
+			expectedAllowed: true,
+			expectedWarning: "the annotation 'evaluation-concurrency' is not supported",
+		},
+		"other addon": {
+			addonName:       "work-manager",
+			annotations:     map[string]string{"client-qps": "0"},
+			expectedAllowed: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			addon := &addonapiv1beta1.ManagedClusterAddOn{ObjectMeta: metav1.ObjectMeta{
+				Name: test.addonName, Namespace: "cluster1", Annotations: test.annotations,
+			}}
+
+			resp := v.validateManagedClusterAddOn(context.TODO(), request(t, addon, "ManagedClusterAddOn"))
+			if resp.Allowed != test.expectedAllowed {
+				t.Fatalf("expected allowed to be %v, got response: %+v", test.expectedAllowed, resp.Result)
+			}
+
+			if test.expectedWarning != "" &&
+				(len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], test.expectedWarning)) {
+				t.Fatalf("expected a warning containing %q, got: %v", test.expectedWarning, resp.Warnings)
+			}
+		})
+	}
+}
+
+func TestValidateManagedClusterAddOnUpdate(t *testing.T) {
+	v := &Validator{AddonClient: addonfake.NewSimpleClientset(), Now: time.Now}
+
+	invalidAddon := &addonapiv1beta1.ManagedClusterAddOn{ObjectMeta: metav1.ObjectMeta{
+		Name: "config-policy-controller", Namespace: "cluster1", Annotations: map[string]string{"client-qps": "0"},
+	}}
+
+	update := func(oldAddon, newAddon *addonapiv1beta1.ManagedClusterAddOn) admission.Request {
+		req := request(t, newAddon, "ManagedClusterAddOn")
+		req.Operation = admissionv1.Update
+		req.OldObject = request(t, oldAddon, "ManagedClusterAddOn").Object
+
+		return req
+	}
+
+	t.Run("a finalizer-only update of an invalid addon is allowed with a warning", func(t *testing.T) {
+		newAddon := invalidAddon.DeepCopy()
+		newAddon.Finalizers = []string{"addon.open-cluster-management.io/addon-pre-delete"}
+
+		resp := v.validateManagedClusterAddOn(context.TODO(), update(invalidAddon, newAddon))
+		if !resp.Allowed || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "client-qps") {
+			t.Fatalf("expected the update to be allowed with the rejected value as a warning, got: %+v", resp)
+		}
+	})
+
+	t.Run("an update changing the annotations to an invalid value is denied", func(t *testing.T) {
+		oldAddon := invalidAddon.DeepCopy()
+		oldAddon.Annotations = nil
+
+		resp := v.validateManagedClusterAddOn(context.TODO(), update(oldAddon, invalidAddon))
+		if resp.Allowed {
+			t.Fatal("expected the invalid annotation to be denied")
+		}
+	})
+
+	t.Run("an addon being deleted is allowed", func(t *testing.T) {
+		newAddon := invalidAddon.DeepCopy()
+		newAddon.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+		newAddon.Annotations = map[string]string{"client-qps": "-1"}
+
+		resp := v.validateManagedClusterAddOn(context.TODO(), update(invalidAddon, newAddon))
+		if !resp.Allowed {
+			t.Fatalf("expected the deleted addon to be allowed, got: %+v", resp.Result)
+		}
+	})
+}
+
+func TestValidateAddOnDeploymentConfig(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	for _, addon := range []*addonapiv1beta1.ManagedClusterAddOn{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Namespace: "cluster1"},
+			Spec: addonapiv1beta1.ManagedClusterAddOnSpec{Configs: []addonapiv1beta1.AddOnConfig{{
+				ConfigGroupResource: addonapiv1beta1.ConfigGroupResource{
+					Group: "addon.open-cluster-management.io", Resource: "addondeploymentconfigs",
+				},
+				ConfigReferent: addonapiv1beta1.ConfigReferent{Name: "config"},
+			}}},
+		},
+		{
+			// A cluster whose name makes the namespace of some hosted install namespace templates too long
+			ObjectMeta: metav1.ObjectMeta{Name: "config-policy-controller", Namespace: strings.Repeat("a", 60)},
+			Spec: addonapiv1beta1.ManagedClusterAddOnSpec{Configs: []addonapiv1beta1.AddOnConfig{{
+				ConfigGroupResource: addonapiv1beta1.ConfigGroupResource{
+					Group: "addon.open-cluster-management.io", Resource: "addondeploymentconfigs",
+				},
+				ConfigReferent: addonapiv1beta1.ConfigReferent{Namespace: "cluster1", Name: "config"},
+			}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "work-manager", Namespace: "cluster1"},
+		},
+	} {
+		if err := indexer.Add(addon); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v := &Validator{AddonLister: addonlistersv1beta1.NewManagedClusterAddOnLister(indexer), Now: time.Now}
+
+	config := func(name string, variables ...addonapiv1beta1.CustomizedVariable) *addonapiv1beta1.AddOnDeploymentConfig {
+		return &addonapiv1beta1.AddOnDeploymentConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "cluster1"},
+			Spec:       addonapiv1beta1.AddOnDeploymentConfigSpec{CustomizedVariables: variables},
+		}
+	}
+
+	resp := v.validateAddOnDeploymentConfig(context.TODO(), request(t,
+		config("config", addonapiv1beta1.CustomizedVariable{Name: "logLevel", Value: "-5"}), "AddOnDeploymentConfig"))
+	if resp.Allowed {
+		t.Fatal("expected the invalid log level to be denied")
+	}
+
+	resp = v.validateAddOnDeploymentConfig(context.TODO(), request(t,
+		config("config", addonapiv1beta1.CustomizedVariable{Name: "logLevl", Value: "2"}), "AddOnDeploymentConfig"))
+	if !resp.Allowed || len(resp.Warnings) != 1 {
+		t.Fatalf("expected the unknown variable to be allowed with a warning, got: %+v", resp)
+	}
+
+	// The hosted install namespace is validated for each cluster using the config
+	resp = v.validateAddOnDeploymentConfig(context.TODO(), request(t,
+		config("config", addonapiv1beta1.CustomizedVariable{
+			Name: "hostedInstallNamespace", Value: "{{ .ClusterName }}-klusterlet",
+		}), "AddOnDeploymentConfig"))
+	if resp.Allowed || !strings.Contains(resp.Result.Message, strings.Repeat("a", 60)+"-klusterlet") {
+		t.Fatalf("expected the hosted install namespace of the long cluster name to be denied, got: %+v", resp)
+	}
+
+	resp = v.validateAddOnDeploymentConfig(context.TODO(), request(t,
+		config("unused", addonapiv1beta1.CustomizedVariable{Name: "logLevel", Value: "-5"}), "AddOnDeploymentConfig"))
+	if !resp.Allowed {
+		t.Fatal("expected a deployment config not used by a governance addon to be allowed")
+	}
+}